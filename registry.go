@@ -1,11 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"os"
 	"registry/api"
 	"registry/config"
+	"registry/fsck"
+	"registry/gc"
 	"registry/logger"
+	"registry/migrate"
+	"registry/reaper"
+	"registry/scrub"
 	"registry/storage"
+	"time"
 )
 
 func main() {
@@ -23,6 +31,200 @@ func main() {
 		logger.Fatal(err.Error())
 	}
 
+	switch flag.Arg(0) {
+	case "", "serve":
+		// fall through to serving
+	case "gc":
+		runGC(storage, cfg.GC, flag.Args()[1:])
+		return
+	case "fsck":
+		runFsck(storage, flag.Args()[1:])
+		return
+	case "migrate":
+		runMigrate(storage, flag.Args()[1:])
+		return
+	case "scrub":
+		runScrub(storage, cfg.Scrub, flag.Args()[1:])
+		return
+	case "reap":
+		runReap(storage, cfg.Reaper, flag.Args()[1:])
+		return
+	case "dedup":
+		runDedup(storage)
+		return
+	default:
+		logger.Fatal("Unknown command: %s", flag.Arg(0))
+	}
+
+	if cfg.GC != nil && cfg.GC.Interval != "" {
+		interval, err := time.ParseDuration(cfg.GC.Interval)
+		if err != nil {
+			logger.Fatal("Invalid gc interval: %s", err.Error())
+		}
+		gracePeriod, err := cfg.GC.ParseGracePeriod()
+		if err != nil {
+			logger.Fatal("Invalid gc grace_period: %s", err.Error())
+		}
+		go gc.Schedule(storage, interval, cfg.GC.DryRun, gracePeriod)
+	}
+	if cfg.Reaper != nil && cfg.Reaper.Interval != "" {
+		interval, err := time.ParseDuration(cfg.Reaper.Interval)
+		if err != nil {
+			logger.Fatal("Invalid reaper interval: %s", err.Error())
+		}
+		maxAge, err := cfg.Reaper.ParseMaxAge()
+		if err != nil {
+			logger.Fatal("Invalid reaper max_age: %s", err.Error())
+		}
+		go reaper.Schedule(storage, interval, maxAge, cfg.Reaper.Quarantine)
+	}
+
 	registryAPI := api.New(cfg.API, storage)
+	if cfg.Scrub != nil {
+		registryAPI.Scrubber = scrub.New(cfg.Scrub, storage)
+		if cfg.Scrub.Interval != "" {
+			interval, err := time.ParseDuration(cfg.Scrub.Interval)
+			if err != nil {
+				logger.Fatal("Invalid scrub interval: %s", err.Error())
+			}
+			go registryAPI.Scrubber.Run(interval)
+		}
+	}
 	logger.Fatal(registryAPI.ListenAndServe().Error())
 }
+
+// registry gc [-dry-run] [-grace-period 1h]
+func runGC(s storage.Storage, cfg *gc.Config, args []string) {
+	if cfg == nil {
+		cfg = &gc.Config{}
+	}
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be removed")
+	flags.StringVar(&cfg.GracePeriod, "grace-period", cfg.GracePeriod, "only remove images unreachable for this long")
+	flags.Parse(args)
+	gracePeriod, err := cfg.ParseGracePeriod()
+	if err != nil {
+		logger.Fatal("Invalid grace period: %s", err.Error())
+	}
+	report, err := gc.Collect(s, *dryRun, gracePeriod)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	printJson(report)
+}
+
+// registry fsck [-repair]. exits with 1 if anything is left broken.
+func runFsck(s storage.Storage, args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix what can be fixed")
+	flags.Parse(args)
+	report, err := fsck.Check(s, *repair)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	printJson(report)
+	if !report.Clean() {
+		os.Exit(1)
+	}
+}
+
+// registry migrate [-from storage.json] -to storage.json [-checkpoint migrate.json]. each file holds a storage config
+// block, -from defaults to the storage in the config. run it again with the same checkpoint to copy what changed.
+func runMigrate(s storage.Storage, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fromFile := flags.String("from", "", "storage config to copy from (default the storage in the config)")
+	toFile := flags.String("to", "", "storage config to copy to")
+	checkpointFile := flags.String("checkpoint", "migrate.json", "where to keep track of what was copied")
+	flags.Parse(args)
+	if *toFile == "" {
+		logger.Fatal("migrate needs -to")
+	}
+	from := s
+	if *fromFile != "" {
+		from = newStorageFromFile(*fromFile)
+	}
+	report, err := migrate.Migrate(from, newStorageFromFile(*toFile), *checkpointFile)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	printJson(report)
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func newStorageFromFile(filename string) storage.Storage {
+	cfg, err := migrate.LoadConfig(filename)
+	if err != nil {
+		logger.Fatal("Error reading %s: %s", filename, err.Error())
+	}
+	s, err := storage.New(cfg)
+	if err != nil {
+		logger.Fatal("Error initializing the storage in %s: %s", filename, err.Error())
+	}
+	return s
+}
+
+// registry reap [-max-age 24h] [-quarantine]. the defaults come from the reaper config.
+func runReap(s storage.Storage, cfg *reaper.Config, args []string) {
+	if cfg == nil {
+		cfg = &reaper.Config{}
+	}
+	flags := flag.NewFlagSet("reap", flag.ExitOnError)
+	flags.StringVar(&cfg.MaxAge, "max-age", cfg.MaxAge, "abort uploads that started longer ago than this")
+	flags.BoolVar(&cfg.Quarantine, "quarantine", cfg.Quarantine, "move abandoned images to quarantine/")
+	flags.Parse(args)
+	maxAge, err := cfg.ParseMaxAge()
+	if err != nil {
+		logger.Fatal("Invalid max age: %s", err.Error())
+	}
+	report, err := reaper.Reap(s, maxAge, cfg.Quarantine)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	printJson(report)
+}
+
+// registry scrub [-rate-limit bytes]. checks every layer once and exits with 1 if any is corrupt.
+func runScrub(s storage.Storage, cfg *scrub.Config, args []string) {
+	if cfg == nil {
+		cfg = &scrub.Config{}
+	}
+	flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+	flags.Int64Var(&cfg.RateLimit, "rate-limit", cfg.RateLimit, "bytes per second read from storage. 0 for no limit")
+	flags.Parse(args)
+	scrubber := scrub.New(cfg, s)
+	if err := scrubber.Pass(); err != nil {
+		logger.Fatal(err.Error())
+	}
+	status := scrubber.Status()
+	printJson(status)
+	if len(status.Corrupt) > 0 {
+		os.Exit(1)
+	}
+}
+
+// registry dedup. converts an existing local tree to deduplicated layers, run it with the registry stopped.
+func runDedup(s storage.Storage) {
+	// the layers are deduplicated where they are stored. the cached copies have the same content, so they stay valid.
+	if cache, ok := s.(*storage.Cache); ok {
+		s = cache.Backend()
+	}
+	local, ok := s.(*storage.Local)
+	if !ok {
+		logger.Fatal("dedup only works with local storage")
+	}
+	report, err := local.Deduplicate()
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	printJson(report)
+}
+
+func printJson(data interface{}) {
+	encoded, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	os.Stdout.Write(append(encoded, '\n'))
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"registry/auth"
+	"registry/layers"
+	"strings"
+	"testing"
+)
+
+func accessRequest(t *testing.T, method, url, username, body string) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "" {
+		req.SetBasicAuth(username, "password")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestNamespaceOwnership(t *testing.T) {
+	s := testLocalStorage(t, "/tmp/go-docker-registry-access-test")
+	defer s.RemoveAll("/")
+	for _, username := range []string{"admin", "alice", "bobby"} {
+		if _, err := auth.CreateUser(s, username, "password", username+"@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(New(&Config{Admins: []string{"admin"}}, s).Router())
+	defer server.Close()
+
+	for _, c := range []struct {
+		method, path, username, body string
+		code                         int
+	}{
+		{"PUT", "/v1/repositories/alice/app/", "alice", "[]", http.StatusOK},
+		{"PUT", "/v1/repositories/alice/app/", "bobby", "[]", http.StatusForbidden},
+		{"PUT", "/v1/repositories/alice/app/", "", "[]", http.StatusForbidden},
+		{"PUT", "/v1/repositories/alice/app/", "admin", "[]", http.StatusOK},
+		{"PUT", "/v1/repositories/unclaimed/app/", "", "[]", http.StatusOK},
+		{"PUT", "/v1/repositories/app/", "bobby", "[]", http.StatusForbidden},
+		{"PUT", "/v1/repositories/library/app/", "admin", "[]", http.StatusOK},
+		{"DELETE", "/v1/repositories/alice/app/images", "bobby", "", http.StatusForbidden},
+		{"PUT", "/v1/repositories/alice/app/tags/latest", "bobby", `"img"`, http.StatusForbidden},
+		{"DELETE", "/v1/repositories/alice/app/tags/latest", "bobby", "", http.StatusForbidden},
+		{"DELETE", "/v1/repositories/alice/app/", "", "", http.StatusForbidden},
+		{"PUT", "/v2/alice/app/manifests/latest", "bobby", "{}", http.StatusForbidden},
+		{"DELETE", "/v2/alice/app/manifests/latest", "", "", http.StatusForbidden},
+		{"POST", "/v2/alice/app/blobs/uploads/", "bobby", "", http.StatusForbidden},
+		{"POST", "/v2/alice/app/blobs/uploads/", "alice", "", http.StatusAccepted},
+		{"PATCH", "/v2/alice/app/blobs/uploads/someuuid", "bobby", "data", http.StatusForbidden},
+		{"DELETE", "/v2/alice/app/blobs/sha256:" + strings.Repeat("0", 64), "bobby", "", http.StatusForbidden},
+		{"POST", "/v2/app/blobs/uploads/", "alice", "", http.StatusForbidden},
+		{"POST", "/v2/app/blobs/uploads/", "admin", "", http.StatusAccepted},
+	} {
+		if code := accessRequest(t, c.method, server.URL+c.path, c.username, c.body); code != c.code {
+			t.Errorf("%s %s as %q: expected %d, got %d", c.method, c.path, c.username, c.code, code)
+		}
+	}
+}
+
+func TestImageWritesNeedTokens(t *testing.T) {
+	s := testLocalStorage(t, "/tmp/go-docker-registry-image-access-test")
+	defer s.RemoveAll("/")
+	if _, err := auth.CreateUser(s, "bobby", "password", "bobby@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(New(&Config{RequireToken: true}, s).Router())
+	defer server.Close()
+
+	for _, path := range []string{"/v1/images/img/json", "/v1/images/img/layer", "/v1/images/img/checksum"} {
+		if code := accessRequest(t, "PUT", server.URL+path, "bobby", `{"id":"img"}`); code != http.StatusUnauthorized {
+			t.Errorf("PUT %s without a token: expected 401, got %d", path, code)
+		}
+	}
+}
+
+func TestV2BlobsBelongToRepositories(t *testing.T) {
+	s := testLocalStorage(t, "/tmp/go-docker-registry-v2-access-test")
+	defer s.RemoveAll("/")
+	for _, username := range []string{"alice", "bobby"} {
+		if _, err := auth.CreateUser(s, username, "password", username+"@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(New(&Config{}, s).Router())
+	defer server.Close()
+
+	blob := "secret layer"
+	sum := sha256.Sum256([]byte(blob))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if code := accessRequest(t, "POST", server.URL+"/v2/alice/secret/blobs/uploads/?digest="+digest, "alice", blob); code != http.StatusCreated {
+		t.Fatalf("Expected the blob to be uploaded, got %d", code)
+	}
+	if err := layers.SetPrivate(s, "alice", "secret", nil); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"schemaVersion":2,"layers":[{"digest":"` + digest + `"}]}`
+
+	for _, c := range []struct {
+		method, path, username, body string
+		code                         int
+	}{
+		{"GET", "/v2/alice/secret/blobs/" + digest, "alice", "", http.StatusOK},
+		{"GET", "/v2/alice/secret/blobs/" + digest, "bobby", "", http.StatusNotFound},
+		{"GET", "/v2/bobby/app/blobs/" + digest, "bobby", "", http.StatusNotFound},
+		{"PUT", "/v2/bobby/app/manifests/latest", "bobby", manifest, http.StatusBadRequest},
+		// not allowed to mount it, so told to upload it instead
+		{"POST", "/v2/bobby/app/blobs/uploads/?mount=" + digest + "&from=alice/secret", "bobby", "", http.StatusAccepted},
+		{"POST", "/v2/alice/other/blobs/uploads/?mount=" + digest + "&from=alice/secret", "alice", "", http.StatusCreated},
+		{"GET", "/v2/alice/other/blobs/" + digest, "alice", "", http.StatusOK},
+		{"PUT", "/v2/alice/other/manifests/latest", "alice", manifest, http.StatusCreated},
+	} {
+		if code := accessRequest(t, c.method, server.URL+c.path, c.username, c.body); code != c.code {
+			t.Errorf("%s %s as %q: expected %d, got %d", c.method, c.path, c.username, c.code, code)
+		}
+	}
+}
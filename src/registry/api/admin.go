@@ -0,0 +1,62 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"registry/auth"
+	"registry/logger"
+	"registry/reaper"
+)
+
+// Rejects requests that don't log in (with basic auth) as one of the configured admins
+func (a *RegistryAPI) RequireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := a.authenticatedUser(r)
+		if err != nil {
+			a.unauthorized(w, err.Error())
+			return
+		} else if user == nil {
+			a.unauthorized(w, "Login required")
+			return
+		}
+		if a.isAdmin(user) {
+			handler(w, r)
+			return
+		}
+		a.response(w, "Not an admin", http.StatusForbidden, EMPTY_HEADERS)
+	}
+}
+
+func (a *RegistryAPI) isAdmin(user *auth.User) bool {
+	if user == nil {
+		return false
+	}
+	for _, admin := range a.Config.Admins {
+		if user.Username == admin {
+			return true
+		}
+	}
+	return false
+}
+
+// lists the images marked as in progress, oldest first
+func (a *RegistryAPI) GetUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	uploads, err := reaper.List(a.Storage)
+	if err != nil {
+		a.storageError(w, "Uploads", err)
+		return
+	}
+	a.response(w, uploads, http.StatusOK, EMPTY_HEADERS)
+}
+
+// removes an image that is being uploaded, or moves it to quarantine with ?quarantine=true
+func (a *RegistryAPI) AbortUploadHandler(w http.ResponseWriter, r *http.Request) {
+	imageID := mux.Vars(r)["imageID"]
+	quarantine := r.URL.Query().Get("quarantine") == "true"
+	if err := reaper.Abort(a.Storage, imageID, quarantine); err != nil {
+		a.storageError(w, "Upload", err)
+		return
+	}
+	logger.Info("[AbortUpload][%s] aborted by %s (quarantine=%t)", imageID, a.requestUsername(r), quarantine)
+	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
+}
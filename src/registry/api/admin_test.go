@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"registry/auth"
+	"registry/layers"
+	"registry/reaper"
+	"registry/storage"
+	"testing"
+)
+
+func adminRequest(t *testing.T, method, url, username string) (int, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "" {
+		req.SetBasicAuth(username, "password")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestAdminUploads(t *testing.T) {
+	s := testLocalStorage(t, "/tmp/go-docker-registry-admin-test")
+	defer s.RemoveAll("/")
+	for _, username := range []string{"admin", "someone"} {
+		if _, err := auth.CreateUser(s, username, "password", username+"@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Put(storage.ImageJsonPath("stuck"), []byte(`{"id":"stuck"}`))
+	layers.MarkInProgress(s, "stuck")
+	server := httptest.NewServer(New(&Config{Admins: []string{"admin"}}, s).Router())
+	defer server.Close()
+
+	if code, _ := adminRequest(t, "GET", server.URL+"/v1/_admin/uploads", ""); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a login, got %d", code)
+	}
+	if code, _ := adminRequest(t, "GET", server.URL+"/v1/_admin/uploads", "someone"); code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for someone who isn't an admin, got %d", code)
+	}
+	code, body := adminRequest(t, "GET", server.URL+"/v1/_admin/uploads", "admin")
+	uploads := []reaper.Upload{}
+	if err := json.Unmarshal(body, &uploads); code != http.StatusOK || err != nil {
+		t.Fatalf("Expected the uploads, got %d %s", code, body)
+	}
+	if len(uploads) != 1 || uploads[0].ImageID != "stuck" || uploads[0].StartedAt == nil {
+		t.Fatalf("Expected the stuck upload, got %+v", uploads)
+	}
+	if code, body := adminRequest(t, "DELETE", server.URL+"/v1/_admin/uploads/stuck", "admin"); code != http.StatusOK {
+		t.Fatalf("Expected the upload to be aborted, got %d %s", code, body)
+	}
+	if exists, _ := s.Exists(storage.ImageDir("stuck")); exists {
+		t.Fatal("The aborted image should have been removed")
+	}
+	if code, _ := adminRequest(t, "DELETE", server.URL+"/v1/_admin/uploads/stuck", "admin"); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 aborting an upload that isn't in progress, got %d", code)
+	}
+}
@@ -5,32 +5,67 @@ import (
 	"fmt"
 	"github.com/cespare/go-apachelog"
 	"github.com/gorilla/mux"
+	"registry/mirror"
+	"registry/scrub"
 	"registry/storage"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"time"
 )
 
+// set at build time with -ldflags "-X registry/api.VERSION=..."
+var VERSION = "dev"
+
 var USER_AGENT_REGEXP = regexp.MustCompile("([^\\s/]+)/([^\\s/]+)")
 var EMPTY_HEADERS = map[string][]string{}
 
 type Config struct {
 	Addr           string              `json:"addr"`
 	DefaultHeaders map[string][]string `json:"default_headers"`
+	RequireLogin   bool                `json:"require_login"` // reject pushes without valid basic auth
+	RequireToken   bool                `json:"require_token"` // reject image and tag requests without a token
+	TokenSecret    string              `json:"token_secret"`  // HMAC key for tokens. random per process if empty
+	TokenTTL       string              `json:"token_ttl"`     // how long tokens are valid for (default "1h")
+	Mirror         *mirror.Config      `json:"mirror"`        // serve as a pull-through cache of another registry
+	Admins         []string            `json:"admins"`        // users allowed to use /v1/_admin. none if empty
 }
 
 type RegistryAPI struct {
 	*Config
-	Storage storage.Storage
+	Storage     storage.Storage
+	startedAt   time.Time
+	status      *backgroundStatus
+	tokenSecret []byte
+	tokenTTL    time.Duration
+	mirror      *mirror.Mirror
+	Scrubber    *scrub.Scrubber // set to refuse layers it found corrupt (if it blocks them) and report its status
 }
 
 func New(cfg *Config, storage storage.Storage) *RegistryAPI {
-	return &RegistryAPI{Config: cfg, Storage: storage}
+	a := &RegistryAPI{
+		Config:      cfg,
+		Storage:     storage,
+		startedAt:   time.Now(),
+		status:      &backgroundStatus{},
+		tokenSecret: tokenSecret(cfg),
+		tokenTTL:    tokenTTL(cfg),
+	}
+	if cfg.Mirror != nil && cfg.Mirror.Upstream != "" {
+		a.mirror = mirror.New(cfg.Mirror, storage)
+	}
+	return a
 }
 
 func (a *RegistryAPI) ListenAndServe() error {
+	a.refreshStatus()
+	log.Printf("Listening on %s", a.Config.Addr)
+	return http.ListenAndServe(a.Config.Addr, apachelog.NewHandler(a.Router(), os.Stderr))
+}
+
+func (a *RegistryAPI) Router() *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/", a.HomeHandler)
 
@@ -45,40 +80,49 @@ func (a *RegistryAPI) ListenAndServe() error {
 	// Undocumented but implemented in docker-registry 0.6.5
 	r.HandleFunc("/_status", a.StatusHandler)
 	r.HandleFunc("/v1/_status", a.StatusHandler)
+	// Administration (additional)
+	r.HandleFunc("/v1/_admin/uploads", a.RequireAdmin(a.GetUploadsHandler)).Methods("GET")
+	r.HandleFunc("/v1/_admin/uploads/{imageID}", a.RequireAdmin(a.AbortUploadHandler)).Methods("DELETE")
 
 	// http://docs.docker.io/en/latest/reference/api/registry_api/#images
 	// Documented and implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/images/{imageID}/layer", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageLayerHandler))).Methods("GET")
-	r.HandleFunc("/v1/images/{imageID}/layer", a.PutImageLayerHandler).Methods("PUT")
-	r.HandleFunc("/v1/images/{imageID}/json", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageJsonHandler))).Methods("GET")
-	r.HandleFunc("/v1/images/{imageID}/json", a.PutImageJsonHandler).Methods("PUT")
-	r.HandleFunc("/v1/images/{imageID}/ancestry", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageAncestryHandler))).Methods("GET")
+	r.HandleFunc("/v1/images/{imageID}/layer", a.RequireImageAccess("read", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageLayerHandler)))).Methods("GET")
+	r.HandleFunc("/v1/images/{imageID}/layer", a.RequireImageAccess("write", a.PutImageLayerHandler)).Methods("PUT")
+	// Resumable chunked layer uploads (additional)
+	r.HandleFunc("/v1/images/{imageID}/layer/uploads/", a.RequireImageAccess("write", a.StartImageLayerUploadHandler)).Methods("POST")
+	r.HandleFunc("/v1/images/{imageID}/layer/uploads/{uuid}", a.RequireImageAccess("write", a.GetImageLayerUploadHandler)).Methods("GET")
+	r.HandleFunc("/v1/images/{imageID}/layer/uploads/{uuid}", a.RequireImageAccess("write", a.PatchImageLayerUploadHandler)).Methods("PATCH")
+	r.HandleFunc("/v1/images/{imageID}/layer/uploads/{uuid}", a.RequireImageAccess("write", a.PutImageLayerUploadHandler)).Methods("PUT")
+	r.HandleFunc("/v1/images/{imageID}/layer/uploads/{uuid}", a.RequireImageAccess("write", a.DeleteImageLayerUploadHandler)).Methods("DELETE")
+	r.HandleFunc("/v1/images/{imageID}/json", a.RequireImageAccess("read", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageJsonHandler)))).Methods("GET")
+	r.HandleFunc("/v1/images/{imageID}/json", a.RequireImageAccess("write", a.PutImageJsonHandler)).Methods("PUT")
+	r.HandleFunc("/v1/images/{imageID}/ancestry", a.RequireImageAccess("read", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageAncestryHandler)))).Methods("GET")
 	// Undocumented but implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/images/{imageID}/checksum", a.PutImageChecksumHandler).Methods("PUT")
-	r.HandleFunc("/v1/images/{imageID}/files", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageFilesHandler))).Methods("GET")
-	r.HandleFunc("/v1/images/{imageID}/diff", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageDiffHandler))).Methods("GET")
+	r.HandleFunc("/v1/images/{imageID}/checksum", a.RequireImageAccess("write", a.PutImageChecksumHandler)).Methods("PUT")
+	r.HandleFunc("/v1/images/{imageID}/files", a.RequireImageAccess("read", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageFilesHandler)))).Methods("GET")
+	r.HandleFunc("/v1/images/{imageID}/diff", a.RequireImageAccess("read", a.RequireCompletion(a.CheckIfModifiedSince(a.GetImageDiffHandler)))).Methods("GET")
 
 	// http://docs.docker.io/en/latest/reference/api/registry_api/#tags
 	// Documented and implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/repositories/{repo}/tags", a.GetRepoTagsHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{repo}/tags/{tag}", a.GetRepoTagHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{repo}/tags/{tag}", a.PutRepoTagHandler).Methods("PUT")
-	r.HandleFunc("/v1/repositories/{repo}/tags/{tag}", a.DeleteRepoTagHandler).Methods("DELETE")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags", a.GetRepoTagsHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags/{tag}", a.GetRepoTagHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags/{tag}", a.PutRepoTagHandler).Methods("PUT")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags/{tag}", a.DeleteRepoTagHandler).Methods("DELETE")
+	r.HandleFunc("/v1/repositories/{repo}/tags", a.RequireAccess("read", a.GetRepoTagsHandler)).Methods("GET")
+	r.HandleFunc("/v1/repositories/{repo}/tags/{tag}", a.RequireAccess("read", a.GetRepoTagHandler)).Methods("GET")
+	r.HandleFunc("/v1/repositories/{repo}/tags/{tag}", a.RequireAccess("write", a.PutRepoTagHandler)).Methods("PUT")
+	r.HandleFunc("/v1/repositories/{repo}/tags/{tag}", a.RequireAccess("delete", a.DeleteRepoTagHandler)).Methods("DELETE")
+	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags", a.RequireAccess("read", a.GetRepoTagsHandler)).Methods("GET")
+	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags/{tag}", a.RequireAccess("read", a.GetRepoTagHandler)).Methods("GET")
+	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags/{tag}", a.RequireAccess("write", a.PutRepoTagHandler)).Methods("PUT")
+	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags/{tag}", a.RequireAccess("delete", a.DeleteRepoTagHandler)).Methods("DELETE")
 	// Undocumented but implemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/repositories/{repo}/tags", a.DeleteRepoTagsHandler).Methods("DELETE")
-	r.HandleFunc("/v1/repositories/{repo}/json", a.GetRepoJsonHandler).Methods("GET")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags", a.DeleteRepoTagsHandler).Methods("DELETE")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/json", a.GetRepoJsonHandler).Methods("GET")
+	r.HandleFunc("/v1/repositories/{repo}/tags", a.RequireAccess("delete", a.DeleteRepoTagsHandler)).Methods("DELETE")
+	r.HandleFunc("/v1/repositories/{repo}/json", a.RequireAccess("read", a.GetRepoJsonHandler)).Methods("GET")
+	r.HandleFunc("/v1/repositories/{namespace}/{repo}/tags", a.RequireAccess("delete", a.DeleteRepoTagsHandler)).Methods("DELETE")
+	r.HandleFunc("/v1/repositories/{namespace}/{repo}/json", a.RequireAccess("read", a.GetRepoJsonHandler)).Methods("GET")
 	// Documented and unimplemented in docker-registry 0.6.5
-	r.HandleFunc("/v1/repositories/{repo}/", a.DeleteRepoHandler).Methods("DELETE")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}/", a.DeleteRepoHandler).Methods("DELETE")
+	r.HandleFunc("/v1/repositories/{repo}/", a.RequireAccess("delete", a.DeleteRepoHandler)).Methods("DELETE")
+	r.HandleFunc("/v1/repositories/{namespace}/{repo}/", a.RequireAccess("delete", a.DeleteRepoHandler)).Methods("DELETE")
 	// Undocumented and unimplemented (additional)
-	r.HandleFunc("/v1/repositories/{repo}", a.DeleteRepoHandler).Methods("DELETE")
-	r.HandleFunc("/v1/repositories/{namespace}/{repo}", a.DeleteRepoHandler).Methods("DELETE")
+	r.HandleFunc("/v1/repositories/{repo}", a.RequireAccess("delete", a.DeleteRepoHandler)).Methods("DELETE")
+	r.HandleFunc("/v1/repositories/{namespace}/{repo}", a.RequireAccess("delete", a.DeleteRepoHandler)).Methods("DELETE")
 
 	// Unused (for private images)
 	//r.HandleFunc("/v1/private_images/{imageID}/layer", a.GetPrivateImageLayerHandler).Methods("GET")
@@ -89,6 +133,24 @@ func (a *RegistryAPI) ListenAndServe() error {
 	//r.HandleFunc("/v1/repositories/{namespace}/{repo}/properties", a.GetRepoPropertiesHandler).Methods("GET")
 	//r.HandleFunc("/v1/repositories/{namespace}/{repo}/properties", a.PutRepoPropertiesHandler).Methods("PUT")
 
+	//
+	// Registry V2 APIs (https://docs.docker.com/registry/spec/api/)
+	//
+
+	// names may contain slashes, so {name} is greedy and the fixed suffixes disambiguate the routes
+	r.HandleFunc("/v2/", a.V2BaseHandler).Methods("GET")
+	r.HandleFunc("/v2/{name:.+}/tags/list", a.RequireV2Read(a.GetV2TagsHandler)).Methods("GET")
+	r.HandleFunc("/v2/{name:.+}/manifests/{reference}", a.RequireV2Read(a.GetV2ManifestHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/v2/{name:.+}/manifests/{reference}", a.RequireV2Write(a.PutV2ManifestHandler)).Methods("PUT")
+	r.HandleFunc("/v2/{name:.+}/manifests/{reference}", a.RequireV2Write(a.DeleteV2ManifestHandler)).Methods("DELETE")
+	r.HandleFunc("/v2/{name:.+}/blobs/uploads/", a.RequireV2Write(a.StartV2UploadHandler)).Methods("POST")
+	r.HandleFunc("/v2/{name:.+}/blobs/uploads/{uuid}", a.RequireV2Write(a.GetV2UploadHandler)).Methods("GET")
+	r.HandleFunc("/v2/{name:.+}/blobs/uploads/{uuid}", a.RequireV2Write(a.PatchV2UploadHandler)).Methods("PATCH")
+	r.HandleFunc("/v2/{name:.+}/blobs/uploads/{uuid}", a.RequireV2Write(a.PutV2UploadHandler)).Methods("PUT")
+	r.HandleFunc("/v2/{name:.+}/blobs/uploads/{uuid}", a.RequireV2Write(a.DeleteV2UploadHandler)).Methods("DELETE")
+	r.HandleFunc("/v2/{name:.+}/blobs/{digest}", a.RequireV2Read(a.GetV2BlobHandler)).Methods("GET", "HEAD")
+	r.HandleFunc("/v2/{name:.+}/blobs/{digest}", a.RequireV2Write(a.DeleteV2BlobHandler)).Methods("DELETE")
+
 	//
 	// Index APIs (http://docs.docker.io/en/latest/reference/api/index_api/)
 	//
@@ -121,8 +183,7 @@ func (a *RegistryAPI) ListenAndServe() error {
 	// Documented and implemented in docker-registry 0.6.5
 	r.HandleFunc("/v1/search", a.SearchHandler).Methods("GET")
 
-	log.Printf("Listening on %s", a.Config.Addr)
-	return http.ListenAndServe(a.Config.Addr, apachelog.NewHandler(r, os.Stderr))
+	return r
 }
 
 func (a *RegistryAPI) response(w http.ResponseWriter, data interface{}, code int, headers map[string][]string) {
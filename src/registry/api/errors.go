@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"registry/logger"
+	"registry/storage"
+)
+
+// the status for a failed storage operation: 404 if what was asked for isn't there, 409 if it already is, is being
+// uploaded or kept being written concurrently, 507 if the storage is full, 503 if the backend failed in a way that
+// may go away (so clients retry rather than give up) and 500 for anything else
+func storageErrorStatus(err error) int {
+	switch {
+	case storage.IsNotFound(err):
+		return http.StatusNotFound
+	case storage.IsAlreadyExists(err), storage.IsUploadInProgress(err), storage.IsConflict(err):
+		return http.StatusConflict
+	case storage.IsFull(err):
+		return http.StatusInsufficientStorage
+	case storage.IsTransient(err):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// responds to a failed storage operation on what ("Image", "Tag", ...)
+func (a *RegistryAPI) storageError(w http.ResponseWriter, what string, err error) {
+	switch code := storageErrorStatus(err); code {
+	case http.StatusNotFound:
+		a.response(w, what+" not found: "+err.Error(), code, EMPTY_HEADERS)
+	case http.StatusConflict:
+		a.response(w, err.Error(), code, EMPTY_HEADERS)
+	case http.StatusInsufficientStorage:
+		logger.Error("[Storage] %s", err.Error())
+		a.response(w, err.Error(), code, EMPTY_HEADERS)
+	case http.StatusServiceUnavailable:
+		logger.Error("[Storage] %s", err.Error())
+		a.response(w, "Storage unavailable, retry later: "+err.Error(), code, EMPTY_HEADERS)
+	default:
+		logger.Error("[Storage] %s", err.Error())
+		a.internalError(w, err.Error())
+	}
+}
+
+// same for the v2 api, where code and message are used for 404s
+func (a *RegistryAPI) v2StorageError(w http.ResponseWriter, code, message string, err error) {
+	switch status := storageErrorStatus(err); status {
+	case http.StatusNotFound:
+		a.v2Error(w, code, message, status)
+	case http.StatusServiceUnavailable:
+		logger.Error("[Storage] %s", err.Error())
+		a.v2Error(w, "UNAVAILABLE", "storage temporarily unavailable, retry later", status)
+	default:
+		logger.Error("[Storage] %s", err.Error())
+		a.v2Error(w, "UNKNOWN", err.Error(), status)
+	}
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"registry/storage"
+	"testing"
+)
+
+// fails every Get the way S3 does when it is down
+type unavailableStorage struct {
+	storage.Storage
+}
+
+func (s *unavailableStorage) Get(relpath string) ([]byte, error) {
+	return nil, &storage.Error{Kind: storage.ErrTransient, Path: relpath, Err: errors.New("connection refused")}
+}
+
+func TestStorageErrors(t *testing.T) {
+	s := testLocalStorage(t, "/tmp/go-docker-registry-errors-test")
+	defer s.RemoveAll("/")
+	server := httptest.NewServer(New(&Config{}, s).Router())
+	defer server.Close()
+	if code, _ := getBody(t, server.URL+"/v1/repositories/foo/tags/latest"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing tag, got %d", code)
+	}
+
+	unavailable := httptest.NewServer(New(&Config{}, &unavailableStorage{s}).Router())
+	defer unavailable.Close()
+	if code, _ := getBody(t, unavailable.URL+"/v1/repositories/foo/tags/latest"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with the storage down, got %d", code)
+	}
+	if code, _ := getBody(t, unavailable.URL+"/v2/foo/manifests/latest"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for v2 with the storage down, got %d", code)
+	}
+	for err, code := range map[error]int{
+		&storage.Error{Kind: storage.ErrNotFound}:         http.StatusNotFound,
+		&storage.Error{Kind: storage.ErrAlreadyExists}:    http.StatusConflict,
+		&storage.Error{Kind: storage.ErrUploadInProgress}: http.StatusConflict,
+		&storage.Error{Kind: storage.ErrFull}:             http.StatusInsufficientStorage,
+		errors.New("disk on fire"):                        http.StatusInternalServerError,
+	} {
+		if got := storageErrorStatus(err); got != code {
+			t.Errorf("Expected %d for %v, got %d", code, err, got)
+		}
+	}
+}
@@ -35,52 +35,83 @@ func (a *RegistryAPI) GetImageLayerHandler(w http.ResponseWriter, r *http.Reques
 	vars := mux.Vars(r)
 	imageID := vars["imageID"]
 	headers := DefaultCacheHeaders()
+	if a.Scrubber != nil && a.Scrubber.Blocked(imageID) {
+		a.response(w, "Image layer is corrupt", http.StatusGone, EMPTY_HEADERS)
+		return
+	}
 	reader, err := a.Storage.GetReader(storage.ImageLayerPath(imageID))
-	if err != nil {
-		// every "Image not found" response in this file.
-		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+	if storage.IsNotFound(err) && a.mirror != nil {
+		a.mirrorImageLayer(w, imageID, headers)
+		return
+	} else if err != nil {
+		a.storageError(w, "Image", err)
 		return
 	}
+	defer reader.Close()
 	a.response(w, reader, http.StatusOK, headers)
 }
 
 func (a *RegistryAPI) PutImageLayerHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	imageID := vars["imageID"]
+	jsonContent, ok := a.checkImageLayerWritable(w, imageID)
+	if !ok {
+		return
+	}
+	a.storeImageLayer(w, imageID, jsonContent, r.Body)
+}
+
+// returns the image json if the layer for imageID may be written. writes the error response otherwise.
+func (a *RegistryAPI) checkImageLayerWritable(w http.ResponseWriter, imageID string) ([]byte, bool) {
 	jsonContent, err := a.Storage.Get(storage.ImageJsonPath(imageID))
 	if err != nil {
-		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
-		return
+		a.storageError(w, "Image", err)
+		return nil, false
 	}
-	layerPath := storage.ImageLayerPath(imageID)
-	markPath := storage.ImageMarkPath(imageID)
-	layerExists, _ := a.Storage.Exists(layerPath)
-	markExists, _ := a.Storage.Exists(markPath)
+	layerExists, _ := a.Storage.Exists(storage.ImageLayerPath(imageID))
+	markExists, _ := a.Storage.Exists(storage.ImageMarkPath(imageID))
 	if layerExists && !markExists {
 		a.response(w, "Image already exists", http.StatusConflict, EMPTY_HEADERS)
-		return
+		return nil, false
 	}
+	return jsonContent, true
+}
+
+// stores the layer read from body and checks it against the stored checksum (if there is one). returns true if the
+// layer was stored and accepted, so whatever it was read from isn't needed anymore.
+func (a *RegistryAPI) storeImageLayer(w http.ResponseWriter, imageID string, jsonContent []byte, body io.Reader) bool {
+	layerPath := storage.ImageLayerPath(imageID)
 	// This next section reads the tarball from the body while computing various checksums. sha256Writer is used
 	// to compute a checksum of the entire tarball using a TeeReader which will read from the body while
-	// simultaneously writing what it read to sha256Writer. tarInfo will read the tar after it is put into the
-	// storage and checksum each individual file within it (and checksum those checksums with the jsonContent)
+	// simultaneously writing what it read to sha256Writer. tarInfo reads the tar from the same TeeReader (through a
+	// pipe) as it is written to storage and checksums each individual file within it (and checksums those checksums
+	// with the jsonContent), so nothing has to be read back from storage.
 	sha256Writer := sha256.New()
 	sha256Writer.Write(jsonContent)
-	teeReader := io.TeeReader(r.Body, sha256Writer)
 	// this will create the checksums for a tar and the json for tar file info
 	tarInfo := layers.NewTarInfo()
-	// PutReader takes a function that will run after the write finishes:
-	err = a.Storage.PutReader(layerPath, teeReader, tarInfo.Load)
+	tarReader, tarWriter := io.Pipe()
+	loaded := make(chan bool)
+	go func() {
+		tarInfo.LoadReader(tarReader)
+		// whatever comes after the end of the tar (or after it turns out not to be one) still has to be taken
+		io.Copy(ioutil.Discard, tarReader)
+		close(loaded)
+	}()
+	teeReader := io.TeeReader(body, io.MultiWriter(sha256Writer, tarWriter))
+	err := a.Storage.PutReader(layerPath, teeReader, noopAfterWrite)
+	tarWriter.CloseWithError(err)
+	<-loaded
 	if err != nil {
 		a.response(w, "Internal Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
-		return
+		return false
 	}
 	checksums := map[string]bool{"sha256:" + hex.EncodeToString(sha256Writer.Sum(nil)): true}
 	if tarInfo.Error == nil {
 		filesJson, err := tarInfo.TarFilesInfo.Json()
 		if err != nil {
 			a.response(w, "Internal Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
-			return
+			return false
 		}
 		layers.SetImageFilesCache(a.Storage, imageID, filesJson)
 		checksums[tarInfo.TarSum.Compute(jsonContent)] = true
@@ -95,19 +126,149 @@ func (a *RegistryAPI) PutImageLayerHandler(w http.ResponseWriter, r *http.Reques
 		cookieString = strings.TrimSuffix(cookieString, COOKIE_SEPARATOR)
 		http.SetCookie(w, &http.Cookie{Name: "checksum", Value: cookieString})
 		a.response(w, true, http.StatusOK, EMPTY_HEADERS)
-		return
+		return true
 	}
 	if !checksums[string(storedSum)] {
 		logger.Debug("[PutImageLayer]["+imageID+"] Wrong checksum:"+string(storedSum)+" not in %#v", checksums)
 		a.response(w, "Checksum mismatch, ignoring the layer", http.StatusBadRequest, EMPTY_HEADERS)
-		return
+		return false
 	}
-	if err := a.Storage.Remove(markPath); err != nil {
+	if err := layers.ClearMark(a.Storage, imageID); err == layers.ErrUploadAborted {
+		a.response(w, err.Error(), http.StatusConflict, EMPTY_HEADERS)
+		return false
+	} else if err != nil {
 		logger.Debug("[PutImageLayer]["+imageID+"] Error removing mark path: %s", err.Error())
 		a.response(w, "Internal Error", http.StatusInternalServerError, EMPTY_HEADERS)
-		return
+		return false
 	}
 	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
+	return true
+}
+
+// Resumable layer uploads. A client starts a session with POST, sends the layer in as many PATCH requests as it
+// likes (resuming from the offset reported by GET if a connection drops) and finishes with a PUT carrying the
+// sha256 digest of the whole layer. The finished layer then goes through the same checks as PutImageLayerHandler.
+
+func imageLayerUploadLocation(imageID, uuid string) string {
+	return "/v1/images/" + imageID + "/layer/uploads/" + uuid
+}
+
+func (a *RegistryAPI) StartImageLayerUploadHandler(w http.ResponseWriter, r *http.Request) {
+	imageID := mux.Vars(r)["imageID"]
+	if _, ok := a.checkImageLayerWritable(w, imageID); !ok {
+		return
+	}
+	upload, err := layers.NewUpload(a.Storage, imageID)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	logger.Debug("[StartImageLayerUpload][%s] uuid=%s", imageID, upload.UUID)
+	location := imageLayerUploadLocation(imageID, upload.UUID)
+	a.response(w, nil, http.StatusAccepted, uploadHeaders(map[string][]string{}, location, upload.UUID, 0))
+}
+
+func (a *RegistryAPI) getImageLayerUpload(w http.ResponseWriter, r *http.Request) *layers.Upload {
+	vars := mux.Vars(r)
+	upload, err := layers.GetUpload(a.Storage, vars["uuid"])
+	if storage.IsTransient(err) {
+		a.storageError(w, "Upload", err)
+		return nil
+	} else if err != nil || upload.ImageID != vars["imageID"] {
+		a.response(w, "Upload not found", http.StatusNotFound, EMPTY_HEADERS)
+		return nil
+	}
+	return upload
+}
+
+func (a *RegistryAPI) imageLayerUploadError(w http.ResponseWriter, upload *layers.Upload, err error) {
+	switch err.(type) {
+	case layers.RangeError:
+		location := imageLayerUploadLocation(upload.ImageID, upload.UUID)
+		headers := uploadHeaders(map[string][]string{}, location, upload.UUID, upload.Offset)
+		a.response(w, err.Error(), http.StatusRequestedRangeNotSatisfiable, headers)
+	case layers.DigestError:
+		a.response(w, err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+	default:
+		if err == layers.ErrUploadAborted {
+			a.response(w, err.Error(), http.StatusConflict, EMPTY_HEADERS)
+			return
+		}
+		a.storageError(w, "Image", err)
+	}
+}
+
+func (a *RegistryAPI) GetImageLayerUploadHandler(w http.ResponseWriter, r *http.Request) {
+	upload := a.getImageLayerUpload(w, r)
+	if upload == nil {
+		return
+	}
+	location := imageLayerUploadLocation(upload.ImageID, upload.UUID)
+	a.response(w, nil, http.StatusNoContent, uploadHeaders(map[string][]string{}, location, upload.UUID, upload.Offset))
+}
+
+func (a *RegistryAPI) PatchImageLayerUploadHandler(w http.ResponseWriter, r *http.Request) {
+	upload := a.getImageLayerUpload(w, r)
+	if upload == nil {
+		return
+	}
+	logger.Debug("[PatchImageLayerUpload][%s] uuid=%s; offset=%d", upload.ImageID, upload.UUID, upload.Offset)
+	if err := a.appendUploadChunk(r, upload); err != nil {
+		a.imageLayerUploadError(w, upload, err)
+		return
+	}
+	location := imageLayerUploadLocation(upload.ImageID, upload.UUID)
+	a.response(w, nil, http.StatusAccepted, uploadHeaders(map[string][]string{}, location, upload.UUID, upload.Offset))
+}
+
+func (a *RegistryAPI) PutImageLayerUploadHandler(w http.ResponseWriter, r *http.Request) {
+	digest := r.URL.Query().Get("digest")
+	if digest == "" {
+		a.response(w, "Missing digest", http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	}
+	upload := a.getImageLayerUpload(w, r)
+	if upload == nil {
+		return
+	}
+	logger.Debug("[PutImageLayerUpload][%s] uuid=%s; digest=%s", upload.ImageID, upload.UUID, digest)
+	if r.ContentLength != 0 {
+		if err := a.appendUploadChunk(r, upload); err != nil {
+			a.imageLayerUploadError(w, upload, err)
+			return
+		}
+	}
+	if err := upload.Verify(digest); err != nil {
+		a.imageLayerUploadError(w, upload, err)
+		return
+	}
+	jsonContent, ok := a.checkImageLayerWritable(w, upload.ImageID)
+	if !ok {
+		return
+	}
+	if err := upload.Claim(a.Storage); err != nil {
+		a.imageLayerUploadError(w, upload, err)
+		return
+	}
+	reader := upload.Reader(a.Storage)
+	defer reader.Close()
+	if a.storeImageLayer(w, upload.ImageID, jsonContent, reader) {
+		upload.Cancel(a.Storage)
+	} else {
+		upload.Release(a.Storage)
+	}
+}
+
+func (a *RegistryAPI) DeleteImageLayerUploadHandler(w http.ResponseWriter, r *http.Request) {
+	upload := a.getImageLayerUpload(w, r)
+	if upload == nil {
+		return
+	}
+	if err := upload.Cancel(a.Storage); err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	a.response(w, "", http.StatusNoContent, EMPTY_HEADERS)
 }
 
 // Must be wrapped by: RequiresCompletion, CheckIfModifiedSince
@@ -117,8 +278,13 @@ func (a *RegistryAPI) GetImageJsonHandler(w http.ResponseWriter, r *http.Request
 	imageID := vars["imageID"]
 	headers := DefaultCacheHeaders()
 	data, err := a.Storage.Get(storage.ImageJsonPath(imageID))
-	if err != nil {
-		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+	if storage.IsNotFound(err) && a.mirror != nil {
+		if data, err = a.mirror.FetchImageJson(imageID); err != nil {
+			a.mirrorError(w, err)
+			return
+		}
+	} else if err != nil {
+		a.storageError(w, "Image", err)
 		return
 	}
 	// docker-registry seems to not worry about errors that occur here. i guess we won't either.
@@ -130,7 +296,7 @@ func (a *RegistryAPI) GetImageJsonHandler(w http.ResponseWriter, r *http.Request
 	checksumPath := storage.ImageChecksumPath(imageID)
 	if exists, _ := a.Storage.Exists(checksumPath); exists {
 		checksum, err := a.Storage.Get(checksumPath)
-		if err != nil {
+		if err == nil {
 			headers["X-Docker-Checksum"] = []string{string(checksum)}
 		}
 	}
@@ -140,6 +306,10 @@ func (a *RegistryAPI) GetImageJsonHandler(w http.ResponseWriter, r *http.Request
 func (a *RegistryAPI) PutImageJsonHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	imageID := vars["imageID"]
+	user, ok := a.pushUser(w, r)
+	if !ok {
+		return
+	}
 	// decode json from request body
 	bodyBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -195,7 +365,7 @@ func (a *RegistryAPI) PutImageJsonHandler(w http.ResponseWriter, r *http.Request
 			return
 		}
 	}
-	err = a.Storage.Put(markPath, []byte("true"))
+	err = layers.MarkInProgress(a.Storage, imageID)
 	if err != nil {
 		a.response(w, "Put Mark Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
@@ -209,6 +379,9 @@ func (a *RegistryAPI) PutImageJsonHandler(w http.ResponseWriter, r *http.Request
 		a.response(w, "Generate Ancestry Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
 	}
+	if user != nil {
+		logger.Info("[PutImageJson][%s] pushed by %s", imageID, user.Username)
+	}
 	a.response(w, "true", http.StatusOK, EMPTY_HEADERS)
 }
 
@@ -219,8 +392,13 @@ func (a *RegistryAPI) GetImageAncestryHandler(w http.ResponseWriter, r *http.Req
 	imageID := vars["imageID"]
 	headers := DefaultCacheHeaders()
 	data, err := a.Storage.Get(storage.ImageAncestryPath(imageID))
-	if err != nil {
-		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+	if storage.IsNotFound(err) && a.mirror != nil {
+		if data, err = a.mirror.FetchImageAncestry(imageID); err != nil {
+			a.mirrorError(w, err)
+			return
+		}
+	} else if err != nil {
+		a.storageError(w, "Image", err)
 		return
 	}
 	a.response(w, data, http.StatusOK, headers)
@@ -242,16 +420,28 @@ func (a *RegistryAPI) PutImageChecksumHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 	// check if image json exists
-	if exists, _ := a.Storage.Exists(storage.ImageJsonPath(imageID)); !exists {
-		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+	if exists, err := a.Storage.Exists(storage.ImageJsonPath(imageID)); err != nil {
+		a.storageError(w, "Image", err)
+		return
+	} else if !exists {
+		a.response(w, "Image not found", http.StatusNotFound, EMPTY_HEADERS)
 		return
 	}
 	markPath := storage.ImageMarkPath(imageID)
-	if exists, _ := a.Storage.Exists(markPath); !exists {
+	if exists, err := a.Storage.Exists(markPath); err != nil {
+		a.storageError(w, "Image", err)
+		return
+	} else if !exists {
 		a.response(w, "Cannot set this image checksum (mark path does not exist)", http.StatusConflict, EMPTY_HEADERS)
 		return
 	}
-	err = layers.StoreChecksum(a.Storage, imageID, checksum)
+	if err := layers.StoreChecksum(a.Storage, imageID, checksum); err == layers.ErrInvalidChecksum {
+		a.response(w, err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	} else if err != nil {
+		a.storageError(w, "Image", err)
+		return
+	}
 	// extract checksumCookie JSON
 	checksumMap := map[string]bool{}
 	for _, checksum := range strings.Split(checksumCookie.Value, COOKIE_SEPARATOR) {
@@ -262,7 +452,13 @@ func (a *RegistryAPI) PutImageChecksumHandler(w http.ResponseWriter, r *http.Req
 		a.response(w, "Checksum mismatch", http.StatusBadRequest, EMPTY_HEADERS)
 		return
 	}
-	a.Storage.Remove(markPath)
+	if err := layers.ClearMark(a.Storage, imageID); err == layers.ErrUploadAborted {
+		a.response(w, err.Error(), http.StatusConflict, EMPTY_HEADERS)
+		return
+	} else if err != nil {
+		a.storageError(w, "Image", err)
+		return
+	}
 	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
 }
 
@@ -279,7 +475,7 @@ func (a *RegistryAPI) GetImageFilesHandler(w http.ResponseWriter, r *http.Reques
 			a.response(w, "Layer format not supported", http.StatusBadRequest, EMPTY_HEADERS)
 			return
 		default:
-			a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+			a.storageError(w, "Image", err)
 			return
 		}
 	}
@@ -1,7 +1,10 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"github.com/gorilla/mux"
+	"registry/auth"
 	"registry/layers"
 	"registry/logger"
 	"registry/storage"
@@ -9,17 +12,20 @@ import (
 	"net/http"
 )
 
-func IndexHeaders(r *http.Request, namespace, repo, access string) map[string][]string {
-	fakeToken := []string{"Token signature=FAKESIGNATURE123,repository=\"" + namespace + "/" + repo + "\",access=" + access}
+func (a *RegistryAPI) IndexHeaders(r *http.Request, namespace, repo, access string) map[string][]string {
+	token := []string{"Token " + a.newToken(r, namespace, repo, access).String()}
 	return map[string][]string{
 		"X-Docker-Endpoints": []string{r.Host},
-		"WWW-Authenticate":   fakeToken,
-		"X-Docker-Token":     fakeToken,
+		"WWW-Authenticate":   token,
+		"X-Docker-Token":     token,
 	}
 }
 
 func (a *RegistryAPI) putRepoImageHandler(w http.ResponseWriter, r *http.Request, successStatus int) {
 	namespace, repo, _ := parseRepo(r, "")
+	if _, ok := a.namespaceWriter(w, r, namespace); !ok {
+		return
+	}
 	bodyBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		a.response(w, "Internal Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
@@ -35,21 +41,145 @@ func (a *RegistryAPI) putRepoImageHandler(w http.ResponseWriter, r *http.Request
 		a.response(w, "Internal Error: "+err.Error(), http.StatusInternalServerError, EMPTY_HEADERS)
 		return
 	}
-	a.response(w, "", successStatus, IndexHeaders(r, namespace, repo, "write"))
+	a.response(w, "", successStatus, a.IndexHeaders(r, namespace, repo, "write"))
+}
+
+type userRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+// Returns the user from the request's basic auth. nil, nil if there is none.
+func (a *RegistryAPI) authenticatedUser(r *http.Request) (*auth.User, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	return auth.Authenticate(a.Storage, username, password)
+}
+
+func (a *RegistryAPI) unauthorized(w http.ResponseWriter, text string) {
+	headers := map[string][]string{"WWW-Authenticate": []string{`Basic realm="go-docker-registry"`}}
+	a.response(w, text, http.StatusUnauthorized, headers)
+}
+
+// Returns the user doing a push, which is nil for anonymous pushes if login isn't required. Writes the error
+// response and returns false if the push isn't allowed. A write token stands in for a login, since the login was
+// checked when the token was issued.
+func (a *RegistryAPI) pushUser(w http.ResponseWriter, r *http.Request) (*auth.User, bool) {
+	if token, err := a.requestToken(r); err != nil {
+		a.unauthorized(w, err.Error())
+		return nil, false
+	} else if token != nil && token.Access == auth.ACCESS_WRITE {
+		if token.User == "" {
+			return nil, true
+		}
+		user, err := auth.GetUser(a.Storage, token.User)
+		if err != nil {
+			a.unauthorized(w, err.Error())
+			return nil, false
+		}
+		return user, true
+	}
+	user, err := a.authenticatedUser(r)
+	if err != nil {
+		a.unauthorized(w, err.Error())
+		return nil, false
+	}
+	if user == nil && a.Config.RequireLogin {
+		a.unauthorized(w, "Login required")
+		return nil, false
+	}
+	return user, true
+}
+
+// Whether the user (nil when anonymous) can push to or delete from repositories in the namespace. A namespace that
+// is a username belongs to that user, library belongs to the admins (or to everyone if there are none), and anyone
+// who can push at all can write to namespaces nobody has registered.
+func (a *RegistryAPI) canWrite(namespace string, user *auth.User) bool {
+	if a.isAdmin(user) {
+		return true
+	}
+	for _, reserved := range auth.RESERVED_USERNAMES {
+		if namespace == reserved {
+			return len(a.Config.Admins) == 0
+		}
+	}
+	owner, err := auth.GetUser(a.Storage, namespace)
+	if storage.IsNotFound(err) || err == auth.ErrInvalidUsername {
+		return true
+	} else if err != nil {
+		logger.Error("[canWrite] Error looking up the owner of %s: %s", namespace, err.Error())
+		return false
+	}
+	return user != nil && user.Username == owner.Username
+}
+
+// Like pushUser, but also rejects users who can't write to the namespace
+func (a *RegistryAPI) namespaceWriter(w http.ResponseWriter, r *http.Request, namespace string) (*auth.User, bool) {
+	user, ok := a.pushUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !a.canWrite(namespace, user) {
+		a.response(w, "Access denied to namespace "+namespace, http.StatusForbidden, EMPTY_HEADERS)
+		return nil, false
+	}
+	return user, true
 }
 
 func (a *RegistryAPI) LoginHandler(w http.ResponseWriter, r *http.Request) {
-	// Empty Shell
+	user, err := a.authenticatedUser(r)
+	if err != nil {
+		a.unauthorized(w, err.Error())
+		return
+	} else if user == nil {
+		a.unauthorized(w, "Missing credentials")
+		return
+	}
+	logger.Debug("[Login] username=%s", user.Username)
 	a.response(w, "OK", http.StatusOK, EMPTY_HEADERS)
 }
 
 func (a *RegistryAPI) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
-	// Empty Shell
-	a.response(w, "User Created (lies)", http.StatusCreated, EMPTY_HEADERS)
+	var req userRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.response(w, "Error Decoding JSON: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	}
+	logger.Debug("[CreateUser] username=%s; email=%s", req.Username, req.Email)
+	if _, err := auth.CreateUser(a.Storage, req.Username, req.Password, req.Email); err == auth.ErrUserExists {
+		// the docker client looks for exactly this body to decide to log in instead
+		a.response(w, []byte(`"Username or email already exists"`), http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	} else if err != nil {
+		a.response(w, err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	}
+	a.response(w, "User Created", http.StatusCreated, EMPTY_HEADERS)
 }
 
 func (a *RegistryAPI) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
-	// Empty Shell
+	username := mux.Vars(r)["username"]
+	user, err := a.authenticatedUser(r)
+	if err != nil {
+		a.unauthorized(w, err.Error())
+		return
+	} else if user == nil || user.Username != username {
+		a.unauthorized(w, "Can only update your own account")
+		return
+	}
+	var req userRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.response(w, "Error Decoding JSON: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	}
+	logger.Debug("[UpdateUser] username=%s", username)
+	if err := user.Update(a.Storage, req.Password, req.Email); err != nil {
+		a.response(w, err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	}
 	a.response(w, "", http.StatusNoContent, EMPTY_HEADERS)
 }
 
@@ -57,19 +187,63 @@ func (a *RegistryAPI) PutRepoHandler(w http.ResponseWriter, r *http.Request) {
 	a.putRepoImageHandler(w, r, http.StatusOK)
 }
 
+type repoAuthRequest struct {
+	Private bool     `json:"private"`
+	Readers []string `json:"readers"` // who can read a private repository besides the namespace's user
+}
+
+// With a {"private": true|false, "readers": [...]} body, makes the repository private or public. Only the user named
+// after the namespace can do that. Without a body it is still the empty shell docker-registry 0.6.5 has.
 func (a *RegistryAPI) PutRepoAuthHandler(w http.ResponseWriter, r *http.Request) {
-	// Empty Shell
-	a.response(w, "OK", http.StatusOK, EMPTY_HEADERS)
+	namespace, repo, _ := parseRepo(r, "")
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	if len(bytes.TrimSpace(bodyBytes)) == 0 {
+		a.response(w, "OK", http.StatusOK, EMPTY_HEADERS)
+		return
+	}
+	var req repoAuthRequest
+	if err := json.Unmarshal(bodyBytes, &req); err != nil {
+		a.response(w, "Error Decoding JSON: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
+		return
+	}
+	user, err := a.authenticatedUser(r)
+	if err != nil {
+		a.unauthorized(w, err.Error())
+		return
+	} else if user == nil || user.Username != namespace {
+		a.unauthorized(w, "Only "+namespace+" can change who can access "+namespace+"/"+repo)
+		return
+	}
+	logger.Debug("[PutRepoAuth] namespace=%s; repository=%s; private=%t; readers=%v", namespace, repo, req.Private,
+		req.Readers)
+	if req.Private {
+		err = layers.SetPrivate(a.Storage, namespace, repo, req.Readers)
+	} else {
+		err = layers.SetPublic(a.Storage, namespace, repo)
+	}
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	a.response(w, req, http.StatusOK, EMPTY_HEADERS)
 }
 
 func (a *RegistryAPI) GetRepoImagesHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, _ := parseRepo(r, "")
+	if !layers.CanRead(a.Storage, namespace, repo, a.requestUsername(r)) {
+		a.response(w, "Image Not Found", http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
 	data, err := a.Storage.Get(storage.RepoIndexImagesPath(namespace, repo))
 	if err != nil {
-		a.response(w, "Image Not Found", http.StatusNotFound, EMPTY_HEADERS)
+		a.storageError(w, "Image", err)
 		return
 	}
-	a.response(w, data, http.StatusOK, IndexHeaders(r, namespace, repo, "read"))
+	a.response(w, data, http.StatusOK, a.IndexHeaders(r, namespace, repo, "read"))
 }
 
 func (a *RegistryAPI) PutRepoImagesHandler(w http.ResponseWriter, r *http.Request) {
@@ -78,10 +252,55 @@ func (a *RegistryAPI) PutRepoImagesHandler(w http.ResponseWriter, r *http.Reques
 
 func (a *RegistryAPI) DeleteRepoImagesHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, _ := parseRepo(r, "")
+	if _, ok := a.namespaceWriter(w, r, namespace); !ok {
+		return
+	}
 	// from docker-registry 0.6.5: Does nothing, this file will be removed when DELETE on repos
-	a.response(w, "", http.StatusNoContent, IndexHeaders(r, namespace, repo, "delete"))
+	a.response(w, "", http.StatusNoContent, a.IndexHeaders(r, namespace, repo, "delete"))
 }
 
+// GET /v1/search?q=<query>[&match=prefix]. matches substrings of repository names unless match=prefix is given.
 func (a *RegistryAPI) SearchHandler(w http.ResponseWriter, r *http.Request) {
-	a.response(w, map[string]string{}, http.StatusOK, EMPTY_HEADERS)
+	query := r.URL.Query().Get("q")
+	prefix := r.URL.Query().Get("match") == "prefix"
+	logger.Debug("[Search] query=%s; prefix=%t", query, prefix)
+	results, err := layers.Search(a.Storage, query, prefix)
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	if results, err = a.readableSearchResults(r, results); err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	data := map[string]interface{}{
+		"num_results": len(results),
+		"query":       query,
+		"results":     results,
+	}
+	a.response(w, data, http.StatusOK, EMPTY_HEADERS)
+}
+
+// leave out private repositories the user can't read
+func (a *RegistryAPI) readableSearchResults(r *http.Request, results []layers.SearchResult) ([]layers.SearchResult, error) {
+	privateRepos, err := layers.ListPrivateRepositories(a.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if len(privateRepos) == 0 {
+		return results, nil
+	}
+	private := map[string]layers.Repository{}
+	for _, repo := range privateRepos {
+		private[repo.String()] = repo
+	}
+	username := a.requestUsername(r)
+	readable := []layers.SearchResult{}
+	for _, result := range results {
+		if repo, ok := private[result.Name]; ok && !layers.CanRead(a.Storage, repo.Namespace, repo.Name, username) {
+			continue
+		}
+		readable = append(readable, result)
+	}
+	return readable, nil
 }
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"registry/logger"
+	"registry/mirror"
+)
+
+// 404 for images that aren't upstream either. 502 if the upstream couldn't be asked.
+func (a *RegistryAPI) mirrorError(w http.ResponseWriter, err error) {
+	if err == mirror.ErrNotFound {
+		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
+	logger.Error("[Mirror] %s", err.Error())
+	a.response(w, "Upstream Error: "+err.Error(), http.StatusBadGateway, EMPTY_HEADERS)
+}
+
+// streams the layer from upstream to the client while it is stored
+func (a *RegistryAPI) mirrorImageLayer(w http.ResponseWriter, imageID string, headers map[string][]string) {
+	started := false
+	err := a.mirror.FetchImageLayer(imageID, func(size int64) io.Writer {
+		started = true
+		if size >= 0 {
+			headers["Content-Length"] = []string{fmt.Sprintf("%d", size)}
+		}
+		a.response(w, nil, http.StatusOK, headers)
+		return w
+	})
+	if err == nil {
+		return
+	} else if !started {
+		a.mirrorError(w, err)
+		return
+	}
+	// too late to tell the client. it sees a short read, or a layer that wasn't kept and is fetched again next time
+	logger.Error("[Mirror][%s] error storing layer: %s", imageID, err.Error())
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"registry/mirror"
+	"registry/storage"
+	"testing"
+)
+
+func testLocalStorage(t *testing.T, root string) storage.Storage {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	return s
+}
+
+func getBody(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestMirror(t *testing.T) {
+	upstreamStorage := testLocalStorage(t, "/tmp/go-docker-registry-mirror-test/upstream")
+	mirrorStorage := testLocalStorage(t, "/tmp/go-docker-registry-mirror-test/mirror")
+	defer upstreamStorage.RemoveAll("/")
+	defer mirrorStorage.RemoveAll("/")
+
+	upstreamStorage.Put(storage.ImageJsonPath("img1"), []byte(`{"id":"img1"}`))
+	upstreamStorage.Put(storage.ImageAncestryPath("img1"), []byte(`["img1"]`))
+	upstreamStorage.Put(storage.ImageLayerPath("img1"), []byte("layer data"))
+	sum := sha256.Sum256([]byte(`{"id":"img1"}layer data`))
+	upstreamStorage.Put(storage.ImageChecksumPath("img1"), []byte("sha256:"+hex.EncodeToString(sum[:])))
+	upstreamStorage.Put(storage.RepoTagPath("library", "foo", "latest"), []byte("img1"))
+	// a layer that doesn't match its checksum
+	upstreamStorage.Put(storage.ImageJsonPath("corrupt"), []byte(`{"id":"corrupt"}`))
+	upstreamStorage.Put(storage.ImageLayerPath("corrupt"), []byte("layer data"))
+	upstreamStorage.Put(storage.ImageChecksumPath("corrupt"), []byte("sha256:"+hex.EncodeToString(sum[:])))
+	upstreamStorage.Put(storage.ImageJsonPath("busy"), []byte(`{"id":"busy"}`))
+	upstreamStorage.Put(storage.ImageLayerPath("busy"), []byte("busy layer"))
+	upstreamRouter := New(&Config{}, upstreamStorage).Router()
+	tagRequests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/repositories/library/bar/tags" {
+			tagRequests++
+		}
+		upstreamRouter.ServeHTTP(w, r)
+	}))
+
+	mirrorAPI := New(&Config{Mirror: &mirror.Config{Upstream: upstream.URL, TagTTL: "1h"}}, mirrorStorage)
+	server := httptest.NewServer(mirrorAPI.Router())
+	defer server.Close()
+
+	expected := map[string]string{
+		"/v1/repositories/foo/tags": `{"latest":"img1"}`,
+		"/v1/images/img1/ancestry":  `["img1"]`,
+		"/v1/images/img1/json":      `{"id":"img1"}`,
+		"/v1/images/img1/layer":     "layer data",
+		"/v1/repositories/bar/tags": "",
+		"/v1/images/missing/json":   "",
+		"/v1/images/missing/layer":  "",
+	}
+	check := func() {
+		for path, body := range expected {
+			code, got := getBody(t, server.URL+path)
+			if body == "" {
+				if code != http.StatusNotFound {
+					t.Errorf("GET %s: expected 404, got %d", path, code)
+				}
+				continue
+			}
+			if code != http.StatusOK || got != body {
+				t.Errorf("GET %s: expected 200 %s, got %d %s", path, body, code, got)
+			}
+		}
+	}
+	check()
+	if exists, _ := mirrorStorage.Exists(storage.ImageLayerPath("img1")); !exists {
+		t.Fatal("Layer should have been stored in the mirror")
+	}
+	if exists, _ := mirrorStorage.Exists(storage.ImageMarkPath("img1")); exists {
+		t.Fatal("Mirrored image should not be left in progress")
+	}
+	getBody(t, server.URL+"/v1/images/corrupt/layer")
+	if exists, _ := mirrorStorage.Exists(storage.ImageLayerPath("corrupt")); exists {
+		t.Fatal("Layer not matching the upstream checksum should not have been stored")
+	}
+	// a layer someone else is storing is only passed through, and what they wrote is left alone
+	mirrorStorage.Put(storage.ImageMarkPath("busy"), []byte("someone else's"))
+	var passed bytes.Buffer
+	if err := mirrorAPI.mirror.FetchImageLayer("busy", func(int64) io.Writer { return &passed }); err != nil || passed.String() != "busy layer" {
+		t.Fatalf("Expected the layer to be passed through, got %q, %v", passed.String(), err)
+	}
+	if exists, _ := mirrorStorage.Exists(storage.ImageLayerPath("busy")); exists {
+		t.Fatal("A layer someone else is storing should not be stored again")
+	}
+	if content, _ := mirrorStorage.Get(storage.ImageMarkPath("busy")); string(content) != "someone else's" {
+		t.Fatalf("The mark of someone else's upload should be left alone, got %q", content)
+	}
+	// upstream isn't asked about a repository it doesn't have again until the ttl runs out
+	getBody(t, server.URL+"/v1/repositories/bar/tags")
+	if tagRequests != 1 {
+		t.Fatalf("Expected upstream to be asked for the tags of a missing repository once, got %d", tagRequests)
+	}
+
+	// everything is served locally from now on, including tags until the ttl runs out
+	upstream.Close()
+	delete(expected, "/v1/images/missing/json")
+	delete(expected, "/v1/images/missing/layer")
+	check()
+	if code, _ := getBody(t, server.URL+"/v1/images/missing/json"); code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for a miss with the upstream down, got %d", code)
+	}
+}
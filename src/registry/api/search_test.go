@@ -0,0 +1,43 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"registry/layers"
+	"registry/storage"
+	"testing"
+)
+
+func TestSearchHandler(t *testing.T) {
+	s := testLocalStorage(t, "/tmp/go-docker-registry-search-api-test")
+	defer s.RemoveAll("/")
+	server := httptest.NewServer(New(&Config{}, s).Router())
+	defer server.Close()
+
+	s.Put(storage.ImageJsonPath("app"), []byte(`{"id":"app","comment":"An app"}`))
+	s.Put(storage.RepoTagPath("someone", "app", "latest"), []byte("app"))
+	s.Put(storage.RepoTagPath("someone", "secret-app", "latest"), []byte("app"))
+	if err := layers.SetPrivate(s, "someone", "secret-app", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := getBody(t, server.URL+"/v1/search?q=app")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", code, body)
+	}
+	var data struct {
+		NumResults int                   `json:"num_results"`
+		Query      string                `json:"query"`
+		Results    []layers.SearchResult `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(body), &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.NumResults != 1 || data.Query != "app" || len(data.Results) != 1 {
+		t.Fatalf("Expected only the public repository, got %s", body)
+	}
+	if data.Results[0].Name != "someone/app" || data.Results[0].Description != "An app" {
+		t.Fatalf("Unexpected result %+v", data.Results[0])
+	}
+}
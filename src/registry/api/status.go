@@ -1,11 +1,184 @@
 package api
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"net/http"
+	"registry/layers"
+	"registry/reaper"
+	"registry/scrub"
+	"registry/storage"
+	"sync"
+	"time"
 )
 
+// what is too slow or too intrusive to do for every status request (counting in-progress uploads walks every image,
+// the write probe writes to storage) is done in the background, at most this often
+const STATUS_REFRESH_INTERVAL = time.Minute
+
+type StorageStatus struct {
+	Type     string     `json:"type"`
+	Healthy  bool       `json:"healthy"`
+	ReadMs   float64    `json:"read_ms"`
+	WriteMs  float64    `json:"write_ms"`
+	RemoveMs float64    `json:"remove_ms"`
+	ProbedAt *time.Time `json:"probed_at,omitempty"` // when writing was last probed
+	Error    string     `json:"error,omitempty"`
+
+	Cache *storage.CacheStats `json:"cache,omitempty"`
+}
+
+type UploadsStatus struct {
+	ImagesInProgress int       `json:"images_in_progress"`
+	Sessions         int       `json:"sessions"`
+	CountedAt        time.Time `json:"counted_at"`
+}
+
+type Status struct {
+	Version       string               `json:"version"`
+	StartedAt     time.Time            `json:"started_at"`
+	Uptime        string               `json:"uptime"`
+	UptimeSeconds int64                `json:"uptime_seconds"`
+	Storage       *StorageStatus       `json:"storage"`
+	Uploads       UploadsStatus        `json:"uploads"`
+	GenDiffError  *layers.GenDiffError `json:"gen_diff_last_error"`
+	Scrub         *scrub.Status        `json:"scrub,omitempty"`
+}
+
+type writeProbe struct {
+	at       time.Time
+	writeMs  float64
+	removeMs float64
+	err      string
+}
+
+// the results of the last background refresh
+type backgroundStatus struct {
+	sync.Mutex
+	refreshing bool
+	uploads    UploadsStatus
+	write      *writeProbe
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// read the probe key, which is all that is done to storage for a status request. it only exists while a write
+// probe runs, so not finding it is fine.
+func probeRead(s storage.Storage) *StorageStatus {
+	status := &StorageStatus{Type: storage.TypeName(s)}
+	if cache, ok := s.(*storage.Cache); ok {
+		stats := cache.Stats()
+		status.Cache = &stats
+	}
+	start := time.Now()
+	_, err := s.Get(storage.StatusProbePath("read"))
+	status.ReadMs = milliseconds(time.Since(start))
+	if err != nil && !storage.IsNotFound(err) {
+		status.Error = "read: " + err.Error()
+		return status
+	}
+	status.Healthy = true
+	return status
+}
+
+// write, read back and remove a probe key, timing the write and the remove
+func probeWrite(s storage.Storage) *writeProbe {
+	probe := &writeProbe{at: time.Now().UTC()}
+	id := fmt.Sprintf("%d", time.Now().UnixNano())
+	probePath := storage.StatusProbePath(id)
+	content := []byte(id)
+
+	start := time.Now()
+	if err := s.Put(probePath, content); err != nil {
+		probe.err = "write: " + err.Error()
+		return probe
+	}
+	probe.writeMs = milliseconds(time.Since(start))
+
+	read, err := s.Get(probePath)
+	if err == nil && !bytes.Equal(read, content) {
+		err = errors.New("probe content mismatch")
+	}
+	if err != nil {
+		probe.err = "read back: " + err.Error()
+		s.Remove(probePath)
+		return probe
+	}
+
+	start = time.Now()
+	if err := s.Remove(probePath); err != nil {
+		probe.err = "remove: " + err.Error()
+		return probe
+	}
+	probe.removeMs = milliseconds(time.Since(start))
+	return probe
+}
+
+func countUploads(s storage.Storage) UploadsStatus {
+	status := UploadsStatus{CountedAt: time.Now().UTC()}
+	if ids, err := reaper.MarkedImages(s); err == nil {
+		status.ImagesInProgress = len(ids)
+	}
+	if sessions, err := s.List("uploads"); err == nil {
+		status.Sessions = len(sessions)
+	}
+	return status
+}
+
+// probes writing and counts the uploads for the status requests to report. ListenAndServe does this once before
+// serving, so the status reports a write probe from the start.
+func (a *RegistryAPI) refreshStatus() {
+	write := probeWrite(a.Storage)
+	uploads := countUploads(a.Storage)
+	a.status.Lock()
+	defer a.status.Unlock()
+	a.status.write, a.status.uploads, a.status.refreshing = write, uploads, false
+}
+
+// starts a background refresh if the last one is more than STATUS_REFRESH_INTERVAL old and none is running, and
+// returns the results of the last one. without one (the API was started without ListenAndServe), the storage is
+// only reported unhealthy if reading fails.
+func (a *RegistryAPI) refreshedStatus() (UploadsStatus, *writeProbe) {
+	a.status.Lock()
+	defer a.status.Unlock()
+	if !a.status.refreshing && time.Since(a.status.uploads.CountedAt) > STATUS_REFRESH_INTERVAL {
+		a.status.refreshing = true
+		go a.refreshStatus()
+	}
+	return a.status.uploads, a.status.write
+}
+
 func (a *RegistryAPI) StatusHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO[jigish] implement this
-	// informative data about the server should go here =P
-	NotImplementedHandler(w, r)
+	uptime := time.Since(a.startedAt)
+	status := &Status{
+		Version:       VERSION,
+		StartedAt:     a.startedAt.UTC(),
+		Uptime:        uptime.String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+		Storage:       probeRead(a.Storage),
+		GenDiffError:  layers.LastGenDiffError(),
+	}
+	var write *writeProbe
+	status.Uploads, write = a.refreshedStatus()
+	if write != nil {
+		status.Storage.WriteMs, status.Storage.RemoveMs = write.writeMs, write.removeMs
+		status.Storage.ProbedAt = &write.at
+		if write.err != "" && status.Storage.Healthy {
+			status.Storage.Healthy = false
+			status.Storage.Error = write.err
+		}
+	}
+	if a.Scrubber != nil {
+		scrubStatus := a.Scrubber.Status()
+		status.Scrub = &scrubStatus
+	}
+	code := http.StatusOK
+	if !status.Storage.Healthy {
+		// let load balancers take us out of rotation
+		code = http.StatusServiceUnavailable
+	}
+	a.response(w, status, code, EMPTY_HEADERS)
 }
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getStatus(t *testing.T, url string) *Status {
+	code, body := getBody(t, url+"/_status")
+	var status Status
+	if err := json.Unmarshal([]byte(body), &status); code != http.StatusOK || err != nil {
+		t.Fatalf("Expected the status, got %d %s", code, body)
+	}
+	return &status
+}
+
+func TestStatusHandler(t *testing.T) {
+	s := testLocalStorage(t, "/tmp/go-docker-registry-status-test")
+	defer s.RemoveAll("/")
+	server := httptest.NewServer(New(&Config{}, s).Router())
+	defer server.Close()
+
+	status := getStatus(t, server.URL)
+	if !status.Storage.Healthy || status.Storage.Type != "local" {
+		t.Fatalf("Expected healthy local storage, got %+v", status.Storage)
+	}
+	for i := 0; i < 100 && status.Storage.ProbedAt == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = getStatus(t, server.URL)
+	}
+	if status.Storage.ProbedAt == nil || status.Uploads.CountedAt.IsZero() {
+		t.Fatalf("Expected writing to be probed and uploads counted in the background, got %+v", status)
+	}
+	probedAt := *status.Storage.ProbedAt
+	if status = getStatus(t, server.URL); !status.Storage.ProbedAt.Equal(probedAt) {
+		t.Fatal("Writing should not be probed again before the refresh interval")
+	}
+	if names, err := s.List("_status"); err == nil && len(names) != 0 {
+		t.Fatalf("The probe should not leave anything behind, got %v", names)
+	}
+}
@@ -2,11 +2,14 @@ package api
 
 import (
 	"encoding/json"
+	"registry/layers"
 	"registry/logger"
+	"registry/mirror"
 	"registry/storage"
 	"io/ioutil"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -23,9 +26,15 @@ var EMPTY_REPO_JSON = map[string]interface{}{
 func (a *RegistryAPI) GetRepoTagsHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, _ := parseRepo(r, "")
 	logger.Debug("[GetRepoTags] namespace=%s; repository=%s", namespace, repo)
+	if a.mirror != nil {
+		if err := a.mirror.RefreshRepoTags(namespace, repo); err != nil && err != mirror.ErrNotFound {
+			// serve whatever we have
+			logger.Error("[GetRepoTags][Mirror] error refreshing %s/%s: %s", namespace, repo, err.Error())
+		}
+	}
 	names, err := a.Storage.List(storage.RepoTagPath(namespace, repo, ""))
 	if err != nil {
-		a.response(w, "Repository not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+		a.storageError(w, "Repository", err)
 		return
 	}
 	data := map[string]string{}
@@ -50,9 +59,15 @@ func (a *RegistryAPI) DeleteRepoTagsHandler(w http.ResponseWriter, r *http.Reque
 	namespace, repo, _ := parseRepo(r, "")
 	logger.Debug("[DeleteRepoTags] namespace=%s; repository=%s", namespace, repo)
 	if err := a.Storage.RemoveAll(storage.RepoTagPath(namespace, repo, "")); err != nil {
-		a.response(w, "Repository not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+		a.storageError(w, "Repository", err)
+		return
+	}
+	// _private went with the rest, which leaves the private index
+	if err := layers.SetPublic(a.Storage, namespace, repo); err != nil {
+		a.storageError(w, "Repository", err)
 		return
 	}
+	a.removeFromSearchIndex(namespace, repo)
 	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
 }
 
@@ -61,7 +76,7 @@ func (a *RegistryAPI) GetRepoTagHandler(w http.ResponseWriter, r *http.Request)
 	logger.Debug("[GetRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
 	content, err := a.Storage.Get(storage.RepoTagPath(namespace, repo, tag))
 	if err != nil {
-		a.response(w, "Tag not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+		a.storageError(w, "Tag", err)
 		return
 	}
 	a.response(w, content, http.StatusOK, EMPTY_HEADERS)
@@ -70,6 +85,10 @@ func (a *RegistryAPI) GetRepoTagHandler(w http.ResponseWriter, r *http.Request)
 func (a *RegistryAPI) PutRepoTagHandler(w http.ResponseWriter, r *http.Request) {
 	namespace, repo, tag := parseRepo(r, "tag")
 	logger.Debug("[PutRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
+	user, ok := a.namespaceWriter(w, r, namespace)
+	if !ok {
+		return
+	}
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		a.response(w, "Error reading request body: "+err.Error(), http.StatusBadRequest, EMPTY_HEADERS)
@@ -80,15 +99,40 @@ func (a *RegistryAPI) PutRepoTagHandler(w http.ResponseWriter, r *http.Request)
 	}
 	logger.Debug("[PutRepoTag] body:\n%s", data)
 	imageID := strings.Trim(string(data), "\"") // trim quotes
-	if exists, err := a.Storage.Exists(storage.ImageJsonPath(imageID)); err != nil || !exists {
-		a.response(w, "Image not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+	if exists, err := a.Storage.Exists(storage.ImageJsonPath(imageID)); err != nil {
+		a.storageError(w, "Image", err)
+		return
+	} else if !exists {
+		a.response(w, "Image not found", http.StatusNotFound, EMPTY_HEADERS)
 		return
 	}
-	err = a.Storage.Put(storage.RepoTagPath(namespace, repo, tag), []byte(imageID))
+	pushedBy := "anonymous"
+	username := ""
+	if user != nil {
+		pushedBy = user.Username
+		username = user.Username
+	}
+	// a tag makes the image readable to whoever can read the repository
+	if !layers.CanReadImage(a.Storage, imageID, username) {
+		a.response(w, "Image not found", http.StatusNotFound, EMPTY_HEADERS)
+		return
+	}
+	if err := layers.AddTaggedImage(a.Storage, namespace, repo, imageID); err != nil {
+		a.storageError(w, "Image", err)
+		return
+	}
+	// retried if the tag is moved concurrently, so the tag ends up pointing at whatever was pushed last
+	err = storage.Update(a.Storage, storage.RepoTagPath(namespace, repo, tag), func(content []byte) ([]byte, error) {
+		if string(content) == imageID {
+			return nil, nil
+		}
+		return []byte(imageID), nil
+	})
 	if err != nil {
 		a.internalError(w, err.Error())
 		return
 	}
+	logger.Info("[PutRepoTag] %s/%s:%s -> %s pushed by %s", namespace, repo, tag, imageID, pushedBy)
 	if tag == "latest" {
 		// write some metadata about the repos
 		uaStrings := r.Header["User-Agent"]
@@ -98,12 +142,26 @@ func (a *RegistryAPI) PutRepoTagHandler(w http.ResponseWriter, r *http.Request)
 			uaString = uaStrings[0]
 		}
 		dataMap := CreateRepoJson(uaString)
-		jsonData, err := json.Marshal(&dataMap)
+		dataMap["last_pushed_by"] = pushedBy
+		err := storage.Update(a.Storage, storage.RepoJsonPath(namespace, repo), func(content []byte) ([]byte, error) {
+			repoJson := map[string]interface{}{}
+			if content != nil {
+				// whatever else is in there is kept, unless it can't be read
+				json.Unmarshal(content, &repoJson)
+			}
+			for key, value := range dataMap {
+				repoJson[key] = value
+			}
+			return json.Marshal(&repoJson)
+		})
 		if err != nil {
 			a.internalError(w, err.Error())
 			return
 		}
-		a.Storage.Put(storage.RepoJsonPath(namespace, repo), jsonData)
+	}
+	if err := layers.AddToSearchIndex(a.Storage, namespace, repo); err != nil {
+		// search being stale isn't worth failing the push over
+		logger.Error("[PutRepoTag] error updating search index: %s", err.Error())
 	}
 	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
 }
@@ -112,9 +170,13 @@ func (a *RegistryAPI) DeleteRepoTagHandler(w http.ResponseWriter, r *http.Reques
 	namespace, repo, tag := parseRepo(r, "tag")
 	logger.Debug("[DeleteRepoTag] namespace=%s; repository=%s; tag=%s", namespace, repo, tag)
 	if err := a.Storage.Remove(storage.RepoTagPath(namespace, repo, tag)); err != nil {
-		a.response(w, "Tag not found: "+err.Error(), http.StatusNotFound, EMPTY_HEADERS)
+		a.storageError(w, "Tag", err)
 		return
 	}
+	if tags, err := layers.ListTags(a.Storage, namespace, repo); err != nil || len(tags) == 0 {
+		// that was the last tag, nothing left to pull
+		a.removeFromSearchIndex(namespace, repo)
+	}
 	a.response(w, true, http.StatusOK, EMPTY_HEADERS)
 }
 
@@ -167,9 +229,28 @@ func CreateRepoJson(userAgent string) map[string]interface{} {
 	return props
 }
 
+// Removes all tags and metadata of a repository. With ?cascade=true, images that no other repository references
+// are removed as well. Responds with everything that was removed.
 func (a *RegistryAPI) DeleteRepoHandler(w http.ResponseWriter, r *http.Request) {
-	//namespace, repo, _ := parseRepo(r, "")
-	// not yet implemented in docker-registry.
-	// TODO[jigish] implement this
-	NotImplementedHandler(w, r)
+	namespace, repo, _ := parseRepo(r, "")
+	cascade, _ := strconv.ParseBool(r.URL.Query().Get("cascade"))
+	logger.Debug("[DeleteRepo] namespace=%s; repository=%s; cascade=%t", namespace, repo, cascade)
+	if _, err := a.Storage.List(storage.RepoTagPath(namespace, repo, "")); err != nil {
+		a.storageError(w, "Repository", err)
+		return
+	}
+	result, err := layers.DeleteRepository(a.Storage, namespace, repo, cascade)
+	if err != nil {
+		// everything done so far stays done, so the client can just retry
+		a.internalError(w, err.Error())
+		return
+	}
+	a.removeFromSearchIndex(namespace, repo)
+	a.response(w, result, http.StatusOK, EMPTY_HEADERS)
+}
+
+func (a *RegistryAPI) removeFromSearchIndex(namespace, repo string) {
+	if err := layers.RemoveFromSearchIndex(a.Storage, namespace, repo); err != nil {
+		logger.Error("[RemoveFromSearchIndex] namespace=%s; repository=%s; error: %s", namespace, repo, err.Error())
+	}
 }
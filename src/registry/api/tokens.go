@@ -0,0 +1,198 @@
+package api
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"registry/auth"
+	"registry/layers"
+	"registry/logger"
+	"strings"
+	"time"
+)
+
+const DEFAULT_TOKEN_TTL = time.Hour
+
+// the secret tokens are signed with. a random one is generated if none is configured, which means tokens don't
+// survive a restart and aren't accepted by other instances.
+func tokenSecret(cfg *Config) []byte {
+	if cfg.TokenSecret != "" {
+		return []byte(cfg.TokenSecret)
+	}
+	logger.Info("No token_secret configured, tokens will only be valid for this process")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		logger.Fatal("Error generating token secret: %s", err.Error())
+	}
+	return secret
+}
+
+func tokenTTL(cfg *Config) time.Duration {
+	if cfg.TokenTTL == "" {
+		return DEFAULT_TOKEN_TTL
+	}
+	ttl, err := time.ParseDuration(cfg.TokenTTL)
+	if err != nil {
+		logger.Error("Invalid token_ttl %q, using %s: %s", cfg.TokenTTL, DEFAULT_TOKEN_TTL, err.Error())
+		return DEFAULT_TOKEN_TTL
+	}
+	return ttl
+}
+
+func (a *RegistryAPI) newToken(r *http.Request, namespace, repo, access string) *auth.Token {
+	return auth.NewToken(a.tokenSecret, namespace+"/"+repo, access, a.requestUsername(r), a.tokenTTL)
+}
+
+// The user making the request, from basic auth or a token. "" for anonymous requests and bad credentials.
+func (a *RegistryAPI) requestUsername(r *http.Request) string {
+	if user, _ := a.authenticatedUser(r); user != nil {
+		return user.Username
+	} else if token, _ := a.requestToken(r); token != nil {
+		return token.User
+	}
+	return ""
+}
+
+// Returns the token from "Authorization: Token ...". nil, nil if there is none.
+func (a *RegistryAPI) requestToken(r *http.Request) (*auth.Token, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Token ") {
+		return nil, nil
+	}
+	return auth.ParseToken(a.tokenSecret, header)
+}
+
+// Returns the token of a request that may go ahead. A request without a token is let through (with a nil token)
+// unless tokens are required, in which case a valid basic auth login will do.
+func (a *RegistryAPI) checkToken(r *http.Request) (*auth.Token, error) {
+	token, err := a.requestToken(r)
+	if err != nil || token != nil || !a.Config.RequireToken {
+		return token, err
+	}
+	if user, err := a.authenticatedUser(r); err != nil {
+		return nil, err
+	} else if user == nil {
+		return nil, errors.New("Token required")
+	}
+	return nil, nil
+}
+
+// Rejects requests whose token doesn't give access to the repository in the route. Reads (with a token or without)
+// can't see private repositories the user can't read, and writes without a token need a user who can write to the
+// namespace.
+func (a *RegistryAPI) RequireAccess(access string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := a.checkToken(r)
+		if err != nil {
+			a.unauthorized(w, err.Error())
+			return
+		}
+		namespace, repo, _ := parseRepo(r, "")
+		if token != nil && !token.Covers(namespace+"/"+repo, access) {
+			a.unauthorized(w, "Token does not grant "+access+" access to "+namespace+"/"+repo)
+			return
+		}
+		if access == auth.ACCESS_READ {
+			if ok, err := layers.CheckRead(a.Storage, namespace, repo, a.requestUsername(r)); err != nil {
+				a.storageError(w, "Repository", err)
+				return
+			} else if !ok {
+				// don't give away that it exists
+				a.response(w, "Repository not found", http.StatusNotFound, EMPTY_HEADERS)
+				return
+			}
+		}
+		if token == nil && access != auth.ACCESS_READ {
+			if _, ok := a.namespaceWriter(w, r, namespace); !ok {
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// Rejects requests whose token doesn't give access to a repository that contains the image in the route. A
+// repository contains the images its tags point to and, for writes, the ones in its _index_images (which a push
+// lists before uploading anything). Writes also need the user the token was issued to to still be able to write to
+// the repository's namespace. Without a token there is no telling which repository a write is for, so writes need
+// one unless the registry lets anyone push. Reads (with a token or without) can't see images that only private
+// repositories the user can't read reference.
+func (a *RegistryAPI) RequireImageAccess(access string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := a.checkToken(r)
+		if err != nil {
+			a.unauthorized(w, err.Error())
+			return
+		}
+		imageID := mux.Vars(r)["imageID"]
+		if token != nil && !(token.Covers(token.Repository, access) && a.repositoryHasImage(token.Repository, imageID, access)) {
+			a.unauthorized(w, "Token does not grant "+access+" access to image "+imageID)
+			return
+		}
+		if access != auth.ACCESS_READ {
+			if token == nil && (a.Config.RequireToken || a.Config.RequireLogin) {
+				a.unauthorized(w, "Token required to write image "+imageID)
+				return
+			} else if token != nil {
+				if _, ok := a.namespaceWriter(w, r, strings.SplitN(token.Repository, "/", 2)[0]); !ok {
+					return
+				}
+			}
+		}
+		if access == auth.ACCESS_READ && !layers.CanReadImage(a.Storage, imageID, a.requestUsername(r)) {
+			a.response(w, "Image not found", http.StatusNotFound, EMPTY_HEADERS)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (a *RegistryAPI) repositoryHasImage(repository, imageID, access string) bool {
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	if access == auth.ACCESS_READ {
+		tagged, err := layers.TaggedImages(a.Storage, parts[0], parts[1])
+		return err == nil && tagged[imageID]
+	}
+	images, err := layers.RepositoryImages(a.Storage, parts[0], parts[1])
+	return err == nil && images[imageID]
+}
+
+// The v2 routes don't use tokens, so pushes and deletes need basic auth from a user who can write to the namespace
+// (or no auth at all for namespaces anyone can write to, when neither login nor tokens are required)
+func (a *RegistryAPI) RequireV2Write(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace, _, _ := parseV2Repo(r, "")
+		user, err := a.authenticatedUser(r)
+		if err != nil {
+			a.v2Unauthorized(w, err.Error())
+			return
+		} else if user == nil && (a.Config.RequireLogin || a.Config.RequireToken) {
+			a.v2Unauthorized(w, "authentication required")
+			return
+		}
+		if !a.canWrite(namespace, user) {
+			a.v2Error(w, "DENIED", "requested access to the resource is denied", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// The v2 routes don't use tokens, so reads of private repositories need basic auth from a user who can read them
+func (a *RegistryAPI) RequireV2Read(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace, repo, _ := parseV2Repo(r, "")
+		if ok, err := layers.CheckRead(a.Storage, namespace, repo, a.requestUsername(r)); err != nil {
+			a.v2StorageError(w, "NAME_UNKNOWN", "repository name not known to registry", err)
+			return
+		} else if !ok {
+			a.v2Error(w, "NAME_UNKNOWN", "repository name not known to registry", http.StatusNotFound)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"registry/layers"
+	"strings"
+)
+
+func noopAfterWrite(io.ReadSeeker) {}
+
+// Content-Range on a chunk is "<start>-<end>" (the v2 spec) or "bytes <start>-<end>/<total>". returns the start
+// offset and length of the chunk, or -1 for both if there was no Content-Range and the chunk should just be appended.
+func parseContentRange(r *http.Request) (int64, int64, error) {
+	header := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	if header == "" {
+		return -1, -1, nil
+	}
+	var start, end int64
+	if _, err := fmt.Sscanf(header, "%d-%d", &start, &end); err != nil || start < 0 || end < start {
+		return 0, 0, layers.RangeError("Invalid Content-Range: " + header)
+	}
+	// end is inclusive
+	return start, end - start + 1, nil
+}
+
+// adds the headers that tell a client where an upload session lives and how much of it has been received
+func uploadHeaders(headers map[string][]string, location, uuid string, size int64) map[string][]string {
+	headers["Location"] = []string{location}
+	headers["Docker-Upload-Uuid"] = []string{uuid}
+	// Range is inclusive, so an empty upload is reported as 0-0 (as the reference implementation does)
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+	headers["Range"] = []string{fmt.Sprintf("0-%d", end)}
+	headers["Content-Length"] = []string{"0"}
+	return headers
+}
+
+// shared by the v1 and v2 chunk handlers. a missing Content-Range means append at the current offset.
+func (a *RegistryAPI) appendUploadChunk(r *http.Request, upload *layers.Upload) error {
+	offset, length, err := parseContentRange(r)
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		offset = upload.Offset
+	}
+	if upload.ImageID != "" {
+		// the image stays marked as in progress until the layer is complete, so the mark has to show the upload is
+		// still going or it gets reaped
+		if err := layers.RefreshMark(a.Storage, upload.ImageID); err != nil {
+			return err
+		}
+	}
+	return upload.AppendChunk(a.Storage, offset, length, r.Body)
+}
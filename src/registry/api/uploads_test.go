@@ -0,0 +1,95 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func uploadRequest(t *testing.T, method, url, body string, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestImageLayerUpload(t *testing.T) {
+	s := testLocalStorage(t, "/tmp/go-docker-registry-uploads-test")
+	defer s.RemoveAll("/")
+	server := httptest.NewServer(New(&Config{}, s).Router())
+	defer server.Close()
+
+	// the checksum docker computes won't match the layer sent
+	resp := uploadRequest(t, "PUT", server.URL+"/v1/images/img/json", `{"id":"img"}`,
+		map[string]string{"X-Docker-Checksum": "sha256:" + strings.Repeat("0", 64)})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the json to be stored, got %d", resp.StatusCode)
+	}
+	resp = uploadRequest(t, "POST", server.URL+"/v1/images/img/layer/uploads/", "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected an upload session, got %d", resp.StatusCode)
+	}
+	location := server.URL + resp.Header.Get("Location")
+
+	resp = uploadRequest(t, "PATCH", location, "layer", map[string]string{"Content-Range": "0-9"})
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable || resp.Header.Get("Range") != "0-0" {
+		t.Fatalf("A chunk shorter than its Content-Range should be refused, got %d %s", resp.StatusCode,
+			resp.Header.Get("Range"))
+	}
+	resp = uploadRequest(t, "PATCH", location, "layer", map[string]string{"Content-Range": "0-4"})
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Range") != "0-4" {
+		t.Fatalf("Expected the chunk to be taken, got %d %s", resp.StatusCode, resp.Header.Get("Range"))
+	}
+	sum := sha256.Sum256([]byte("layer"))
+	resp = uploadRequest(t, "PUT", location+"?digest=sha256:"+hex.EncodeToString(sum[:]), "", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected a checksum mismatch, got %d", resp.StatusCode)
+	}
+	if resp = uploadRequest(t, "GET", location, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("The session should be kept after a checksum mismatch, got %d", resp.StatusCode)
+	}
+}
+
+func TestImageLayerTarInfo(t *testing.T) {
+	s := testLocalStorage(t, "/tmp/go-docker-registry-tarinfo-test")
+	defer s.RemoveAll("/")
+	server := httptest.NewServer(New(&Config{}, s).Router())
+	defer server.Close()
+
+	layer := &bytes.Buffer{}
+	writer := tar.NewWriter(layer)
+	writer.WriteHeader(&tar.Header{Name: "hello", Mode: 0644, Size: 5})
+	writer.Write([]byte("hello"))
+	writer.Close()
+	if resp := uploadRequest(t, "PUT", server.URL+"/v1/images/img/json", `{"id":"img"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the json to be stored, got %d", resp.StatusCode)
+	}
+	resp := uploadRequest(t, "PUT", server.URL+"/v1/images/img/layer", layer.String(), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the layer to be stored, got %d", resp.StatusCode)
+	}
+	var checksums []string
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "checksum" {
+			checksums = strings.Split(cookie.Value, COOKIE_SEPARATOR)
+		}
+	}
+	// the sha256 of the whole layer and the tarsum, which is only there if the tar was read
+	if len(checksums) != 2 {
+		t.Fatalf("Expected the layer's sha256 and tarsum, got %v", checksums)
+	}
+}
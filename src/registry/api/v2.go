@@ -0,0 +1,90 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"path"
+	"regexp"
+	"registry/logger"
+	"registry/storage"
+	"sort"
+	"strings"
+)
+
+const V2_API_VERSION = "registry/2.0"
+
+var DIGEST_REGEXP = regexp.MustCompile("^sha256:[a-f0-9]{64}$")
+
+// what the v2 spec allows as a tag
+var TAG_REGEXP = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+func V2Headers() map[string][]string {
+	return map[string][]string{
+		"Docker-Distribution-Api-Version": []string{V2_API_VERSION},
+	}
+}
+
+func v2JsonHeaders() map[string][]string {
+	headers := V2Headers()
+	headers["Content-Type"] = []string{"application/json; charset=utf-8"}
+	return headers
+}
+
+// write an error in the format described by the v2 spec:
+// {"errors": [{"code": <code>, "message": <message>}]}
+func (a *RegistryAPI) v2Error(w http.ResponseWriter, code, message string, status int) {
+	a.response(w, v2ErrorBody(code, message), status, v2JsonHeaders())
+}
+
+func (a *RegistryAPI) v2Unauthorized(w http.ResponseWriter, message string) {
+	headers := v2JsonHeaders()
+	headers["WWW-Authenticate"] = []string{`Basic realm="go-docker-registry"`}
+	a.response(w, v2ErrorBody("UNAUTHORIZED", message), http.StatusUnauthorized, headers)
+}
+
+func v2ErrorBody(code, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"errors": []map[string]string{
+			map[string]string{"code": code, "message": message},
+		},
+	}
+}
+
+// v2 names are slash separated and may have any number of components. map them onto the v1 layout:
+// "foo" -> library/foo, "foo/bar" -> foo/bar, "foo/bar/baz" -> foo/bar/baz (namespace foo, repo bar/baz)
+func parseV2Repo(r *http.Request, extra string) (string, string, string) {
+	vars := mux.Vars(r)
+	namespace, repo := splitV2Name(vars["name"])
+	return namespace, repo, vars[extra]
+}
+
+func splitV2Name(name string) (string, string) {
+	if idx := strings.Index(name, "/"); idx >= 0 {
+		return name[:idx], name[idx+1:]
+	}
+	return "library", name
+}
+
+func (a *RegistryAPI) V2BaseHandler(w http.ResponseWriter, r *http.Request) {
+	a.response(w, map[string]string{}, http.StatusOK, v2JsonHeaders())
+}
+
+func (a *RegistryAPI) GetV2TagsHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, repo, _ := parseV2Repo(r, "")
+	logger.Debug("[GetV2Tags] namespace=%s; repository=%s", namespace, repo)
+	names, err := a.Storage.List(storage.ManifestTagPath(namespace, repo, ""))
+	if err != nil {
+		a.v2StorageError(w, "NAME_UNKNOWN", "repository name not known to registry", err)
+		return
+	}
+	tags := make([]string, len(names))
+	for i, name := range names {
+		tags[i] = path.Base(name)
+	}
+	sort.Strings(tags)
+	data := map[string]interface{}{
+		"name": mux.Vars(r)["name"],
+		"tags": tags,
+	}
+	a.response(w, data, http.StatusOK, v2JsonHeaders())
+}
@@ -0,0 +1,329 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"registry/layers"
+	"registry/logger"
+	"registry/storage"
+)
+
+// Whether the repository can serve the blob, which it can if the blob was pushed to or mounted into it. Blobs
+// pushed before repositories kept links are found in the repository's manifests instead, and linked then.
+func (a *RegistryAPI) repoHasBlob(namespace, repo, digest string) (bool, error) {
+	if exists, err := a.Storage.Exists(storage.RepoBlobLinkPath(namespace, repo, digest)); err != nil || exists {
+		return exists, err
+	}
+	if exists, err := a.Storage.Exists(storage.BlobPath(digest)); err != nil || !exists {
+		return false, err
+	}
+	found, err := a.manifestsReference(namespace, repo, digest)
+	if err != nil || !found {
+		return false, err
+	}
+	return true, a.linkBlob(namespace, repo, digest)
+}
+
+// whether any manifest of the repository references the blob
+func (a *RegistryAPI) manifestsReference(namespace, repo, digest string) (bool, error) {
+	found := false
+	err := storage.Walk(a.Storage, storage.ManifestRevisionPath(namespace, repo, ""), func(relpath string) error {
+		if found {
+			return nil
+		}
+		data, err := a.Storage.Get(relpath)
+		if err != nil {
+			return err
+		}
+		var manifest v2Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			logger.Error("[manifestsReference] Invalid manifest %s: %s", relpath, err.Error())
+			return nil
+		}
+		for _, blobDigest := range manifest.blobDigests() {
+			found = found || blobDigest == digest
+		}
+		return nil
+	})
+	if storage.IsNotFound(err) {
+		err = nil
+	}
+	return found, err
+}
+
+// Records whether namespace/repo links the blob in the blob's list of repositories, so deleting the blob from one
+// repository doesn't have to look through every other one. Returns whether any repository still links it. A blob
+// without a list counts as linked, since there's no telling who has it.
+func (a *RegistryAPI) updateBlobRepositories(namespace, repo, digest string, linked bool) (bool, error) {
+	name := namespace + "/" + repo
+	referenced := true
+	err := storage.Update(a.Storage, storage.BlobRepositoriesPath(digest), func(content []byte) ([]byte, error) {
+		repos := map[string]bool{}
+		if content == nil && !linked {
+			return nil, nil
+		} else if content != nil {
+			if err := json.Unmarshal(content, &repos); err != nil {
+				return nil, err
+			}
+		}
+		if repos[name] == linked {
+			referenced = len(repos) > 0
+			return nil, nil
+		}
+		if linked {
+			repos[name] = true
+		} else {
+			delete(repos, name)
+		}
+		referenced = len(repos) > 0
+		return json.Marshal(repos)
+	})
+	return referenced, err
+}
+
+func (a *RegistryAPI) linkBlob(namespace, repo, digest string) error {
+	if _, err := a.updateBlobRepositories(namespace, repo, digest, true); err != nil {
+		return err
+	}
+	return a.Storage.Put(storage.RepoBlobLinkPath(namespace, repo, digest), []byte(digest))
+}
+
+func (a *RegistryAPI) GetV2BlobHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, repo, digest := parseV2Repo(r, "digest")
+	if !DIGEST_REGEXP.MatchString(digest) {
+		a.v2Error(w, "DIGEST_INVALID", "invalid digest: "+digest, http.StatusBadRequest)
+		return
+	}
+	// blobs are stored once for every repository, but a repository only serves its own
+	if ok, err := a.repoHasBlob(namespace, repo, digest); err != nil {
+		a.v2StorageError(w, "BLOB_UNKNOWN", "blob unknown to registry", err)
+		return
+	} else if !ok {
+		a.v2Error(w, "BLOB_UNKNOWN", "blob unknown to registry", http.StatusNotFound)
+		return
+	}
+	blobPath := storage.BlobPath(digest)
+	size, err := a.Storage.Size(blobPath)
+	if err != nil {
+		a.v2StorageError(w, "BLOB_UNKNOWN", "blob unknown to registry", err)
+		return
+	}
+	headers := DefaultCacheHeaders()
+	for name, values := range V2Headers() {
+		headers[name] = values
+	}
+	headers["Content-Type"] = []string{"application/octet-stream"}
+	headers["Content-Length"] = []string{fmt.Sprintf("%d", size)}
+	headers["Docker-Content-Digest"] = []string{digest}
+	headers["Etag"] = []string{`"` + digest + `"`}
+	if r.Method == "HEAD" {
+		a.response(w, nil, http.StatusOK, headers)
+		return
+	}
+	reader, err := a.Storage.GetReader(blobPath)
+	if err != nil {
+		a.v2StorageError(w, "BLOB_UNKNOWN", "blob unknown to registry", err)
+		return
+	}
+	defer reader.Close()
+	a.response(w, reader, http.StatusOK, headers)
+}
+
+// Removes the blob from the repository. The blob itself is only removed once nothing else needs it.
+func (a *RegistryAPI) DeleteV2BlobHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, repo, digest := parseV2Repo(r, "digest")
+	if !DIGEST_REGEXP.MatchString(digest) {
+		a.v2Error(w, "DIGEST_INVALID", "invalid digest: "+digest, http.StatusBadRequest)
+		return
+	}
+	// also links blobs only the manifests know about, so there is a link to remove
+	if ok, err := a.repoHasBlob(namespace, repo, digest); err != nil {
+		a.v2StorageError(w, "BLOB_UNKNOWN", "blob unknown to registry", err)
+		return
+	} else if !ok {
+		a.v2Error(w, "BLOB_UNKNOWN", "blob unknown to registry", http.StatusNotFound)
+		return
+	}
+	if err := a.Storage.Remove(storage.RepoBlobLinkPath(namespace, repo, digest)); err != nil {
+		a.v2StorageError(w, "BLOB_UNKNOWN", "blob unknown to registry", err)
+		return
+	}
+	// a manifest of the repository that still references the blob would be left without it
+	inManifests, err := a.manifestsReference(namespace, repo, digest)
+	if err != nil {
+		a.v2StorageError(w, "BLOB_UNKNOWN", "blob unknown to registry", err)
+		return
+	}
+	if referenced, err := a.updateBlobRepositories(namespace, repo, digest, inManifests); err != nil {
+		a.v2StorageError(w, "BLOB_UNKNOWN", "blob unknown to registry", err)
+		return
+	} else if !referenced {
+		if err := a.Storage.RemoveAll(storage.BlobDir(digest)); err != nil && !storage.IsNotFound(err) {
+			a.v2StorageError(w, "BLOB_UNKNOWN", "blob unknown to registry", err)
+			return
+		}
+		if err := a.Storage.Remove(storage.BlobRepositoriesPath(digest)); err != nil && !storage.IsNotFound(err) {
+			a.v2StorageError(w, "BLOB_UNKNOWN", "blob unknown to registry", err)
+			return
+		}
+	}
+	a.response(w, nil, http.StatusAccepted, V2Headers())
+}
+
+func (a *RegistryAPI) v2UploadError(w http.ResponseWriter, r *http.Request, upload *layers.Upload, err error) {
+	switch err.(type) {
+	case layers.RangeError:
+		headers := uploadHeaders(v2JsonHeaders(), r.URL.Path, upload.UUID, upload.Offset)
+		a.response(w, v2ErrorBody("BLOB_UPLOAD_INVALID", err.Error()), http.StatusRequestedRangeNotSatisfiable, headers)
+	case layers.DigestError:
+		a.v2Error(w, "DIGEST_INVALID", err.Error(), http.StatusBadRequest)
+	default:
+		a.internalError(w, err.Error())
+	}
+}
+
+// A cross repository mount links a blob the user can read in the repository it comes from into this one. If it
+// can't, the client is told to upload the blob instead.
+func (a *RegistryAPI) mountV2Blob(r *http.Request, digest string) bool {
+	namespace, repo, _ := parseV2Repo(r, "")
+	fromNamespace, fromRepo := splitV2Name(r.URL.Query().Get("from"))
+	if !layers.CanRead(a.Storage, fromNamespace, fromRepo, a.requestUsername(r)) {
+		return false
+	}
+	if ok, err := a.repoHasBlob(fromNamespace, fromRepo, digest); err != nil || !ok {
+		return false
+	}
+	if err := a.linkBlob(namespace, repo, digest); err != nil {
+		logger.Error("[StartV2Upload] Error mounting %s: %s", digest, err.Error())
+		return false
+	}
+	return true
+}
+
+func (a *RegistryAPI) StartV2UploadHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	query := r.URL.Query()
+	if mount := query.Get("mount"); mount != "" && DIGEST_REGEXP.MatchString(mount) {
+		if a.mountV2Blob(r, mount) {
+			headers := V2Headers()
+			headers["Location"] = []string{"/v2/" + name + "/blobs/" + mount}
+			headers["Docker-Content-Digest"] = []string{mount}
+			a.response(w, nil, http.StatusCreated, headers)
+			return
+		}
+	}
+	upload, err := layers.NewUpload(a.Storage, "")
+	if err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	logger.Debug("[StartV2Upload] name=%s; uuid=%s", name, upload.UUID)
+	if digest := query.Get("digest"); digest != "" {
+		// monolithic upload
+		if err := upload.AppendChunk(a.Storage, 0, -1, r.Body); err != nil {
+			a.internalError(w, err.Error())
+			return
+		}
+		a.commitV2Upload(w, r, upload, digest)
+		return
+	}
+	location := "/v2/" + name + "/blobs/uploads/" + upload.UUID
+	a.response(w, nil, http.StatusAccepted, uploadHeaders(V2Headers(), location, upload.UUID, 0))
+}
+
+func (a *RegistryAPI) getV2Upload(w http.ResponseWriter, r *http.Request) *layers.Upload {
+	upload, err := layers.GetUpload(a.Storage, mux.Vars(r)["uuid"])
+	if storage.IsTransient(err) {
+		a.v2StorageError(w, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry", err)
+		return nil
+	} else if err != nil || upload.ImageID != "" {
+		a.v2Error(w, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry", http.StatusNotFound)
+		return nil
+	}
+	return upload
+}
+
+func (a *RegistryAPI) GetV2UploadHandler(w http.ResponseWriter, r *http.Request) {
+	upload := a.getV2Upload(w, r)
+	if upload == nil {
+		return
+	}
+	a.response(w, nil, http.StatusNoContent, uploadHeaders(V2Headers(), r.URL.Path, upload.UUID, upload.Offset))
+}
+
+func (a *RegistryAPI) PatchV2UploadHandler(w http.ResponseWriter, r *http.Request) {
+	upload := a.getV2Upload(w, r)
+	if upload == nil {
+		return
+	}
+	logger.Debug("[PatchV2Upload] uuid=%s; offset=%d", upload.UUID, upload.Offset)
+	if err := a.appendUploadChunk(r, upload); err != nil {
+		a.v2UploadError(w, r, upload, err)
+		return
+	}
+	a.response(w, nil, http.StatusAccepted, uploadHeaders(V2Headers(), r.URL.Path, upload.UUID, upload.Offset))
+}
+
+func (a *RegistryAPI) PutV2UploadHandler(w http.ResponseWriter, r *http.Request) {
+	digest := r.URL.Query().Get("digest")
+	if !DIGEST_REGEXP.MatchString(digest) {
+		a.v2Error(w, "DIGEST_INVALID", "invalid digest: "+digest, http.StatusBadRequest)
+		return
+	}
+	upload := a.getV2Upload(w, r)
+	if upload == nil {
+		return
+	}
+	logger.Debug("[PutV2Upload] uuid=%s; digest=%s", upload.UUID, digest)
+	// the final chunk may come along with the PUT
+	if r.ContentLength != 0 {
+		if err := a.appendUploadChunk(r, upload); err != nil {
+			a.v2UploadError(w, r, upload, err)
+			return
+		}
+	}
+	a.commitV2Upload(w, r, upload, digest)
+}
+
+func (a *RegistryAPI) commitV2Upload(w http.ResponseWriter, r *http.Request, upload *layers.Upload, digest string) {
+	name := mux.Vars(r)["name"]
+	namespace, repo, _ := parseV2Repo(r, "")
+	blobPath := storage.BlobPath(digest)
+	var err error
+	if exists, _ := a.Storage.Exists(blobPath); exists {
+		// content addressed, so if it is already there it is already correct
+		if err = upload.Verify(digest); err == nil {
+			if err = upload.Claim(a.Storage); err == nil {
+				upload.Cancel(a.Storage)
+			}
+		}
+	} else {
+		err = upload.Commit(a.Storage, blobPath, digest, noopAfterWrite)
+	}
+	if err != nil {
+		a.v2UploadError(w, r, upload, err)
+		return
+	}
+	if err := a.linkBlob(namespace, repo, digest); err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	headers := V2Headers()
+	headers["Location"] = []string{"/v2/" + name + "/blobs/" + digest}
+	headers["Docker-Content-Digest"] = []string{digest}
+	a.response(w, nil, http.StatusCreated, headers)
+}
+
+func (a *RegistryAPI) DeleteV2UploadHandler(w http.ResponseWriter, r *http.Request) {
+	upload := a.getV2Upload(w, r)
+	if upload == nil {
+		return
+	}
+	if err := upload.Cancel(a.Storage); err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	a.response(w, nil, http.StatusNoContent, V2Headers())
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"registry/layers"
+	"registry/logger"
+	"registry/storage"
+)
+
+const MANIFEST_V1_SIGNED_MEDIA_TYPE = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+
+type v2Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+// covers schema1, schema2 and manifest lists. we only look at the parts we need to validate references.
+type v2Manifest struct {
+	SchemaVersion int            `json:"schemaVersion"`
+	MediaType     string         `json:"mediaType"`
+	Config        *v2Descriptor  `json:"config"`
+	Layers        []v2Descriptor `json:"layers"`
+	Manifests     []v2Descriptor `json:"manifests"`
+	FSLayers      []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+}
+
+func (m *v2Manifest) blobDigests() []string {
+	digests := []string{}
+	if m.Config != nil {
+		digests = append(digests, m.Config.Digest)
+	}
+	for _, layer := range m.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	for _, layer := range m.FSLayers {
+		digests = append(digests, layer.BlobSum)
+	}
+	return digests
+}
+
+func (m *v2Manifest) contentType() string {
+	if m.MediaType != "" {
+		return m.MediaType
+	}
+	if m.SchemaVersion == 1 {
+		return MANIFEST_V1_SIGNED_MEDIA_TYPE
+	}
+	return "application/json"
+}
+
+// resolve a tag or digest reference to a digest
+func (a *RegistryAPI) resolveManifest(namespace, repo, reference string) (string, error) {
+	if DIGEST_REGEXP.MatchString(reference) {
+		return reference, nil
+	} else if !TAG_REGEXP.MatchString(reference) {
+		// can't be a tag, so there's nothing to look for in storage
+		return "", &storage.Error{Kind: storage.ErrNotFound, Path: reference}
+	}
+	content, err := a.Storage.Get(storage.ManifestTagPath(namespace, repo, reference))
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+func (a *RegistryAPI) GetV2ManifestHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, repo, reference := parseV2Repo(r, "reference")
+	logger.Debug("[GetV2Manifest] namespace=%s; repository=%s; reference=%s", namespace, repo, reference)
+	digest, err := a.resolveManifest(namespace, repo, reference)
+	if err != nil {
+		a.v2StorageError(w, "MANIFEST_UNKNOWN", "manifest unknown", err)
+		return
+	}
+	data, err := a.Storage.Get(storage.ManifestRevisionPath(namespace, repo, digest))
+	if err != nil {
+		a.v2StorageError(w, "MANIFEST_UNKNOWN", "manifest unknown", err)
+		return
+	}
+	var manifest v2Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		a.internalError(w, "Stored manifest is invalid: "+err.Error())
+		return
+	}
+	headers := V2Headers()
+	headers["Content-Type"] = []string{manifest.contentType()}
+	headers["Content-Length"] = []string{fmt.Sprintf("%d", len(data))}
+	headers["Docker-Content-Digest"] = []string{digest}
+	headers["Etag"] = []string{`"` + digest + `"`}
+	a.response(w, data, http.StatusOK, headers)
+}
+
+func (a *RegistryAPI) PutV2ManifestHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, repo, reference := parseV2Repo(r, "reference")
+	logger.Debug("[PutV2Manifest] namespace=%s; repository=%s; reference=%s", namespace, repo, reference)
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		a.v2Error(w, "MANIFEST_INVALID", "Error reading request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var manifest v2Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		a.v2Error(w, "MANIFEST_INVALID", "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(data)
+	digest := layers.DIGEST_SHA256_PREFIX + hex.EncodeToString(sum[:])
+	isDigest := DIGEST_REGEXP.MatchString(reference)
+	if !isDigest && !TAG_REGEXP.MatchString(reference) {
+		a.v2Error(w, "TAG_INVALID", "invalid tag: "+reference, http.StatusBadRequest)
+		return
+	}
+	if isDigest && reference != digest {
+		a.v2Error(w, "DIGEST_INVALID", "provided digest did not match uploaded content", http.StatusBadRequest)
+		return
+	}
+	for _, blobDigest := range manifest.blobDigests() {
+		if !DIGEST_REGEXP.MatchString(blobDigest) {
+			a.v2Error(w, "DIGEST_INVALID", "invalid digest: "+blobDigest, http.StatusBadRequest)
+			return
+		}
+		if ok, err := a.repoHasBlob(namespace, repo, blobDigest); err != nil {
+			a.v2StorageError(w, "MANIFEST_BLOB_UNKNOWN", "blob unknown to registry: "+blobDigest, err)
+			return
+		} else if !ok {
+			a.v2Error(w, "MANIFEST_BLOB_UNKNOWN", "blob unknown to registry: "+blobDigest, http.StatusBadRequest)
+			return
+		}
+	}
+	for _, child := range manifest.Manifests {
+		if !DIGEST_REGEXP.MatchString(child.Digest) {
+			a.v2Error(w, "DIGEST_INVALID", "invalid digest: "+child.Digest, http.StatusBadRequest)
+			return
+		}
+		if exists, err := a.Storage.Exists(storage.ManifestRevisionPath(namespace, repo, child.Digest)); err != nil {
+			a.v2StorageError(w, "MANIFEST_UNKNOWN", "manifest unknown: "+child.Digest, err)
+			return
+		} else if !exists {
+			a.v2Error(w, "MANIFEST_UNKNOWN", "manifest unknown: "+child.Digest, http.StatusBadRequest)
+			return
+		}
+	}
+	if err := a.Storage.Put(storage.ManifestRevisionPath(namespace, repo, digest), data); err != nil {
+		a.internalError(w, err.Error())
+		return
+	}
+	if !isDigest {
+		if err := a.Storage.Put(storage.ManifestTagPath(namespace, repo, reference), []byte(digest)); err != nil {
+			a.internalError(w, err.Error())
+			return
+		}
+		if err := layers.AddToSearchIndex(a.Storage, namespace, repo); err != nil {
+			logger.Error("[PutV2Manifest] error updating search index: %s", err.Error())
+		}
+	}
+	headers := V2Headers()
+	headers["Location"] = []string{"/v2/" + mux.Vars(r)["name"] + "/manifests/" + digest}
+	headers["Docker-Content-Digest"] = []string{digest}
+	a.response(w, nil, http.StatusCreated, headers)
+}
+
+func (a *RegistryAPI) DeleteV2ManifestHandler(w http.ResponseWriter, r *http.Request) {
+	namespace, repo, reference := parseV2Repo(r, "reference")
+	logger.Debug("[DeleteV2Manifest] namespace=%s; repository=%s; reference=%s", namespace, repo, reference)
+	if !DIGEST_REGEXP.MatchString(reference) {
+		a.v2Error(w, "DIGEST_INVALID", "manifests can only be deleted by digest", http.StatusBadRequest)
+		return
+	}
+	if err := a.Storage.Remove(storage.ManifestRevisionPath(namespace, repo, reference)); err != nil {
+		a.v2StorageError(w, "MANIFEST_UNKNOWN", "manifest unknown", err)
+		return
+	}
+	// remove any tags that pointed at the deleted manifest so they don't dangle
+	tagPaths, _ := a.Storage.List(storage.ManifestTagPath(namespace, repo, ""))
+	for _, tagPath := range tagPaths {
+		if content, err := a.Storage.Get(tagPath); err == nil && string(content) == reference {
+			a.Storage.Remove(tagPath)
+		}
+	}
+	a.response(w, nil, http.StatusAccepted, V2Headers())
+}
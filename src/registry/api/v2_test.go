@@ -0,0 +1,155 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"registry/storage"
+	"strings"
+	"testing"
+)
+
+func v2Digest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// uploads content as a blob of the repository in two chunks
+func pushV2Blob(t *testing.T, url, name, content string) string {
+	resp := uploadRequest(t, "POST", url+"/v2/"+name+"/blobs/uploads/", "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected an upload session, got %d", resp.StatusCode)
+	}
+	location := url + resp.Header.Get("Location")
+	half := len(content) / 2
+	if resp = uploadRequest(t, "PATCH", location, content[:half], nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected the first chunk to be taken, got %d", resp.StatusCode)
+	}
+	digest := v2Digest(content)
+	resp = uploadRequest(t, "PUT", location+"?digest="+digest, content[half:], nil)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Docker-Content-Digest") != digest {
+		t.Fatalf("Expected the blob to be committed, got %d", resp.StatusCode)
+	}
+	return digest
+}
+
+func TestV2(t *testing.T) {
+	s := testLocalStorage(t, "/tmp/go-docker-registry-v2-test")
+	defer s.RemoveAll("/")
+	server := httptest.NewServer(New(&Config{}, s).Router())
+	defer server.Close()
+
+	if code, _ := getBody(t, server.URL+"/v2/"); code != http.StatusOK {
+		t.Fatalf("Expected the v2 base to be there, got %d", code)
+	}
+	layer := pushV2Blob(t, server.URL, "someone/app", "layer content")
+	config := pushV2Blob(t, server.URL, "someone/app", "config content")
+	if code, body := getBody(t, server.URL+"/v2/someone/app/blobs/"+layer); code != http.StatusOK || body != "layer content" {
+		t.Fatalf("Expected the blob, got %d %q", code, body)
+	}
+	if code, _ := getBody(t, server.URL+"/v2/someone/app/blobs/"+v2Digest("missing")); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing blob, got %d", code)
+	}
+
+	manifest := `{"schemaVersion":2,"config":{"digest":"` + config + `"},"layers":[{"digest":"` + layer + `"}]}`
+	resp := uploadRequest(t, "PUT", server.URL+"/v2/someone/app/manifests/latest", manifest, nil)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Docker-Content-Digest") != v2Digest(manifest) {
+		t.Fatalf("Expected the manifest to be stored, got %d", resp.StatusCode)
+	}
+	for _, reference := range []string{"latest", v2Digest(manifest)} {
+		if code, body := getBody(t, server.URL+"/v2/someone/app/manifests/"+reference); code != http.StatusOK || body != manifest {
+			t.Fatalf("Expected the manifest by %s, got %d %s", reference, code, body)
+		}
+	}
+	code, body := getBody(t, server.URL+"/v2/someone/app/tags/list")
+	var tags struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal([]byte(body), &tags); code != http.StatusOK || err != nil ||
+		tags.Name != "someone/app" || len(tags.Tags) != 1 || tags.Tags[0] != "latest" {
+		t.Fatalf("Expected the latest tag, got %d %s", code, body)
+	}
+
+	// the same blob in another repository is stored once
+	if shared := pushV2Blob(t, server.URL, "someone/other", "layer content"); shared != layer {
+		t.Fatalf("Expected the same digest, got %s", shared)
+	}
+	if resp = uploadRequest(t, "DELETE", server.URL+"/v2/someone/other/blobs/"+layer, "", nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected the blob to be deleted from the repository, got %d", resp.StatusCode)
+	}
+	if code, _ := getBody(t, server.URL+"/v2/someone/other/blobs/"+layer); code != http.StatusNotFound {
+		t.Fatalf("The deleted blob should be gone from the repository, got %d", code)
+	}
+	if code, _ := getBody(t, server.URL+"/v2/someone/app/blobs/"+layer); code != http.StatusOK {
+		t.Fatalf("The blob should still be there for the other repository, got %d", code)
+	}
+	// repositories with more than two name parts count too
+	pushV2Blob(t, server.URL, "someone/deep/app", "layer content")
+	if resp = uploadRequest(t, "DELETE", server.URL+"/v2/someone/other/blobs/"+layer, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Deleting a blob twice should be a 404, got %d", resp.StatusCode)
+	}
+	pushV2Blob(t, server.URL, "someone/other", "layer content")
+	uploadRequest(t, "DELETE", server.URL+"/v2/someone/app/blobs/"+layer, "", nil)
+	uploadRequest(t, "DELETE", server.URL+"/v2/someone/other/blobs/"+layer, "", nil)
+	if code, _ := getBody(t, server.URL+"/v2/someone/deep/app/blobs/"+layer); code != http.StatusOK {
+		t.Fatalf("The blob should still be there for someone/deep/app, got %d", code)
+	}
+	pushV2Blob(t, server.URL, "someone/app", "layer content")
+	// the manifest still references it
+	if resp = uploadRequest(t, "DELETE", server.URL+"/v2/someone/app/blobs/"+layer, "", nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected the blob to be deleted from the repository, got %d", resp.StatusCode)
+	}
+	if exists, _ := s.Exists(storage.BlobPath(layer)); !exists {
+		t.Fatal("A blob referenced by a manifest should not be removed")
+	}
+
+	resp = uploadRequest(t, "DELETE", server.URL+"/v2/someone/app/manifests/"+v2Digest(manifest), "", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected the manifest to be deleted, got %d", resp.StatusCode)
+	}
+	if code, _ := getBody(t, server.URL+"/v2/someone/app/manifests/latest"); code != http.StatusNotFound {
+		t.Fatalf("The tag of a deleted manifest should be gone, got %d", code)
+	}
+	if resp = uploadRequest(t, "DELETE", server.URL+"/v2/someone/app/blobs/"+config, "", nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected the blob to be deleted, got %d", resp.StatusCode)
+	}
+	if exists, _ := s.Exists(storage.BlobPath(config)); exists {
+		t.Fatal("A blob nothing references should be removed")
+	}
+	if resp = uploadRequest(t, "DELETE", server.URL+"/v2/someone/app/blobs/"+config, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Deleting a blob twice should be a 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestV2Errors(t *testing.T) {
+	s := testLocalStorage(t, "/tmp/go-docker-registry-v2-errors-test")
+	defer s.RemoveAll("/")
+	server := httptest.NewServer(New(&Config{}, s).Router())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v2/someone/app/manifests/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(data), "MANIFEST_UNKNOWN") {
+		t.Fatalf("Expected a MANIFEST_UNKNOWN error, got %d %s", resp.StatusCode, data)
+	}
+	blob := pushV2Blob(t, server.URL, "someone/app", "content")
+	if resp := uploadRequest(t, "PUT", server.URL+"/v2/someone/app/manifests/"+v2Digest("other"), `{"schemaVersion":2}`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("A manifest that doesn't match its digest should be refused, got %d", resp.StatusCode)
+	}
+	if resp := uploadRequest(t, "PUT", server.URL+"/v2/someone/app/blobs/uploads/unknown?digest="+blob, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected an unknown upload to be a 404, got %d", resp.StatusCode)
+	}
+	for _, reference := range []string{"-dash", ".hidden", "sha256:abc", strings.Repeat("t", 129)} {
+		if resp := uploadRequest(t, "PUT", server.URL+"/v2/someone/app/manifests/"+reference, `{"schemaVersion":2}`, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("A manifest tagged %q should be refused, got %d", reference, resp.StatusCode)
+		}
+	}
+}
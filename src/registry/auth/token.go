@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ACCESS_READ   = "read"
+	ACCESS_WRITE  = "write"
+	ACCESS_DELETE = "delete"
+)
+
+// A Token grants access to a single repository until it expires. It is handed out by the index endpoints in
+// X-Docker-Token and comes back in "Authorization: Token <token>".
+type Token struct {
+	Repository string
+	Access     string
+	User       string
+	Expires    time.Time
+	Signature  string
+}
+
+// every field is prefixed with its length, so no value can be shifted into the next one (repository names may
+// contain any separator)
+func (t *Token) payload() string {
+	return fmt.Sprintf("%d:%s|%d:%s|%d:%s|%d", len(t.Repository), t.Repository, len(t.Access), t.Access, len(t.User),
+		t.User, t.Expires.Unix())
+}
+
+func (t *Token) sign(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(t.payload()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func NewToken(secret []byte, repository, access, user string, ttl time.Duration) *Token {
+	t := &Token{Repository: repository, Access: access, User: user, Expires: time.Now().Add(ttl)}
+	t.Signature = t.sign(secret)
+	return t
+}
+
+// signature=<sig>, followed by the fields it signs. the docker client sends it back as it got it.
+func (t *Token) String() string {
+	return "signature=" + t.Signature + "," + t.payload()
+}
+
+// Covers returns true if the token allows access to repository. write and delete tokens can also read.
+func (t *Token) Covers(repository, access string) bool {
+	if t.Repository != repository {
+		return false
+	}
+	return t.Access == access || access == ACCESS_READ
+}
+
+// ParseToken parses and verifies a token. The docker client sends back whatever it got in X-Docker-Token prefixed
+// with "Token ", which may already have had a "Token " prefix, so any number of those are stripped.
+func ParseToken(secret []byte, value string) (*Token, error) {
+	value = strings.TrimSpace(value)
+	for strings.HasPrefix(value, "Token ") {
+		value = strings.TrimSpace(strings.TrimPrefix(value, "Token "))
+	}
+	if !strings.HasPrefix(value, "signature=") || !strings.Contains(value, ",") {
+		return nil, errors.New("Malformed token")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, "signature="), ",", 2)
+	t := &Token{Signature: parts[0]}
+	// the fields are read by their lengths, since they may contain anything
+	payload := parts[1]
+	for _, field := range []*string{&t.Repository, &t.Access, &t.User} {
+		colon := strings.Index(payload, ":")
+		if colon < 0 {
+			return nil, errors.New("Malformed token")
+		}
+		length, err := strconv.Atoi(payload[:colon])
+		if err != nil || length < 0 || colon+1+length >= len(payload) || payload[colon+1+length] != '|' {
+			return nil, errors.New("Malformed token")
+		}
+		*field = payload[colon+1 : colon+1+length]
+		payload = payload[colon+2+length:]
+	}
+	expires, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return nil, errors.New("Malformed token expiry")
+	}
+	t.Expires = time.Unix(expires, 0)
+	if !hmac.Equal([]byte(t.Signature), []byte(t.sign(secret))) {
+		return nil, errors.New("Invalid token signature")
+	}
+	if time.Now().After(t.Expires) {
+		return nil, errors.New("Token expired")
+	}
+	return t, nil
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	secret := []byte("secret")
+	token := NewToken(secret, "library/foo", ACCESS_WRITE, "someone", time.Hour)
+
+	// the docker client sends back "Token " + X-Docker-Token, which already has the prefix
+	parsed, err := ParseToken(secret, "Token Token "+token.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Repository != "library/foo" || parsed.Access != ACCESS_WRITE || parsed.User != "someone" {
+		t.Fatalf("Token did not round trip: %+v", parsed)
+	}
+	if !parsed.Covers("library/foo", ACCESS_READ) || !parsed.Covers("library/foo", ACCESS_WRITE) {
+		t.Fatal("A write token should cover reads and writes of its repository")
+	}
+	if parsed.Covers("library/foo", ACCESS_DELETE) || parsed.Covers("library/bar", ACCESS_READ) {
+		t.Fatal("A write token should not cover deletes or other repositories")
+	}
+
+	if _, err := ParseToken([]byte("other"), token.String()); err == nil {
+		t.Fatal("A token signed with another secret should be rejected")
+	}
+	tampered := strings.Replace(token.String(), "library/foo", "library/bar", 1)
+	if _, err := ParseToken(secret, tampered); err == nil {
+		t.Fatal("A token for another repository should be rejected")
+	}
+	// the fields can't be shifted into each other while keeping the signature
+	forged := NewToken(secret, "victim/app|delete|", ACCESS_WRITE, "", time.Hour)
+	forged.Repository, forged.Access, forged.User = "victim/app", ACCESS_DELETE, "|write|"
+	if _, err := ParseToken(secret, forged.String()); err == nil {
+		t.Fatal("A token with its fields shifted should be rejected")
+	}
+	// nor do separators in them get in the way
+	odd := NewToken(secret, `some,one/"app"`, ACCESS_WRITE, "a=b,c", time.Hour)
+	if parsed, err := ParseToken(secret, "Token "+odd.String()); err != nil || parsed.Repository != odd.Repository || parsed.User != odd.User {
+		t.Fatalf("Token with separators in its fields did not round trip: %+v, %v", parsed, err)
+	}
+	expired := NewToken(secret, "library/foo", ACCESS_READ, "", -time.Minute)
+	if _, err := ParseToken(secret, expired.String()); err == nil {
+		t.Fatal("An expired token should be rejected")
+	}
+}
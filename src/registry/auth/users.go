@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"path"
+	"regexp"
+	"registry/storage"
+	"strings"
+	"time"
+)
+
+// same rules as the docker index
+var USERNAME_REGEXP = regexp.MustCompile("^[a-z0-9_]{4,30}$")
+
+const MIN_PASSWORD_LENGTH = 5
+
+var ErrUserExists = errors.New("Username already exists")
+var ErrBadCredentials = errors.New("Invalid username or password")
+var ErrInvalidUsername = errors.New("Username must be 4 to 30 characters of lowercase letters, digits and _")
+var ErrReservedUsername = errors.New("Username is reserved")
+var ErrNoSuchUser = errors.New("User does not exist")
+
+// namespaces that must not belong to a user. library holds the official images (and the repositories pushed without
+// a namespace), so whoever registered it would own all of them.
+var RESERVED_USERNAMES = []string{"library"}
+
+type User struct {
+	Username     string    `json:"username"`
+	Email        string    `json:"email"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// the username goes into the storage path of the user, so anything that could point it somewhere else (like
+// "../images/x") must never get that far
+func validUsername(username string) bool {
+	userPath := storage.UserPath(username)
+	return USERNAME_REGEXP.MatchString(username) && path.Clean(userPath) == userPath
+}
+
+func validate(username, password, email string) error {
+	if !validUsername(username) {
+		return ErrInvalidUsername
+	}
+	for _, reserved := range RESERVED_USERNAMES {
+		if username == reserved {
+			return ErrReservedUsername
+		}
+	}
+	if len(password) < MIN_PASSWORD_LENGTH {
+		return errors.New("Password is too short")
+	}
+	if !strings.Contains(email, "@") {
+		return errors.New("Invalid email address")
+	}
+	return nil
+}
+
+func (u *User) setPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+func GetUser(s storage.Storage, username string) (*User, error) {
+	if !validUsername(username) {
+		return nil, ErrInvalidUsername
+	}
+	content, err := s.Get(storage.UserPath(username))
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := json.Unmarshal(content, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func CreateUser(s storage.Storage, username, password, email string) (*User, error) {
+	if err := validate(username, password, email); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	user := &User{Username: username, Email: email, CreatedAt: now, UpdatedAt: now}
+	if err := user.setPassword(password); err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	// only if nobody has the name yet, even if they are signing up at the same time
+	if err := s.PutIfVersion(storage.UserPath(username), content, ""); storage.IsConflict(err) {
+		return nil, ErrUserExists
+	} else if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Returns the user if the password matches, ErrBadCredentials otherwise
+func Authenticate(s storage.Storage, username, password string) (*User, error) {
+	if !validUsername(username) {
+		return nil, ErrBadCredentials
+	}
+	user, err := GetUser(s, username)
+	if err != nil {
+		// don't let on whether the user exists
+		return nil, ErrBadCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrBadCredentials
+	}
+	return user, nil
+}
+
+// Change the email and/or password of a user. Empty values are left alone. The change is made to what is in storage
+// rather than to u, so a concurrent update of the other field isn't undone by it.
+func (u *User) Update(s storage.Storage, password, email string) error {
+	if email != "" && !strings.Contains(email, "@") {
+		return errors.New("Invalid email address")
+	}
+	passwordHash := ""
+	if password != "" {
+		if len(password) < MIN_PASSWORD_LENGTH {
+			return errors.New("Password is too short")
+		}
+		if err := u.setPassword(password); err != nil {
+			return err
+		}
+		passwordHash = u.PasswordHash
+	}
+	var updated User
+	err := storage.Update(s, storage.UserPath(u.Username), func(content []byte) ([]byte, error) {
+		if content == nil {
+			return nil, ErrNoSuchUser
+		}
+		updated = User{}
+		if err := json.Unmarshal(content, &updated); err != nil {
+			return nil, err
+		}
+		if email != "" {
+			updated.Email = email
+		}
+		if passwordHash != "" {
+			updated.PasswordHash = passwordHash
+		}
+		updated.UpdatedAt = time.Now().UTC()
+		return json.Marshal(&updated)
+	})
+	if err != nil {
+		return err
+	}
+	*u = updated
+	return nil
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"encoding/json"
+	"registry/storage"
+	"testing"
+)
+
+func TestUsers(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-auth-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	if _, err := CreateUser(s, "ab", "password", "ab@example.com"); err == nil {
+		t.Fatal("Usernames shorter than 4 characters should be rejected")
+	}
+	if _, err := CreateUser(s, "library", "password", "library@example.com"); err != ErrReservedUsername {
+		t.Fatalf("library should be reserved, got %v", err)
+	}
+	if _, err := CreateUser(s, "someone", "password", "someone@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateUser(s, "someone", "password", "someone@example.com"); err != ErrUserExists {
+		t.Fatalf("Creating a user twice should return ErrUserExists, got %v", err)
+	}
+	if _, err := Authenticate(s, "someone", "wrong"); err != ErrBadCredentials {
+		t.Fatal("Wrong password should not authenticate")
+	}
+	if _, err := Authenticate(s, "nobody", "password"); err != ErrBadCredentials {
+		t.Fatal("Unknown user should not authenticate")
+	}
+	// a user json pushed somewhere else must not be usable to log in
+	planted, _ := GetUser(s, "someone")
+	planted.Username = "admin"
+	content, _ := json.Marshal(planted)
+	s.Put(storage.ImageJsonPath("evil"), content)
+	for _, username := range []string{"../images/evil", "someone/../../images/evil"} {
+		if _, err := Authenticate(s, username, "password"); err != ErrBadCredentials {
+			t.Fatalf("%s should not authenticate, got %v", username, err)
+		}
+		if _, err := GetUser(s, username); err != ErrInvalidUsername {
+			t.Fatalf("%s should be an invalid username, got %v", username, err)
+		}
+	}
+	user, err := Authenticate(s, "someone", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.PasswordHash == "password" {
+		t.Fatal("Password should not be stored in plain text")
+	}
+	if err := user.Update(s, "newpassword", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authenticate(s, "someone", "password"); err == nil {
+		t.Fatal("Old password should not work after a change")
+	}
+	if user, err = Authenticate(s, "someone", "newpassword"); err != nil {
+		t.Fatal(err)
+	} else if user.Email != "someone@example.com" {
+		t.Fatal("Email should be unchanged")
+	}
+	// two updates made from the same copy of the user both stick
+	stale := *user
+	if err := user.Update(s, "otherpassword", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.Update(s, "", "new@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if user, err = Authenticate(s, "someone", "otherpassword"); err != nil {
+		t.Fatal("An update of the email should not undo a password change")
+	} else if user.Email != "new@example.com" {
+		t.Fatalf("Email should have been changed, got %s", user.Email)
+	}
+	s.Remove(storage.UserPath("someone"))
+	if err := stale.Update(s, "", "new@example.com"); err != ErrNoSuchUser {
+		t.Fatalf("Updating a removed user should fail with ErrNoSuchUser, got %v", err)
+	}
+}
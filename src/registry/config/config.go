@@ -3,6 +3,9 @@ package config
 import (
 	"encoding/json"
 	"registry/api"
+	"registry/gc"
+	"registry/reaper"
+	"registry/scrub"
 	"registry/storage"
 	"os"
 )
@@ -10,6 +13,9 @@ import (
 type Config struct {
 	API     *api.Config     `json:"api"`
 	Storage *storage.Config `json:"storage"`
+	GC      *gc.Config      `json:"gc"`
+	Reaper  *reaper.Config  `json:"reaper"`
+	Scrub   *scrub.Config   `json:"scrub"` // re-verify stored layers in the background
 }
 
 func New(filename string) (*Config, error) {
@@ -0,0 +1,339 @@
+package fsck
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"registry/layers"
+	"registry/logger"
+	"registry/reaper"
+	"registry/scrub"
+	"registry/storage"
+	"sort"
+	"time"
+)
+
+type Severity string
+
+const (
+	// pulls fail or return the wrong thing
+	SEVERITY_ERROR Severity = "error"
+	// nothing is broken yet, but something was left behind or will break later
+	SEVERITY_WARNING Severity = "warning"
+)
+
+type Problem struct {
+	Severity Severity `json:"severity"`
+	Path     string   `json:"path"`
+	Message  string   `json:"message"`
+	Repaired bool     `json:"repaired"`
+}
+
+type Report struct {
+	Repair       bool      `json:"repair"`
+	StartedAt    time.Time `json:"started_at"`
+	Duration     string    `json:"duration"`
+	Repositories int       `json:"repositories"`
+	Tags         int       `json:"tags"`
+	Images       int       `json:"images"`
+	Sessions     int       `json:"sessions"`
+	Errors       int       `json:"errors"`   // problems of SEVERITY_ERROR that weren't repaired
+	Warnings     int       `json:"warnings"` // problems of SEVERITY_WARNING that weren't repaired
+	Repaired     int       `json:"repaired"`
+	Problems     []Problem `json:"problems"`
+}
+
+func (r *Report) add(severity Severity, relpath string, repaired bool, format string, args ...interface{}) {
+	problem := Problem{Severity: severity, Path: relpath, Message: fmt.Sprintf(format, args...), Repaired: repaired}
+	logger.Info("[Fsck] %s: %s: %s (repaired=%t)", problem.Severity, problem.Path, problem.Message, repaired)
+	r.Problems = append(r.Problems, problem)
+	switch {
+	case repaired:
+		r.Repaired++
+	case severity == SEVERITY_ERROR:
+		r.Errors++
+	default:
+		r.Warnings++
+	}
+}
+
+// Clean is true if nothing is left broken
+func (r *Report) Clean() bool {
+	return r.Errors == 0 && r.Warnings == 0
+}
+
+type checker struct {
+	s      storage.Storage
+	repair bool
+	report *Report
+	// parent of every image whose json could be read ("" for base images)
+	parents map[string]string
+	// images whose ancestry was checked (and repaired if need be), and whether it is good now
+	ancestryOK map[string]bool
+}
+
+// Check walks the images, repositories and upload sessions in s and reports everything that is inconsistent. With
+// repair set, what can be fixed without guessing is: ancestry files are regenerated from the parents in the image
+// jsons, in progress marks of images that are complete or have no json are removed, and upload sessions without a
+// state are removed. Everything else (a tag pointing to a missing image, an image without its layer) needs the
+// images pushed again.
+func Check(s storage.Storage, repair bool) (*Report, error) {
+	c := &checker{
+		s:          s,
+		repair:     repair,
+		report:     &Report{Repair: repair, StartedAt: time.Now().UTC(), Problems: []Problem{}},
+		parents:    map[string]string{},
+		ancestryOK: map[string]bool{},
+	}
+	ids, err := c.listImages()
+	if err != nil {
+		return nil, err
+	}
+	for _, imageID := range ids {
+		c.checkImage(imageID)
+	}
+	for _, imageID := range ids {
+		if _, ok := c.parents[imageID]; ok {
+			c.checkAncestry(imageID)
+		}
+	}
+	if err := c.checkRepositories(); err != nil {
+		return nil, err
+	}
+	if err := c.checkSessions(); err != nil {
+		return nil, err
+	}
+	report := c.report
+	report.Duration = time.Since(report.StartedAt).String()
+	logger.Info("[Fsck] repair=%t; images=%d; tags=%d; errors=%d; warnings=%d; repaired=%d", repair,
+		report.Images, report.Tags, report.Errors, report.Warnings, report.Repaired)
+	return report, nil
+}
+
+func (c *checker) listImages() ([]string, error) {
+	imagePaths, err := c.s.List("images")
+	if storage.IsNotFound(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(imagePaths))
+	for _, imagePath := range imagePaths {
+		ids = append(ids, path.Base(imagePath))
+	}
+	sort.Strings(ids)
+	c.report.Images = len(ids)
+	return ids, nil
+}
+
+func (c *checker) exists(relpath string) bool {
+	exists, _ := c.s.Exists(relpath)
+	return exists
+}
+
+// removes relpath if repairing. returns whether it was removed.
+func (c *checker) remove(relpath string) bool {
+	if !c.repair {
+		return false
+	}
+	if err := c.s.Remove(relpath); err != nil {
+		logger.Error("[Fsck] error removing %s: %s", relpath, err.Error())
+		return false
+	}
+	return true
+}
+
+func (c *checker) checkImage(imageID string) {
+	jsonPath := storage.ImageJsonPath(imageID)
+	markPath := storage.ImageMarkPath(imageID)
+	marked := c.exists(markPath)
+	content, err := c.s.Get(jsonPath)
+	if storage.IsNotFound(err) {
+		if marked {
+			// the push died before the json was written
+			c.report.add(SEVERITY_WARNING, markPath, c.remove(markPath), "in progress mark of an image without json")
+		} else {
+			c.report.add(SEVERITY_ERROR, jsonPath, false, "image has no json")
+		}
+		return
+	} else if err != nil {
+		c.report.add(SEVERITY_ERROR, jsonPath, false, "error reading json: %s", err.Error())
+		return
+	}
+	var data struct {
+		Parent string `json:"parent"`
+	}
+	if err := json.Unmarshal(content, &data); err != nil {
+		c.report.add(SEVERITY_ERROR, jsonPath, false, "invalid json: %s", err.Error())
+		return
+	}
+	c.parents[imageID] = data.Parent
+	hasLayer := c.exists(storage.ImageLayerPath(imageID))
+	hasChecksum := c.exists(storage.ImageChecksumPath(imageID))
+	switch {
+	case marked && hasLayer && hasChecksum:
+		c.checkCompleteUpload(imageID)
+	case marked:
+		c.checkUpload(imageID)
+	case !hasLayer:
+		c.report.add(SEVERITY_ERROR, storage.ImageLayerPath(imageID), false, "image has no layer")
+	case !hasChecksum:
+		c.report.add(SEVERITY_WARNING, storage.ImageChecksumPath(imageID), false, "image has no checksum")
+	}
+}
+
+// an image whose checksum didn't match is left marked too, so the mark only goes if the layer verifies. one that
+// doesn't is left to the reaper.
+func (c *checker) checkCompleteUpload(imageID string) {
+	markPath := storage.ImageMarkPath(imageID)
+	problem, _, err := scrub.VerifyLayer(c.s, imageID, 0)
+	if err != nil {
+		c.report.add(SEVERITY_WARNING, markPath, false, "in progress mark of a complete image, error verifying it: %s",
+			err.Error())
+	} else if problem != "" {
+		c.report.add(SEVERITY_WARNING, markPath, false, "in progress mark of an image that doesn't verify (%s), see "+
+			"registry reap", problem)
+	} else {
+		c.report.add(SEVERITY_WARNING, markPath, c.remove(markPath), "in progress mark of a complete image")
+	}
+}
+
+// an upload is only reported if it looks abandoned. removing it is left to the reaper.
+func (c *checker) checkUpload(imageID string) {
+	markedAt, ok, err := layers.MarkedAt(c.s, imageID)
+	if err != nil || !ok || time.Since(markedAt) < reaper.DEFAULT_MAX_AGE {
+		return
+	}
+	c.report.add(SEVERITY_WARNING, storage.ImageMarkPath(imageID), false,
+		"upload started at %s looks abandoned, see registry reap", markedAt.Format(time.RFC3339))
+}
+
+// the ancestry of an image must be the image followed by the ancestry of its parent. parents are checked (and
+// repaired) first, so a repaired ancestry is built on a good one. returns whether the ancestry is good now.
+func (c *checker) checkAncestry(imageID string) bool {
+	if ok, checked := c.ancestryOK[imageID]; checked {
+		return ok
+	}
+	// stops cycles in the parents
+	c.ancestryOK[imageID] = false
+	parentID := c.parents[imageID]
+	// what the ancestry should be. only the image and its parent are known if the parent's ancestry is broken.
+	expected := []string{imageID}
+	parentOK := true
+	if parentID != "" {
+		if _, ok := c.parents[parentID]; !ok {
+			c.report.add(SEVERITY_ERROR, storage.ImageJsonPath(imageID), false, "parent %s is missing", parentID)
+			return false
+		}
+		parentOK = c.checkAncestry(parentID)
+		if parentOK {
+			parentAncestry, _ := layers.GetAncestry(c.s, parentID)
+			expected = append(expected, parentAncestry...)
+		} else {
+			expected = append(expected, parentID)
+		}
+	}
+	ancestryPath := storage.ImageAncestryPath(imageID)
+	ancestry, err := layers.GetAncestry(c.s, imageID)
+	problem := ""
+	switch {
+	case storage.IsNotFound(err):
+		problem = "image has no ancestry"
+	case err != nil:
+		problem = "error reading ancestry: " + err.Error()
+	case parentOK && !equal(ancestry, expected):
+		problem = fmt.Sprintf("ancestry %v doesn't match the parents of the image %v", ancestry, expected)
+		for _, id := range ancestry {
+			if _, ok := c.parents[id]; !ok {
+				problem = fmt.Sprintf("ancestry references missing image %s", id)
+				break
+			}
+		}
+	case !parentOK && (len(ancestry) < len(expected) || !equal(ancestry[:len(expected)], expected)):
+		problem = fmt.Sprintf("ancestry %v doesn't start with the image and its parent", ancestry)
+	}
+	if problem == "" {
+		c.ancestryOK[imageID] = parentOK
+		return parentOK
+	}
+	repaired := false
+	if c.repair && parentOK {
+		if err := layers.GenerateAncestry(c.s, imageID, parentID); err != nil {
+			logger.Error("[Fsck] error generating ancestry of %s: %s", imageID, err.Error())
+		} else {
+			repaired = true
+		}
+	}
+	c.report.add(SEVERITY_ERROR, ancestryPath, repaired, "%s", problem)
+	c.ancestryOK[imageID] = repaired
+	return repaired
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *checker) checkRepositories() error {
+	repos, err := layers.ListRepositories(c.s)
+	if err != nil {
+		return err
+	}
+	c.report.Repositories = len(repos)
+	for _, repo := range repos {
+		tags, err := layers.ListTags(c.s, repo.Namespace, repo.Name)
+		if err != nil {
+			// repositories that were created but never tagged
+			continue
+		}
+		names := make([]string, 0, len(tags))
+		for tag, _ := range tags {
+			names = append(names, tag)
+		}
+		sort.Strings(names)
+		for _, tag := range names {
+			c.report.Tags++
+			imageID := tags[tag]
+			tagPath := storage.RepoTagPath(repo.Namespace, repo.Name, tag)
+			if _, ok := c.parents[imageID]; !ok {
+				c.report.add(SEVERITY_ERROR, tagPath, false, "tag points to missing image %s", imageID)
+			} else if !c.ancestryOK[imageID] {
+				c.report.add(SEVERITY_ERROR, tagPath, false, "tag points to image %s with a broken ancestry", imageID)
+			}
+		}
+	}
+	return nil
+}
+
+// upload sessions whose state is gone can't be resumed, and are only taking up space
+func (c *checker) checkSessions() error {
+	sessions, err := c.s.List("uploads")
+	if storage.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	c.report.Sessions = len(sessions)
+	for _, session := range sessions {
+		uuid := path.Base(session)
+		upload, err := layers.GetUpload(c.s, uuid)
+		if storage.IsNotFound(err) || (err == nil && upload.UUID != uuid) {
+			repaired := c.repair && c.s.RemoveAll(storage.UploadPath(uuid)) == nil
+			c.report.add(SEVERITY_WARNING, storage.UploadPath(uuid), repaired, "upload session has no state")
+		} else if err != nil {
+			c.report.add(SEVERITY_WARNING, storage.UploadStatePath(uuid), false, "error reading upload state: %s",
+				err.Error())
+		} else if time.Since(upload.LastActive()) > reaper.DEFAULT_MAX_AGE {
+			c.report.add(SEVERITY_WARNING, storage.UploadPath(uuid), false,
+				"upload session last active at %s looks abandoned", upload.LastActive().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
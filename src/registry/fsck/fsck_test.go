@@ -0,0 +1,106 @@
+package fsck
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"registry/storage"
+	"testing"
+)
+
+func putImage(t *testing.T, s storage.Storage, id, parent, ancestry string) {
+	json := `{"id":"` + id + `"}`
+	if parent != "" {
+		json = `{"id":"` + id + `","parent":"` + parent + `"}`
+	}
+	if err := s.Put(storage.ImageJsonPath(id), []byte(json)); err != nil {
+		t.Fatal(err)
+	}
+	if ancestry != "" {
+		s.Put(storage.ImageAncestryPath(id), []byte(ancestry))
+	}
+	s.Put(storage.ImageLayerPath(id), []byte("layer"))
+	sum := sha256.Sum256([]byte(json + "layer"))
+	s.Put(storage.ImageChecksumPath(id), []byte("sha256:"+hex.EncodeToString(sum[:])))
+}
+
+func problems(report *Report) map[string]Problem {
+	byPath := map[string]Problem{}
+	for _, problem := range report.Problems {
+		byPath[problem.Path] = problem
+	}
+	return byPath
+}
+
+func TestCheck(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-fsck-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	putImage(t, s, "base", "", `["base"]`)
+	putImage(t, s, "child", "base", `["child","gone"]`)
+	putImage(t, s, "grandchild", "child", "")
+	putImage(t, s, "nolayer", "", `["nolayer"]`)
+	s.Remove(storage.ImageLayerPath("nolayer"))
+	s.Put(storage.ImageMarkPath("base"), []byte("true"))
+	// what a checksum mismatch leaves behind
+	putImage(t, s, "corrupt", "", `["corrupt"]`)
+	s.Put(storage.ImageChecksumPath("corrupt"), []byte("sha256:abc"))
+	s.Put(storage.ImageMarkPath("corrupt"), []byte("true"))
+	s.Put(storage.ImageMarkPath("nojson"), []byte("true"))
+	s.Put(storage.RepoTagPath("library", "app", "latest"), []byte("grandchild"))
+	s.Put(storage.RepoTagPath("library", "app", "broken"), []byte("missing"))
+	s.Put(storage.UploadChunkPath("lost", 0, "chunk"), []byte("chunk"))
+
+	report, err := Check(s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := problems(report)
+	for relpath, severity := range map[string]Severity{
+		storage.ImageAncestryPath("child"):              SEVERITY_ERROR,
+		storage.ImageAncestryPath("grandchild"):         SEVERITY_ERROR,
+		storage.ImageLayerPath("nolayer"):               SEVERITY_ERROR,
+		storage.ImageMarkPath("base"):                   SEVERITY_WARNING,
+		storage.ImageMarkPath("corrupt"):                SEVERITY_WARNING,
+		storage.ImageMarkPath("nojson"):                 SEVERITY_WARNING,
+		storage.RepoTagPath("library", "app", "broken"): SEVERITY_ERROR,
+		storage.RepoTagPath("library", "app", "latest"): SEVERITY_ERROR,
+		storage.UploadPath("lost"):                      SEVERITY_WARNING,
+	} {
+		if problem, ok := found[relpath]; !ok || problem.Severity != severity || problem.Repaired {
+			t.Errorf("Expected an unrepaired %s for %s, got %+v", severity, relpath, problem)
+		}
+	}
+	if len(report.Problems) != 9 {
+		t.Errorf("Expected 9 problems, got %+v", report.Problems)
+	}
+	if exists, _ := s.Exists(storage.ImageMarkPath("nojson")); !exists {
+		t.Fatal("Nothing should be changed without repair")
+	}
+
+	if report, err = Check(s, true); err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired != 5 {
+		t.Errorf("Expected 5 repairs, got %+v", report.Problems)
+	}
+	if content, _ := s.Get(storage.ImageAncestryPath("grandchild")); string(content) != `["grandchild","child","base"]` {
+		t.Errorf("The ancestry of grandchild should have been regenerated, got %s", content)
+	}
+	for _, relpath := range []string{storage.ImageMarkPath("base"), storage.ImageDir("nojson"), storage.UploadPath("lost")} {
+		if exists, _ := s.Exists(relpath); exists {
+			t.Errorf("%s should have been removed", relpath)
+		}
+	}
+
+	// only what needs the images pushed again is left
+	if report, err = Check(s, false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Errors != 2 || report.Warnings != 1 || report.Clean() {
+		t.Errorf("Expected the missing layer, the broken tag and the corrupt upload to be left, got %+v", report.Problems)
+	}
+}
@@ -0,0 +1,223 @@
+package gc
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"registry/layers"
+	"registry/logger"
+	"registry/storage"
+	"sort"
+	"time"
+)
+
+// An image that becomes unreachable is only removed once it has been unreachable for GracePeriod, as seen by
+// collections at least that far apart, so the images of a push that isn't tagged yet survive. When each image was
+// first found unreachable is kept at storage.GCCandidatesPath().
+
+const DEFAULT_GRACE_PERIOD = time.Hour
+
+type Config struct {
+	Interval    string `json:"interval"`     // how often to collect in the background (e.g. "24h"). empty disables it.
+	DryRun      bool   `json:"dry_run"`      // only report what would be removed
+	GracePeriod string `json:"grace_period"` // how long an image has to stay unreachable to be removed (default "1h")
+}
+
+func (c *Config) ParseGracePeriod() (time.Duration, error) {
+	if c.GracePeriod == "" {
+		return DEFAULT_GRACE_PERIOD, nil
+	}
+	return time.ParseDuration(c.GracePeriod)
+}
+
+type Report struct {
+	DryRun       bool      `json:"dry_run"`
+	StartedAt    time.Time `json:"started_at"`
+	Duration     string    `json:"duration"`
+	Repositories int       `json:"repositories"`
+	Tags         int       `json:"tags"`
+	Images       int       `json:"images"`
+	Reachable    int       `json:"reachable"`
+	Pending      []string  `json:"pending"` // unreachable, but not for the grace period yet
+	Removed      []string  `json:"removed"`
+	Aborted      bool      `json:"aborted"` // nothing was removed because marking failed
+	Errors       []string  `json:"errors"`
+}
+
+func (r *Report) addError(format string, args ...interface{}) {
+	logger.Error("[GC] "+format, args...)
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Mark returns the set of image ids that must be kept:
+//   - every image a tag points to, and everything in its ancestry
+//   - every image in the _index_images of a repository that has no tags yet, because that is what a push in
+//     progress looks like (images are uploaded before the tags that reference them)
+//
+// Anything that can't be read is added to the report's errors, since what it references is unknown.
+func Mark(s storage.Storage, report *Report) (map[string]bool, error) {
+	live := map[string]bool{}
+	repos, err := layers.ListRepositories(s)
+	if err != nil {
+		return nil, err
+	}
+	report.Repositories = len(repos)
+	for _, repo := range repos {
+		tags, err := layers.ListTags(s, repo.Namespace, repo.Name)
+		if err != nil && !storage.IsNotFound(err) {
+			report.addError("%s: error listing tags: %s", repo, err.Error())
+			continue
+		}
+		if len(tags) == 0 {
+			// no tags, protect anything a push may be in the middle of uploading
+			ids, err := layers.GetIndexImageIDs(s, repo.Namespace, repo.Name)
+			if err != nil && !storage.IsNotFound(err) {
+				report.addError("%s: error reading _index_images: %s", repo, err.Error())
+			}
+			for _, id := range ids {
+				live[id] = true
+			}
+			continue
+		}
+		for tag, imageID := range tags {
+			report.Tags++
+			if live[imageID] {
+				continue
+			}
+			live[imageID] = true
+			ancestry, err := layers.GetAncestry(s, imageID)
+			if err != nil {
+				report.addError("%s:%s -> %s: error reading ancestry: %s", repo, tag, imageID, err.Error())
+				continue
+			}
+			for _, id := range ancestry {
+				live[id] = true
+			}
+		}
+	}
+	return live, nil
+}
+
+func loadCandidates(s storage.Storage) (map[string]time.Time, error) {
+	candidates := map[string]time.Time{}
+	content, err := s.Get(storage.GCCandidatesPath())
+	if storage.IsNotFound(err) {
+		return candidates, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return candidates, json.Unmarshal(content, &candidates)
+}
+
+// Collect runs a full mark and sweep. Images that have been unreachable for gracePeriod are removed unless dryRun
+// is set, in which case the report just lists what would have been removed. Images that are still being uploaded
+// (have an _inprogress mark) are never removed, and if marking runs into any error nothing is. Marking takes a while,
+// so the images to remove are marked again right before removing them, which keeps those tagged in the meantime.
+func Collect(s storage.Storage, dryRun bool, gracePeriod time.Duration) (*Report, error) {
+	report := &Report{
+		DryRun:    dryRun,
+		StartedAt: time.Now().UTC(),
+		Pending:   []string{},
+		Removed:   []string{},
+		Errors:    []string{},
+	}
+	live, err := Mark(s, report)
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Errors) > 0 {
+		report.Aborted = true
+		report.Duration = time.Since(report.StartedAt).String()
+		logger.Error("[GC] Not sweeping, marking ran into %d errors", len(report.Errors))
+		return report, nil
+	}
+	candidates, err := loadCandidates(s)
+	if err != nil {
+		return nil, err
+	}
+	imagePaths, err := s.List("images")
+	if storage.IsNotFound(err) {
+		// no images at all
+		imagePaths = []string{}
+	} else if err != nil {
+		return nil, err
+	}
+	report.Images = len(imagePaths)
+	unreachable := map[string]time.Time{}
+	expired := []string{}
+	for _, imagePath := range imagePaths {
+		imageID := path.Base(imagePath)
+		if live[imageID] {
+			report.Reachable++
+			continue
+		}
+		if exists, err := s.Exists(storage.ImageMarkPath(imageID)); err != nil || exists {
+			// still being uploaded (or can't tell)
+			report.Reachable++
+			continue
+		}
+		since, ok := candidates[imageID]
+		if !ok {
+			since = report.StartedAt
+		}
+		unreachable[imageID] = since
+		if report.StartedAt.Sub(since) < gracePeriod {
+			report.Pending = append(report.Pending, imageID)
+			continue
+		}
+		expired = append(expired, imageID)
+	}
+	if !dryRun && len(expired) > 0 {
+		recheck := &Report{Errors: []string{}}
+		if live, err = Mark(s, recheck); err != nil {
+			return nil, err
+		}
+		if len(recheck.Errors) > 0 {
+			// it isn't known what was tagged since, so keep everything for now
+			report.Errors = append(report.Errors, recheck.Errors...)
+			report.Pending = append(report.Pending, expired...)
+			expired = nil
+		}
+	}
+	for _, imageID := range expired {
+		if !dryRun {
+			if live[imageID] {
+				// tagged since it was marked
+				delete(unreachable, imageID)
+				report.Reachable++
+				continue
+			}
+			if err := s.RemoveAll(storage.ImageDir(imageID)); err != nil {
+				report.addError("%s: error removing: %s", imageID, err.Error())
+				continue
+			}
+		}
+		delete(unreachable, imageID)
+		report.Removed = append(report.Removed, imageID)
+	}
+	if !dryRun {
+		content, err := json.Marshal(&unreachable)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.Put(storage.GCCandidatesPath(), content); err != nil {
+			report.addError("error saving the unreachable images: %s", err.Error())
+		}
+	}
+	sort.Strings(report.Pending)
+	sort.Strings(report.Removed)
+	report.Duration = time.Since(report.StartedAt).String()
+	logger.Info("[GC] dry_run=%t; images=%d; reachable=%d; pending=%d; removed=%d; errors=%d", dryRun,
+		report.Images, report.Reachable, len(report.Pending), len(report.Removed), len(report.Errors))
+	return report, nil
+}
+
+// Run Collect every interval, forever. Meant to be started in its own goroutine.
+func Schedule(s storage.Storage, interval time.Duration, dryRun bool, gracePeriod time.Duration) {
+	for {
+		time.Sleep(interval)
+		if _, err := Collect(s, dryRun, gracePeriod); err != nil {
+			logger.Error("[GC] error collecting: %s", err.Error())
+		}
+	}
+}
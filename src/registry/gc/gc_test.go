@@ -0,0 +1,133 @@
+package gc
+
+import (
+	"registry/storage"
+	"testing"
+	"time"
+)
+
+func putImage(t *testing.T, s storage.Storage, id, ancestry string) {
+	if err := s.Put(storage.ImageJsonPath(id), []byte(`{"id":"`+id+`"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(storage.ImageAncestryPath(id), []byte(ancestry)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-gc-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	putImage(t, s, "base", `["base"]`)
+	putImage(t, s, "child", `["child","base"]`)
+	putImage(t, s, "orphan", `["orphan","base"]`)
+	putImage(t, s, "uploading", `["uploading"]`)
+	putImage(t, s, "pushing", `["pushing"]`)
+	s.Put(storage.ImageMarkPath("uploading"), []byte("true"))
+	s.Put(storage.RepoTagPath("library", "tagged", "latest"), []byte("child"))
+	s.Put(storage.RepoIndexImagesPath("library", "untagged"), []byte(`[{"id":"pushing"}]`))
+
+	report, err := Collect(s, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0] != "orphan" {
+		t.Fatalf("Only orphan should be removable, got %+v", report.Removed)
+	}
+	if exists, _ := s.Exists(storage.ImageJsonPath("orphan")); !exists {
+		t.Fatal("Dry run should not remove anything")
+	}
+
+	if report, err = Collect(s, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0] != "orphan" {
+		t.Fatalf("Only orphan should be removed, got %+v", report.Removed)
+	}
+	if exists, _ := s.Exists(storage.ImageJsonPath("orphan")); exists {
+		t.Fatal("orphan should have been removed")
+	}
+	for _, id := range []string{"base", "child", "uploading", "pushing"} {
+		if exists, _ := s.Exists(storage.ImageJsonPath(id)); !exists {
+			t.Fatalf("%s should not have been removed", id)
+		}
+	}
+}
+
+func TestCollectGracePeriod(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-gc-grace-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	putImage(t, s, "orphan", `["orphan"]`)
+	report, err := Collect(s, false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 0 || len(report.Pending) != 1 {
+		t.Fatalf("orphan should only be pending the first time it is seen, got %+v", report)
+	}
+	// pretend the first collection was a while ago
+	s.Put(storage.GCCandidatesPath(), []byte(`{"orphan":"`+time.Now().Add(-2*time.Hour).UTC().Format(time.RFC3339)+`"}`))
+	if report, err = Collect(s, false, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0] != "orphan" {
+		t.Fatalf("orphan should be removed after the grace period, got %+v", report)
+	}
+
+	// a tag whose ancestry can't be read could be holding on to anything
+	putImage(t, s, "orphan", `["orphan"]`)
+	s.Put(storage.GCCandidatesPath(), []byte(`{"orphan":"2000-01-01T00:00:00Z"}`))
+	s.Put(storage.RepoTagPath("library", "broken", "latest"), []byte("missing"))
+	if report, err = Collect(s, false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Aborted || len(report.Removed) != 0 {
+		t.Fatalf("Nothing should be removed when marking fails, got %+v", report)
+	}
+}
+
+// tags an image once the images are listed, which is after marking
+type tagOnList struct {
+	storage.Storage
+	tagged bool
+}
+
+func (s *tagOnList) List(relpath string) ([]string, error) {
+	if relpath == "images" && !s.tagged {
+		s.tagged = true
+		s.Put(storage.RepoTagPath("library", "late", "latest"), []byte("orphan"))
+	}
+	return s.Storage.List(relpath)
+}
+
+func TestCollectTaggedWhileSweeping(t *testing.T) {
+	local, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-gc-late-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.RemoveAll("/")
+	defer local.RemoveAll("/")
+	s := &tagOnList{Storage: local}
+
+	putImage(t, s, "orphan", `["orphan"]`)
+	report, err := Collect(s, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 0 {
+		t.Fatalf("An image tagged after marking should not be removed, got %+v", report)
+	}
+	if exists, _ := s.Exists(storage.ImageJsonPath("orphan")); !exists {
+		t.Fatal("orphan should not have been removed")
+	}
+}
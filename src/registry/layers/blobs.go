@@ -0,0 +1,32 @@
+package layers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"registry/storage"
+)
+
+const DIGEST_SHA256_PREFIX = "sha256:"
+
+type DigestError string
+
+func (e DigestError) Error() string {
+	return string(e)
+}
+
+func noopAfterWrite(io.ReadSeeker) {}
+
+// Compute the sha256 digest ("sha256:<hex>") of the content stored at relpath
+func ComputeDigest(s storage.Storage, relpath string) (string, error) {
+	reader, err := s.GetReader(relpath)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	sha256Writer := sha256.New()
+	if _, err := io.Copy(sha256Writer, reader); err != nil {
+		return "", err
+	}
+	return DIGEST_SHA256_PREFIX + hex.EncodeToString(sha256Writer.Sum(nil)), nil
+}
@@ -0,0 +1,106 @@
+package layers
+
+import (
+	"errors"
+	"registry/storage"
+	"time"
+)
+
+// An image is marked as in progress (images/{id}/_inprogress) from when its json is pushed until its checksum is.
+// The mark holds when the upload started (or last made progress) so abandoned ones can be found. Marks written by
+// older versions just hold "true" and have no start time. An upload that is being aborted has MARK_ABORTED in its
+// mark, so it can't be completed anymore, and one that is being completed has MARK_COMPLETING, so it can't be
+// aborted anymore.
+
+const (
+	MARK_ABORTED    = "aborted"
+	MARK_COMPLETING = "completing"
+)
+
+var ErrUploadAborted = errors.New("Upload was aborted")
+
+func MarkInProgress(s storage.Storage, imageID string) error {
+	return s.Put(storage.ImageMarkPath(imageID), []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+// MarkedAt returns when the upload of imageID started. ok is false if the mark doesn't say.
+func MarkedAt(s storage.Storage, imageID string) (markedAt time.Time, ok bool, err error) {
+	markedAt, ok, _, err = GetMark(s, imageID)
+	return markedAt, ok, err
+}
+
+// GetMark is MarkedAt that also returns the version of the mark, which AbortMark needs. An upload being completed
+// is a conflict.
+func GetMark(s storage.Storage, imageID string) (markedAt time.Time, ok bool, version string, err error) {
+	content, version, err := s.GetVersion(storage.ImageMarkPath(imageID))
+	if err != nil {
+		return time.Time{}, false, "", err
+	} else if string(content) == MARK_COMPLETING {
+		return time.Time{}, false, "", &storage.Error{Kind: storage.ErrConflict, Path: storage.ImageMarkPath(imageID)}
+	}
+	markedAt, err = time.Parse(time.RFC3339, string(content))
+	return markedAt, err == nil, version, nil
+}
+
+// RefreshMark gives the mark the current time, for uploads that are still making progress. Fails with
+// ErrUploadAborted if the upload was aborted, and not found if it was completed.
+func RefreshMark(s storage.Storage, imageID string) error {
+	return storage.Update(s, storage.ImageMarkPath(imageID), func(content []byte) ([]byte, error) {
+		if content == nil {
+			return nil, &storage.Error{Kind: storage.ErrNotFound, Path: storage.ImageMarkPath(imageID)}
+		} else if string(content) == MARK_ABORTED {
+			return nil, ErrUploadAborted
+		}
+		return []byte(time.Now().UTC().Format(time.RFC3339)), nil
+	})
+}
+
+// AbortMark marks the upload of imageID as aborted, unless the mark was written since version was read: a conflict
+// then means the upload was completed or made progress in the meantime.
+func AbortMark(s storage.Storage, imageID, version string) error {
+	return s.PutIfVersion(storage.ImageMarkPath(imageID), []byte(MARK_ABORTED), version)
+}
+
+// ClearMark completes the upload of imageID. Fails with ErrUploadAborted if it was aborted, or if the mark changed
+// while it was being claimed, since it may have been aborted.
+func ClearMark(s storage.Storage, imageID string) error {
+	markPath := storage.ImageMarkPath(imageID)
+	content, version, err := s.GetVersion(markPath)
+	if err != nil {
+		return err
+	} else if string(content) == MARK_ABORTED {
+		return ErrUploadAborted
+	}
+	// claimed first, so it can't be aborted between here and its removal
+	if err := s.PutIfVersion(markPath, []byte(MARK_COMPLETING), version); storage.IsConflict(err) {
+		return ErrUploadAborted
+	} else if err != nil {
+		return err
+	}
+	return s.Remove(markPath)
+}
+
+// StampMark gives a mark without a start time the current time, so its age can be told from now on. Returns when
+// the upload started (or was first seen). Aborted marks are left as they are and returned as the zero time, since
+// what is left of their upload should go. Marks of uploads being completed are a conflict.
+func StampMark(s storage.Storage, imageID string) (time.Time, error) {
+	markedAt := time.Now().UTC()
+	err := storage.Update(s, storage.ImageMarkPath(imageID), func(content []byte) ([]byte, error) {
+		if content == nil {
+			// the upload finished meanwhile
+			return nil, &storage.Error{Kind: storage.ErrNotFound, Path: storage.ImageMarkPath(imageID)}
+		}
+		if string(content) == MARK_ABORTED {
+			markedAt = time.Time{}
+			return nil, nil
+		} else if string(content) == MARK_COMPLETING {
+			return nil, &storage.Error{Kind: storage.ErrConflict, Path: storage.ImageMarkPath(imageID)}
+		}
+		if stamped, err := time.Parse(time.RFC3339, string(content)); err == nil {
+			markedAt = stamped
+			return nil, nil
+		}
+		return []byte(markedAt.Format(time.RFC3339)), nil
+	})
+	return markedAt, err
+}
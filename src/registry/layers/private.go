@@ -0,0 +1,313 @@
+package layers
+
+import (
+	"encoding/json"
+	"registry/auth"
+	"registry/storage"
+	"sort"
+	"time"
+)
+
+// A repository is private if it has a _private file (storage.RepoPrivatePath). Only the user named after the
+// namespace and the listed readers can see it.
+type PrivateRepo struct {
+	Readers   []string  `json:"readers"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Returns nil, nil if the repository is public
+func GetPrivateRepo(s storage.Storage, namespace, repo string) (*PrivateRepo, error) {
+	content, err := s.Get(storage.RepoPrivatePath(namespace, repo))
+	if storage.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	private := &PrivateRepo{Readers: []string{}}
+	if len(content) == 0 {
+		// docker-registry just touches the file
+		return private, nil
+	}
+	if err := json.Unmarshal(content, private); err != nil {
+		return nil, err
+	}
+	return private, nil
+}
+
+func (p *PrivateRepo) CanRead(namespace, username string) bool {
+	if username == "" {
+		return false
+	}
+	if username == namespace && !reservedNamespace(namespace) {
+		return true
+	}
+	for _, reader := range p.Readers {
+		if reader == username {
+			return true
+		}
+	}
+	return false
+}
+
+// nobody owns the reserved namespaces, even if a user by that name was created before they were reserved
+func reservedNamespace(namespace string) bool {
+	for _, reserved := range auth.RESERVED_USERNAMES {
+		if namespace == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// CanRead returns true if the repository is public or username may read it. Errors reading the private file
+// count as private, so a storage hiccup doesn't expose anything.
+func CanRead(s storage.Storage, namespace, repo, username string) bool {
+	ok, _ := CheckRead(s, namespace, repo, username)
+	return ok
+}
+
+// Like CanRead, but returns the error reading the private file so it can be told apart from a refusal
+func CheckRead(s storage.Storage, namespace, repo, username string) (bool, error) {
+	private, err := GetPrivateRepo(s, namespace, repo)
+	if err != nil {
+		return false, err
+	}
+	return private == nil || private.CanRead(namespace, username), nil
+}
+
+func SetPrivate(s storage.Storage, namespace, repo string, readers []string) error {
+	if readers == nil {
+		readers = []string{}
+	}
+	content, err := json.Marshal(&PrivateRepo{Readers: readers, UpdatedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := s.Put(storage.RepoPrivatePath(namespace, repo), content); err != nil {
+		return err
+	}
+	return updatePrivateIndex(s, namespace, repo, true)
+}
+
+func SetPublic(s storage.Storage, namespace, repo string) error {
+	if err := s.Remove(storage.RepoPrivatePath(namespace, repo)); err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+	return updatePrivateIndex(s, namespace, repo, false)
+}
+
+// The private index is a json list of the private repositories ("namespace/repo") kept at
+// storage.PrivateIndexPath(), so image reads don't have to look at every repository to find out whether the image
+// belongs to a private one. It is rebuilt if it doesn't exist yet.
+func ListPrivateRepositories(s storage.Storage) ([]Repository, error) {
+	content, err := s.Get(storage.PrivateIndexPath())
+	if storage.IsNotFound(err) {
+		return RebuildPrivateIndex(s)
+	} else if err != nil {
+		return nil, err
+	}
+	var repos []Repository
+	if err := json.Unmarshal(content, &repos); err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+func RebuildPrivateIndex(s storage.Storage) ([]Repository, error) {
+	private, err := buildPrivateIndex(s)
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(&private)
+	if err != nil {
+		return nil, err
+	}
+	return private, s.Put(storage.PrivateIndexPath(), content)
+}
+
+func buildPrivateIndex(s storage.Storage) ([]Repository, error) {
+	repos, err := ListRepositories(s)
+	if err != nil {
+		return nil, err
+	}
+	private := []Repository{}
+	for _, repo := range repos {
+		if exists, err := s.Exists(storage.RepoPrivatePath(repo.Namespace, repo.Name)); err != nil {
+			return nil, err
+		} else if exists {
+			private = append(private, repo)
+		}
+	}
+	return private, nil
+}
+
+// adds or removes the repository from the private index (built if it doesn't exist yet). retried if the index is
+// updated concurrently, by a change to another repository.
+func updatePrivateIndex(s storage.Storage, namespace, repo string, private bool) error {
+	return storage.Update(s, storage.PrivateIndexPath(), func(content []byte) ([]byte, error) {
+		var repos []Repository
+		if content == nil {
+			var err error
+			if repos, err = buildPrivateIndex(s); err != nil {
+				return nil, err
+			}
+		} else if err := json.Unmarshal(content, &repos); err != nil {
+			return nil, err
+		}
+		updated := []Repository{}
+		found := false
+		for _, other := range repos {
+			if other.Namespace == namespace && other.Name == repo {
+				found = true
+				if !private {
+					continue
+				}
+			}
+			updated = append(updated, other)
+		}
+		if found == private && content != nil {
+			// nothing changed, don't bother writing
+			return nil, nil
+		}
+		if private && !found {
+			updated = append(updated, Repository{Namespace: namespace, Name: repo})
+		}
+		sort.Sort(repositories(updated))
+		return json.Marshal(&updated)
+	})
+}
+
+// CanReadImage returns true if username may read imageID. Images are global, so an image is only hidden if a
+// repository that references it is private and unreadable by username, and then only a tag of a repository
+// username can read makes it readable again (anyone can list any image in the _index_images of their own
+// repository, but tagging an image takes being able to read it). Images no repository references (yet) are not
+// hidden. Only the repositories the image index lists for the image are looked at.
+func CanReadImage(s storage.Storage, imageID, username string) bool {
+	repos, err := imageRepositories(s, imageID)
+	if err != nil {
+		return false
+	}
+	hidden := false
+	readable := []Repository{}
+	for _, repo := range repos {
+		if ok, err := CheckRead(s, repo.Namespace, repo.Name, username); err != nil {
+			return false
+		} else if ok {
+			readable = append(readable, repo)
+			continue
+		}
+		if hidden {
+			continue
+		}
+		// if what the repository references can't be read, it might be this
+		images, err := RepositoryImages(s, repo.Namespace, repo.Name)
+		hidden = err != nil || images[imageID]
+	}
+	if !hidden {
+		return true
+	}
+	// an unreadable private repository has it, but a readable one might have it tagged too
+	for _, repo := range readable {
+		if tagged, err := TaggedImages(s, repo.Namespace, repo.Name); err == nil && tagged[imageID] {
+			return true
+		}
+	}
+	return false
+}
+
+// The image index keeps a json list of the repositories that may reference each image at
+// storage.ImageRepositoriesPath(): the ones that tagged it (or an image based on it) or listed it in _index_images.
+// Repositories are only ever added, so CanReadImage checks the repositories themselves, but only those. It is built
+// from every repository the first time it is needed.
+
+// AddImageRepository adds namespace/repo to the repositories that may reference each of imageIDs
+func AddImageRepository(s storage.Storage, namespace, repo string, imageIDs []string) error {
+	for _, imageID := range imageIDs {
+		err := storage.Update(s, storage.ImageRepositoriesPath(imageID), func(content []byte) ([]byte, error) {
+			var repos []Repository
+			if content != nil {
+				if err := json.Unmarshal(content, &repos); err != nil {
+					return nil, err
+				}
+			}
+			for _, other := range repos {
+				if other.Namespace == namespace && other.Name == repo {
+					return nil, nil
+				}
+			}
+			repos = append(repos, Repository{Namespace: namespace, Name: repo})
+			sort.Sort(repositories(repos))
+			return json.Marshal(&repos)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddTaggedImage adds namespace/repo to the repositories that may reference imageID and its ancestry, for a tag
+// about to point at it
+func AddTaggedImage(s storage.Storage, namespace, repo, imageID string) error {
+	ancestry, err := GetAncestry(s, imageID)
+	if storage.IsNotFound(err) {
+		ancestry = []string{imageID}
+	} else if err != nil {
+		return err
+	}
+	return AddImageRepository(s, namespace, repo, ancestry)
+}
+
+func imageRepositories(s storage.Storage, imageID string) ([]Repository, error) {
+	if err := buildImageIndex(s); err != nil {
+		return nil, err
+	}
+	content, err := s.Get(storage.ImageRepositoriesPath(imageID))
+	if storage.IsNotFound(err) {
+		return []Repository{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var repos []Repository
+	if err := json.Unmarshal(content, &repos); err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
+
+// adds what every repository references to the image index, unless that was done already. tags written meanwhile
+// add themselves, so doing this more than once at the same time is only wasted work.
+func buildImageIndex(s storage.Storage) error {
+	if exists, err := s.Exists(storage.ImageRepositoriesBuiltPath()); err != nil || exists {
+		return err
+	}
+	repos, err := ListRepositories(s)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		tags, err := ListTags(s, repo.Namespace, repo.Name)
+		if err != nil && !storage.IsNotFound(err) {
+			return err
+		}
+		for _, imageID := range tags {
+			if err := AddTaggedImage(s, repo.Namespace, repo.Name, imageID); err != nil {
+				return err
+			}
+		}
+		imageIDs, err := GetIndexImageIDs(s, repo.Namespace, repo.Name)
+		if err != nil && !storage.IsNotFound(err) {
+			return err
+		}
+		if err := AddImageRepository(s, repo.Namespace, repo.Name, imageIDs); err != nil {
+			return err
+		}
+	}
+	return s.Put(storage.ImageRepositoriesBuiltPath(), []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+type repositories []Repository
+
+func (r repositories) Len() int           { return len(r) }
+func (r repositories) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r repositories) Less(i, j int) bool { return r[i].String() < r[j].String() }
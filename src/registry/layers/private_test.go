@@ -0,0 +1,101 @@
+package layers
+
+import (
+	"fmt"
+	"registry/storage"
+	"sync"
+	"testing"
+)
+
+func TestCanReadImage(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-private-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	// secret/app is private and has an image of its own on top of a base image that library/base also has
+	s.Put(storage.RepoTagPath("library", "base", "latest"), []byte("base"))
+	s.Put(storage.ImageAncestryPath("base"), []byte(`["base"]`))
+	s.Put(storage.RepoTagPath("secret", "app", "latest"), []byte("app"))
+	s.Put(storage.ImageAncestryPath("app"), []byte(`["app","base"]`))
+	if err := SetPrivate(s, "secret", "app", []string{"friend"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if CanRead(s, "secret", "app", "") || CanRead(s, "secret", "app", "stranger") {
+		t.Fatal("Private repository should not be readable by others")
+	}
+	if !CanRead(s, "secret", "app", "secret") || !CanRead(s, "secret", "app", "friend") {
+		t.Fatal("Private repository should be readable by its owner and readers")
+	}
+	if CanReadImage(s, "app", "stranger") {
+		t.Fatal("Image only referenced by a private repository should be hidden")
+	}
+	if !CanReadImage(s, "app", "friend") {
+		t.Fatal("Image should be readable by readers of the private repository")
+	}
+	// tags written once the image index is built are added to it
+	s.Put(storage.ImageAncestryPath("other"), []byte(`["other","base"]`))
+	if err := AddTaggedImage(s, "secret", "other", "other"); err != nil {
+		t.Fatal(err)
+	}
+	s.Put(storage.RepoTagPath("secret", "other", "latest"), []byte("other"))
+	SetPrivate(s, "secret", "other", nil)
+	if CanReadImage(s, "other", "stranger") {
+		t.Fatal("Image tagged after the image index was built should be hidden")
+	}
+	SetPublic(s, "secret", "other")
+	if !CanReadImage(s, "base", "stranger") {
+		t.Fatal("Image also referenced by a public repository should be readable")
+	}
+	// anyone can list any image in the _index_images of their own repository
+	if err := UpdateIndexImages(s, "stranger", "copy", []byte(`[{"id":"app"}]`), []map[string]interface{}{{"id": "app"}}); err != nil {
+		t.Fatal(err)
+	}
+	if CanReadImage(s, "app", "stranger") {
+		t.Fatal("Listing an image in _index_images should not make it readable")
+	}
+
+	if err := SetPublic(s, "secret", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if repos, err := ListPrivateRepositories(s); err != nil || len(repos) != 0 {
+		t.Fatalf("Private index should be empty, got %v, %v", repos, err)
+	}
+	if !CanReadImage(s, "app", "stranger") {
+		t.Fatal("Image should be readable once the repository is public")
+	}
+	SetPrivate(s, "library", "private", nil)
+	if CanRead(s, "library", "private", "library") {
+		t.Fatal("Nobody should own the library namespace")
+	}
+}
+
+func TestPrivateIndexConcurrentUpdates(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-private-index-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	if _, err := RebuildPrivateIndex(s); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(repo string) {
+			defer wg.Done()
+			if err := SetPrivate(s, "someone", repo, nil); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("repo%d", i))
+	}
+	wg.Wait()
+	if repos, err := ListPrivateRepositories(s); err != nil || len(repos) != 8 {
+		t.Fatalf("Expected all 8 repositories in the private index, got %v, %v", repos, err)
+	}
+}
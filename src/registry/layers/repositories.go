@@ -0,0 +1,257 @@
+package layers
+
+import (
+	"encoding/json"
+	"path"
+	"registry/storage"
+	"sort"
+	"strings"
+)
+
+type Repository struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func (r Repository) String() string {
+	return r.Namespace + "/" + r.Name
+}
+
+// List every repository in storage (repositories/{namespace}/{repo})
+func ListRepositories(s storage.Storage) ([]Repository, error) {
+	namespaces, err := s.List("repositories")
+	if storage.IsNotFound(err) {
+		// nothing pushed yet
+		return []Repository{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	repos := []Repository{}
+	for _, namespacePath := range namespaces {
+		names, err := s.List(namespacePath)
+		if storage.IsNotFound(err) {
+			// the namespace was emptied out from under us
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			repos = append(repos, Repository{Namespace: path.Base(namespacePath), Name: path.Base(name)})
+		}
+	}
+	return repos, nil
+}
+
+// Return a map of tag name -> image id for the repository
+func ListTags(s storage.Storage, namespace, repo string) (map[string]string, error) {
+	names, err := s.List(storage.RepoTagPath(namespace, repo, ""))
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, name := range names {
+		base := path.Base(name)
+		if !strings.HasPrefix(base, storage.TAG_PREFIX) {
+			continue
+		}
+		// this is a tag
+		content, err := s.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		tags[strings.TrimPrefix(base, storage.TAG_PREFIX)] = string(content)
+	}
+	return tags, nil
+}
+
+// Return the ancestry of imageID (imageID first, base image last)
+func GetAncestry(s storage.Storage, imageID string) ([]string, error) {
+	content, err := s.Get(storage.ImageAncestryPath(imageID))
+	if err != nil {
+		return nil, err
+	}
+	var ancestry []string
+	if err := json.Unmarshal(content, &ancestry); err != nil {
+		return nil, err
+	}
+	return ancestry, nil
+}
+
+// Return the ids of the images listed in the repository's _index_images
+func GetIndexImageIDs(s storage.Storage, namespace, repo string) ([]string, error) {
+	content, err := s.Get(storage.RepoIndexImagesPath(namespace, repo))
+	if err != nil {
+		return nil, err
+	}
+	var images []map[string]interface{}
+	if err := json.Unmarshal(content, &images); err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, image := range images {
+		if id, ok := image["id"].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Return every image the repository references: the full ancestry of every tag plus everything in _index_images.
+func RepositoryImages(s storage.Storage, namespace, repo string) (map[string]bool, error) {
+	images, err := TaggedImages(s, namespace, repo)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := GetIndexImageIDs(s, namespace, repo)
+	if err != nil && !storage.IsNotFound(err) {
+		return nil, err
+	}
+	for _, id := range ids {
+		images[id] = true
+	}
+	return images, nil
+}
+
+// Return the images the repository's tags point at and their ancestry. Unlike RepositoryImages this leaves out
+// _index_images, which whoever pushes to the repository can fill with any image ids. A tag whose ancestry can't
+// be read is an error, since there is no telling what it references.
+func TaggedImages(s storage.Storage, namespace, repo string) (map[string]bool, error) {
+	tags, err := ListTags(s, namespace, repo)
+	if storage.IsNotFound(err) {
+		tags = map[string]string{}
+	} else if err != nil {
+		return nil, err
+	}
+	images := map[string]bool{}
+	for _, imageID := range tags {
+		ancestry, err := GetAncestry(s, imageID)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ancestry {
+			images[id] = true
+		}
+	}
+	return images, nil
+}
+
+type DeleteResult struct {
+	Repository string   `json:"repository"`
+	Tags       []string `json:"tags"`
+	Files      []string `json:"files"`
+	Images     []string `json:"images"`
+}
+
+// DeleteRepository removes a repository's tags and metadata. If cascade is set, images the repository referenced
+// that no other repository references are removed too.
+//
+// This is safe to retry: everything that is already gone is skipped, and _index_images (which is what tells a
+// retry which images were part of the repository) is removed last, after the images.
+func DeleteRepository(s storage.Storage, namespace, repo string, cascade bool) (*DeleteResult, error) {
+	result := &DeleteResult{
+		Repository: namespace + "/" + repo,
+		Tags:       []string{},
+		Files:      []string{},
+		Images:     []string{},
+	}
+	var repoImages, referenced map[string]bool
+	if cascade {
+		// if what the repositories reference isn't known, neither is what can be removed with this one, so nothing
+		// is removed at all
+		var err error
+		if repoImages, err = RepositoryImages(s, namespace, repo); err != nil {
+			return result, err
+		}
+		if referenced, err = referencedElsewhere(s, namespace, repo); err != nil {
+			return result, err
+		}
+	}
+	tags, err := ListTags(s, namespace, repo)
+	if storage.IsNotFound(err) {
+		tags = map[string]string{}
+	} else if err != nil {
+		return result, err
+	}
+	for tag, _ := range tags {
+		if err := s.Remove(storage.RepoTagPath(namespace, repo, tag)); err != nil {
+			if exists, _ := s.Exists(storage.RepoTagPath(namespace, repo, tag)); exists {
+				return result, err
+			}
+			continue
+		}
+		result.Tags = append(result.Tags, tag)
+	}
+	for _, relpath := range []string{storage.RepoJsonPath(namespace, repo), storage.RepoPrivatePath(namespace, repo)} {
+		if exists, _ := s.Exists(relpath); !exists {
+			continue
+		}
+		if err := s.Remove(relpath); err != nil {
+			return result, err
+		}
+		result.Files = append(result.Files, relpath)
+	}
+	if err := updatePrivateIndex(s, namespace, repo, false); err != nil {
+		return result, err
+	}
+	if cascade {
+		for imageID, _ := range repoImages {
+			if referenced[imageID] {
+				continue
+			}
+			if exists, err := s.Exists(storage.ImageMarkPath(imageID)); err != nil {
+				return result, err
+			} else if exists {
+				// being uploaded again by someone, leave it alone
+				continue
+			}
+			if exists, err := s.Exists(storage.ImageJsonPath(imageID)); err != nil {
+				return result, err
+			} else if !exists {
+				continue
+			}
+			if err := s.RemoveAll(storage.ImageDir(imageID)); err != nil {
+				return result, err
+			}
+			result.Images = append(result.Images, imageID)
+		}
+	}
+	indexPath := storage.RepoIndexImagesPath(namespace, repo)
+	if exists, _ := s.Exists(indexPath); exists {
+		if err := s.Remove(indexPath); err != nil {
+			return result, err
+		}
+		result.Files = append(result.Files, indexPath)
+	}
+	// anything left over (v2 manifests, stray files)
+	if names, err := s.List(storage.RepoTagPath(namespace, repo, "")); err == nil && len(names) > 0 {
+		if err := s.RemoveAll(storage.RepoTagPath(namespace, repo, "")); err != nil {
+			return result, err
+		}
+		result.Files = append(result.Files, storage.RepoTagPath(namespace, repo, ""))
+	}
+	sort.Strings(result.Tags)
+	sort.Strings(result.Images)
+	return result, nil
+}
+
+// images referenced by any repository other than namespace/repo
+func referencedElsewhere(s storage.Storage, namespace, repo string) (map[string]bool, error) {
+	referenced := map[string]bool{}
+	repos, err := ListRepositories(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range repos {
+		if other.Namespace == namespace && other.Name == repo {
+			continue
+		}
+		images, err := RepositoryImages(s, other.Namespace, other.Name)
+		if err != nil {
+			return nil, err
+		}
+		for id, _ := range images {
+			referenced[id] = true
+		}
+	}
+	return referenced, nil
+}
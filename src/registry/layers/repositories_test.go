@@ -0,0 +1,43 @@
+package layers
+
+import (
+	"registry/storage"
+	"testing"
+)
+
+func TestDeleteRepositoryCascade(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-repositories-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	for id, ancestry := range map[string]string{"base": `["base"]`, "app": `["app","base"]`} {
+		s.Put(storage.ImageJsonPath(id), []byte(`{"id":"`+id+`"}`))
+		s.Put(storage.ImageAncestryPath(id), []byte(ancestry))
+	}
+	s.Put(storage.RepoTagPath("someone", "app", "latest"), []byte("app"))
+	s.Put(storage.RepoTagPath("someone", "base", "latest"), []byte("base"))
+	// whatever this one references can't be told
+	s.Put(storage.RepoTagPath("someone", "broken", "latest"), []byte("missing"))
+
+	if _, err := DeleteRepository(s, "someone", "app", true); err == nil {
+		t.Fatal("Cascading should be refused while another repository can't be read")
+	}
+	if exists, _ := s.Exists(storage.RepoTagPath("someone", "app", "latest")); !exists {
+		t.Fatal("Nothing should have been removed")
+	}
+
+	s.Remove(storage.RepoTagPath("someone", "broken", "latest"))
+	result, err := DeleteRepository(s, "someone", "app", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Images) != 1 || result.Images[0] != "app" {
+		t.Fatalf("Only app should have been removed, got %+v", result)
+	}
+	if exists, _ := s.Exists(storage.ImageJsonPath("base")); !exists {
+		t.Fatal("base is still referenced and should have been kept")
+	}
+}
@@ -0,0 +1,165 @@
+package layers
+
+import (
+	"encoding/json"
+	"registry/storage"
+	"sort"
+	"strings"
+)
+
+type SearchResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// The search index is a json map of "namespace/repo" -> description kept at storage.SearchIndexPath(). It is
+// rebuilt from the repositories in storage if it doesn't exist yet.
+func loadSearchIndex(s storage.Storage) (map[string]string, error) {
+	content, err := s.Get(storage.SearchIndexPath())
+	if storage.IsNotFound(err) {
+		return RebuildSearchIndex(s)
+	} else if err != nil {
+		return nil, err
+	}
+	index := map[string]string{}
+	if err := json.Unmarshal(content, &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func saveSearchIndex(s storage.Storage, index map[string]string) error {
+	content, err := json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+	return s.Put(storage.SearchIndexPath(), content)
+}
+
+// The description of a repository is the comment (docker commit -m) of the image its latest tag points to, or of
+// the first of its other tags if it has no latest tag.
+func repoDescription(s storage.Storage, namespace, repo string) string {
+	tags, err := ListTags(s, namespace, repo)
+	if err != nil || len(tags) == 0 {
+		return ""
+	}
+	imageID, ok := tags["latest"]
+	if !ok {
+		names := []string{}
+		for name, _ := range tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		imageID = tags[names[0]]
+	}
+	content, err := s.Get(storage.ImageJsonPath(imageID))
+	if err != nil {
+		return ""
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(content, &data); err != nil {
+		return ""
+	}
+	comment, _ := data["comment"].(string)
+	return comment
+}
+
+func RebuildSearchIndex(s storage.Storage) (map[string]string, error) {
+	index, err := buildSearchIndex(s)
+	if err != nil {
+		return nil, err
+	}
+	return index, saveSearchIndex(s, index)
+}
+
+func buildSearchIndex(s storage.Storage) (map[string]string, error) {
+	repos, err := ListRepositories(s)
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]string{}
+	for _, repo := range repos {
+		if tags, err := ListTags(s, repo.Namespace, repo.Name); err != nil || len(tags) == 0 {
+			// only repositories with tags can be pulled, so don't bother showing anything else
+			continue
+		}
+		index[repo.String()] = repoDescription(s, repo.Namespace, repo.Name)
+	}
+	return index, nil
+}
+
+// applies change to the search index (built if it doesn't exist yet) and saves it if change returns true. retried
+// if the index is updated concurrently, by a push to another repository.
+func updateSearchIndex(s storage.Storage, change func(index map[string]string) bool) error {
+	return storage.Update(s, storage.SearchIndexPath(), func(content []byte) ([]byte, error) {
+		var index map[string]string
+		if content == nil {
+			var err error
+			if index, err = buildSearchIndex(s); err != nil {
+				return nil, err
+			}
+		} else if err := json.Unmarshal(content, &index); err != nil {
+			return nil, err
+		}
+		if !change(index) && content != nil {
+			// nothing changed, don't bother writing
+			return nil, nil
+		}
+		return json.Marshal(&index)
+	})
+}
+
+func AddToSearchIndex(s storage.Storage, namespace, repo string) error {
+	name := namespace + "/" + repo
+	description := repoDescription(s, namespace, repo)
+	return updateSearchIndex(s, func(index map[string]string) bool {
+		if current, ok := index[name]; ok && current == description {
+			return false
+		}
+		index[name] = description
+		return true
+	})
+}
+
+func RemoveFromSearchIndex(s storage.Storage, namespace, repo string) error {
+	name := namespace + "/" + repo
+	return updateSearchIndex(s, func(index map[string]string) bool {
+		if _, ok := index[name]; !ok {
+			return false
+		}
+		delete(index, name)
+		return true
+	})
+}
+
+// Case insensitive search of repository names. With prefix set, query has to match the beginning of either the
+// full name or the repository part of it ("ubu" matches "library/ubuntu"), otherwise it can match anywhere.
+func Search(s storage.Storage, query string, prefix bool) ([]SearchResult, error) {
+	index, err := loadSearchIndex(s)
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(query)
+	results := []SearchResult{}
+	for name, description := range index {
+		lowerName := strings.ToLower(name)
+		var matches bool
+		if prefix {
+			repoPart := lowerName[strings.Index(lowerName, "/")+1:]
+			matches = strings.HasPrefix(lowerName, query) || strings.HasPrefix(repoPart, query)
+		} else {
+			matches = strings.Contains(lowerName, query) || strings.Contains(strings.ToLower(description), query)
+		}
+		if matches {
+			results = append(results, SearchResult{Name: name, Description: description})
+		}
+	}
+	sort.Sort(searchResults(results))
+	return results, nil
+}
+
+type searchResults []SearchResult
+
+func (r searchResults) Len() int           { return len(r) }
+func (r searchResults) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r searchResults) Less(i, j int) bool { return r[i].Name < r[j].Name }
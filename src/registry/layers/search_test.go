@@ -0,0 +1,65 @@
+package layers
+
+import (
+	"registry/storage"
+	"testing"
+)
+
+func searchNames(t *testing.T, s storage.Storage, query string, prefix bool) map[string]string {
+	results, err := Search(s, query, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]string{}
+	for _, result := range results {
+		names[result.Name] = result.Description
+	}
+	return names
+}
+
+func TestSearch(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-search-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	s.Put(storage.ImageJsonPath("ubuntu"), []byte(`{"id":"ubuntu","comment":"Ubuntu base image"}`))
+	s.Put(storage.ImageJsonPath("app"), []byte(`{"id":"app"}`))
+	s.Put(storage.RepoTagPath("library", "ubuntu", "14.04"), []byte("ubuntu"))
+	s.Put(storage.RepoTagPath("someone", "app", "latest"), []byte("app"))
+	// nothing to pull, so not worth finding
+	s.Put(storage.RepoJsonPath("someone", "untagged"), []byte("{}"))
+
+	// built from what is in storage the first time
+	names := searchNames(t, s, "", false)
+	if len(names) != 2 || names["library/ubuntu"] != "Ubuntu base image" || names["someone/app"] != "" {
+		t.Fatalf("Expected both tagged repositories with their descriptions, got %v", names)
+	}
+	if exists, _ := s.Exists(storage.SearchIndexPath()); !exists {
+		t.Fatal("The search index should have been saved")
+	}
+	if names := searchNames(t, s, "BASE", false); len(names) != 1 || names["library/ubuntu"] == "" {
+		t.Fatalf("Expected the description to match, got %v", names)
+	}
+	if names := searchNames(t, s, "ubu", true); len(names) != 1 {
+		t.Fatalf("Expected the repository part to match the prefix, got %v", names)
+	}
+	if names := searchNames(t, s, "buntu", true); len(names) != 0 {
+		t.Fatalf("Expected nothing to match the prefix, got %v", names)
+	}
+
+	s.Put(storage.ImageJsonPath("app2"), []byte(`{"id":"app2","comment":"The app"}`))
+	s.Put(storage.RepoTagPath("someone", "app", "latest"), []byte("app2"))
+	if err := AddToSearchIndex(s, "someone", "app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveFromSearchIndex(s, "library", "ubuntu"); err != nil {
+		t.Fatal(err)
+	}
+	// the tag is still there, so this only passes if the saved index is what's searched
+	if names := searchNames(t, s, "", false); len(names) != 1 || names["someone/app"] != "The app" {
+		t.Fatalf("Expected only the updated repository, got %v", names)
+	}
+}
@@ -2,6 +2,7 @@ package layers
 
 import (
 	"archive/tar"
+	"bufio"
 	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
@@ -47,6 +48,25 @@ func (t *TarInfo) Load(file io.ReadSeeker) {
 	} else {
 		reader = tar.NewReader(gzipReader)
 	}
+	t.load(reader)
+}
+
+// LoadReader is Load for a layer that can't be seeked, like one being read back from storage
+func (t *TarInfo) LoadReader(r io.Reader) {
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			t.Error = TarError(err.Error())
+			return
+		}
+		t.load(tar.NewReader(gzipReader))
+		return
+	}
+	t.load(tar.NewReader(buffered))
+}
+
+func (t *TarInfo) load(reader *tar.Reader) {
 	for {
 		header, err := reader.Next()
 		if err == io.EOF {
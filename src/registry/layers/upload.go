@@ -0,0 +1,290 @@
+package layers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"registry/storage"
+	"time"
+)
+
+type RangeError string
+
+func (e RangeError) Error() string {
+	return string(e)
+}
+
+// An Upload is a resumable, chunked upload session. Every chunk is written to its own key and the session state
+// (including the running sha256 state) is kept in storage, so an upload can be continued after a restart or on a
+// different registry instance. The state is only written if it hasn't changed since it was read, so of two chunks
+// sent for the same offset at the same time only one is taken, and a chunk can't be taken while the upload is being
+// completed (see Claim).
+type Upload struct {
+	UUID      string        `json:"uuid"`
+	ImageID   string        `json:"image_id,omitempty"` // set for v1 layer uploads
+	StartedAt time.Time     `json:"started_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Offset    int64         `json:"offset"`
+	Chunks    []UploadChunk `json:"chunks"`     // every stored chunk, in order
+	HashState []byte        `json:"hash_state"` // marshalled sha256 of everything up to Offset
+	Claimed   bool          `json:"claimed,omitempty"`
+	version   string        // of the state this was read from, "" if it hasn't been saved yet
+}
+
+type UploadChunk struct {
+	Offset int64  `json:"offset"`
+	ID     string `json:"id"`
+}
+
+func (c UploadChunk) path(uuid string) string {
+	return storage.UploadChunkPath(uuid, c.Offset, c.ID)
+}
+
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func NewUpload(s storage.Storage, imageID string) (*Upload, error) {
+	uuid, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	u := &Upload{UUID: uuid, ImageID: imageID, StartedAt: time.Now().UTC(), Chunks: []UploadChunk{}}
+	if u.HashState, err = sha256.New().(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return nil, err
+	}
+	return u, u.save(s)
+}
+
+func GetUpload(s storage.Storage, uuid string) (*Upload, error) {
+	content, version, err := s.GetVersion(storage.UploadStatePath(uuid))
+	if err != nil {
+		return nil, err
+	}
+	var u Upload
+	if err := json.Unmarshal(content, &u); err != nil {
+		return nil, err
+	}
+	u.version = version
+	return &u, nil
+}
+
+// LastActive is when the upload last received a chunk, or when it started if it hasn't yet
+func (u *Upload) LastActive() time.Time {
+	if u.UpdatedAt.IsZero() {
+		return u.StartedAt
+	}
+	return u.UpdatedAt
+}
+
+// writes the state, unless it was written by someone else since it was read
+func (u *Upload) save(s storage.Storage) error {
+	u.UpdatedAt = time.Now().UTC()
+	content, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err := s.PutIfVersion(storage.UploadStatePath(u.UUID), content, u.version); err != nil {
+		return err
+	}
+	u.version = storage.ContentVersion(content)
+	return nil
+}
+
+func (u *Upload) hash() (hash.Hash, error) {
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(u.HashState); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Append a chunk starting at offset. offset must be the current end of the upload, and length (-1 if it isn't known)
+// the size of the chunk. A chunk only counts once it has been completely received and stored, so a dropped
+// connection leaves the session at the previous offset, and so does losing the race against another chunk for the
+// same offset.
+func (u *Upload) AppendChunk(s storage.Storage, offset, length int64, r io.Reader) error {
+	if u.Claimed {
+		return RangeError("Upload is being completed")
+	}
+	if offset != u.Offset {
+		return RangeError(fmt.Sprintf("Chunk starts at %d but upload is at %d", offset, u.Offset))
+	}
+	h, err := u.hash()
+	if err != nil {
+		return err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	chunk := UploadChunk{Offset: offset, ID: id}
+	counter := &countingWriter{}
+	teeReader := io.TeeReader(r, io.MultiWriter(h, counter))
+	if err := s.PutReader(chunk.path(u.UUID), teeReader, noopAfterWrite); err != nil {
+		s.Remove(chunk.path(u.UUID))
+		return err
+	}
+	if length >= 0 && counter.n != length {
+		s.Remove(chunk.path(u.UUID))
+		return RangeError(fmt.Sprintf("Chunk should have %d bytes but has %d", length, counter.n))
+	}
+	if counter.n == 0 {
+		// empty chunk, don't keep it around
+		s.Remove(chunk.path(u.UUID))
+		return nil
+	}
+	updated := *u
+	if updated.HashState, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		s.Remove(chunk.path(u.UUID))
+		return err
+	}
+	updated.Chunks = append(append([]UploadChunk{}, u.Chunks...), chunk)
+	updated.Offset += counter.n
+	if err := updated.save(s); storage.IsConflict(err) {
+		s.Remove(chunk.path(u.UUID))
+		return RangeError("Another chunk was received for the same offset")
+	} else if err != nil {
+		s.Remove(chunk.path(u.UUID))
+		return err
+	}
+	*u = updated
+	return nil
+}
+
+// Digest of everything uploaded so far
+func (u *Upload) Digest() (string, error) {
+	h, err := u.hash()
+	if err != nil {
+		return "", err
+	}
+	return DIGEST_SHA256_PREFIX + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify returns a DigestError if the uploaded content does not match digest
+func (u *Upload) Verify(digest string) error {
+	computed, err := u.Digest()
+	if err != nil {
+		return err
+	}
+	if computed != digest {
+		return DigestError("Digest mismatch: expected " + digest + ", got " + computed)
+	}
+	return nil
+}
+
+// Reader returns the concatenation of all the chunks
+func (u *Upload) Reader(s storage.Storage) io.ReadCloser {
+	paths := make([]string, len(u.Chunks))
+	for i, chunk := range u.Chunks {
+		paths[i] = chunk.path(u.UUID)
+	}
+	return &chunkReader{s: s, paths: paths}
+}
+
+// Claim stops the upload from taking chunks so it can be completed. It fails with a RangeError if a chunk was taken
+// since u was read, as the content is then not what was verified, or if the upload is already being completed.
+func (u *Upload) Claim(s storage.Storage) error {
+	if u.Claimed {
+		return RangeError("Upload is already being completed")
+	}
+	claimed := *u
+	claimed.Claimed = true
+	if err := claimed.save(s); storage.IsConflict(err) {
+		return RangeError("Upload changed while being completed")
+	} else if err != nil {
+		return err
+	}
+	*u = claimed
+	return nil
+}
+
+// Release undoes Claim, so an upload that failed to complete can be completed again
+func (u *Upload) Release(s storage.Storage) error {
+	released := *u
+	released.Claimed = false
+	if err := released.save(s); err != nil {
+		return err
+	}
+	*u = released
+	return nil
+}
+
+// Commit verifies the upload against digest, writes the assembled content to relpath and removes the session.
+func (u *Upload) Commit(s storage.Storage, relpath, digest string, afterWrite func(io.ReadSeeker)) error {
+	if err := u.Verify(digest); err != nil {
+		return err
+	}
+	if err := u.Claim(s); err != nil {
+		return err
+	}
+	reader := u.Reader(s)
+	defer reader.Close()
+	if err := s.PutReader(relpath, reader, afterWrite); err != nil {
+		u.Release(s)
+		return err
+	}
+	return u.Cancel(s)
+}
+
+func (u *Upload) Cancel(s storage.Storage) error {
+	return s.RemoveAll(storage.UploadPath(u.UUID))
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// reads the chunks one after another, only opening each one when it is needed
+type chunkReader struct {
+	s       storage.Storage
+	paths   []string
+	current io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.paths) == 0 {
+				return 0, io.EOF
+			}
+			reader, err := c.s.GetReader(c.paths[0])
+			if err != nil {
+				return 0, err
+			}
+			c.current = reader
+			c.paths = c.paths[1:]
+		}
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.current != nil {
+		return c.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package layers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"registry/storage"
+	"strings"
+	"testing"
+)
+
+func TestUploadChunks(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-upload-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	upload, err := NewUpload(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.AppendChunk(s, 0, 10, strings.NewReader("short")); err == nil {
+		t.Fatal("A chunk shorter than its Content-Range should be rejected")
+	} else if _, ok := err.(RangeError); !ok || upload.Offset != 0 {
+		t.Fatalf("Expected a range error and nothing appended, got %v at %d", err, upload.Offset)
+	}
+
+	// two clients sending a chunk for the same offset
+	other, err := GetUpload(s, upload.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upload.AppendChunk(s, 0, 5, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.AppendChunk(s, 0, -1, strings.NewReader("HELLO")); err == nil {
+		t.Fatal("Only one of two chunks for the same offset should be taken")
+	} else if _, ok := err.(RangeError); !ok {
+		t.Fatalf("Expected a range error, got %v", err)
+	}
+	if err := upload.AppendChunk(s, 5, -1, strings.NewReader(" world")); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := GetUpload(s, upload.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := resumed.Reader(s)
+	content, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(content) != "hello world" {
+		t.Fatalf("Expected the chunks that were taken, got %q, %v", content, err)
+	}
+	sum := sha256.Sum256([]byte("hello world"))
+	if err := resumed.Verify(DIGEST_SHA256_PREFIX + hex.EncodeToString(sum[:])); err != nil {
+		t.Fatal(err)
+	}
+	if chunks, err := s.List(storage.UploadPath(upload.UUID) + "/chunks"); err != nil || len(chunks) != 2 {
+		t.Fatalf("Chunks that weren't taken should be removed, got %v, %v", chunks, err)
+	}
+
+	// a chunk taken after the upload was read for completing means the content isn't what was verified
+	if err := upload.AppendChunk(s, 11, -1, strings.NewReader("!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.Claim(s); err == nil {
+		t.Fatal("An upload that changed since it was read shouldn't be claimed")
+	}
+	if err := upload.Claim(s); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := GetUpload(s, upload.UUID); err != nil {
+		t.Fatal(err)
+	} else if err := claimed.AppendChunk(s, 12, -1, strings.NewReader("?")); err == nil {
+		t.Fatal("A claimed upload shouldn't take chunks")
+	}
+}
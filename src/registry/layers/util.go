@@ -6,25 +6,40 @@ import (
 	"registry/logger"
 	"registry/storage"
 	"strings"
+	"sync"
+	"time"
 )
 
-// this function takes both []byte and []map[string]interface{} to shortcut in some cases.
+// this function takes both []byte and []map[string]interface{} to shortcut in some cases. it is retried if another
+// push to the same repository updates the index at the same time, so neither loses the other's images.
 func UpdateIndexImages(s storage.Storage, namespace, repo string, additionalBytes []byte,
 	additional []map[string]interface{}) error {
-	path := storage.RepoIndexImagesPath(namespace, repo)
-	// get previous content
-	previousData, err := s.Get(path)
-	if err != nil {
+	imageIDs := []string{}
+	for _, image := range additional {
+		if id, ok := image["id"].(string); ok {
+			imageIDs = append(imageIDs, id)
+		}
+	}
+	if err := AddImageRepository(s, namespace, repo, imageIDs); err != nil {
+		return err
+	}
+	return storage.Update(s, storage.RepoIndexImagesPath(namespace, repo), func(previousData []byte) ([]byte, error) {
+		return mergeIndexImages(previousData, additionalBytes, additional)
+	})
+}
+
+func mergeIndexImages(previousData, additionalBytes []byte, additional []map[string]interface{}) ([]byte, error) {
+	if previousData == nil {
 		// doesn't yet exist, just put the data
-		return s.Put(path, additionalBytes)
+		return additionalBytes, nil
 	}
 	var previous []map[string]interface{}
 	if err := json.Unmarshal(previousData, &previous); err != nil {
-		return err
+		return nil, err
 	}
 	if len(previous) == 0 {
 		// nothing in previous, just put the data
-		return s.Put(path, additionalBytes)
+		return additionalBytes, nil
 	}
 	// Merge existing images with the incoming images. if the image ID exists in the existing, check to see if
 	// the checksum is the same. if it is just continue, if it isn't replace it with the incoming image
@@ -33,7 +48,7 @@ func UpdateIndexImages(s storage.Storage, namespace, repo string, additionalByte
 		id, ok := value["id"].(string)
 		if !ok {
 			// json was screwed up
-			return errors.New("Invalid Data")
+			return nil, errors.New("Invalid Data")
 		}
 		if imageData, ok := newImagesMap[id]; ok {
 			if _, ok := imageData["checksum"]; ok {
@@ -46,7 +61,7 @@ func UpdateIndexImages(s storage.Storage, namespace, repo string, additionalByte
 		id, ok := value["id"].(string)
 		if !ok {
 			// json was screwed up
-			return errors.New("Invalid Data")
+			return nil, errors.New("Invalid Data")
 		}
 		if imageData, ok := newImagesMap[id]; ok {
 			if _, ok := imageData["checksum"]; ok {
@@ -61,11 +76,7 @@ func UpdateIndexImages(s storage.Storage, namespace, repo string, additionalByte
 		newImagesArr[i] = image
 		i++
 	}
-	data, err := json.Marshal(&newImagesArr)
-	if err != nil {
-		return err
-	}
-	return s.Put(path, data)
+	return json.Marshal(&newImagesArr)
 }
 
 func GetImageFilesCache(s storage.Storage, imageID string) ([]byte, error) {
@@ -89,18 +100,23 @@ func GetImageFilesJson(s storage.Storage, imageID string) ([]byte, error) {
 	// docker-registry 0.6.5 has an lzma decompress here. it actually doesn't seem to be used so i've omitted it
 	// will add it later if need be.
 	tarFilesInfo := NewTarFilesInfo()
-	if reader, err := s.GetReader(storage.ImageLayerPath(imageID)); err != nil {
+	reader, err := s.GetReader(storage.ImageLayerPath(imageID))
+	if err != nil {
 		return nil, err
-	} else if err := tarFilesInfo.Load(reader); err != nil {
+	}
+	defer reader.Close()
+	if err := tarFilesInfo.Load(reader); err != nil {
 		return nil, err
 	}
 	return tarFilesInfo.Json()
 }
 
+var ErrInvalidChecksum = errors.New("Invalid checksum format")
+
 func StoreChecksum(s storage.Storage, imageID, checksum string) error {
 	parts := strings.Split(checksum, ":")
 	if len(parts) != 2 {
-		return errors.New("Invalid checksum format")
+		return ErrInvalidChecksum
 	}
 	return s.Put(storage.ImageChecksumPath(imageID), []byte(checksum))
 }
@@ -141,6 +157,30 @@ func SetImageDiffCache(s storage.Storage, imageID string, diffJson []byte) error
 	return s.Put(storage.ImageDiffPath(imageID), diffJson)
 }
 
+type GenDiffError struct {
+	ImageID string    `json:"image_id"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+var lastGenDiffError *GenDiffError
+var lastGenDiffErrorLock sync.RWMutex
+
+// GenDiff runs in the background, so keep the last error around for the status endpoint
+func genDiffError(imageID, message string) {
+	logger.Error("[GenDiff][" + imageID + "] " + message)
+	lastGenDiffErrorLock.Lock()
+	defer lastGenDiffErrorLock.Unlock()
+	lastGenDiffError = &GenDiffError{ImageID: imageID, Message: message, Time: time.Now().UTC()}
+}
+
+// Returns the last error seen by GenDiff, or nil if there hasn't been one
+func LastGenDiffError() *GenDiffError {
+	lastGenDiffErrorLock.RLock()
+	defer lastGenDiffErrorLock.RUnlock()
+	return lastGenDiffError
+}
+
 func GenDiff(s storage.Storage, imageID string) {
 	// Comment from docker-registry 0.6.5
 	// get json describing file differences in layer
@@ -168,20 +208,20 @@ func GenDiff(s storage.Storage, imageID string) {
 	anContent, err := s.Get(anPath)
 	if err != nil {
 		// error fetching ancestry, just return
-		logger.Error("[GenDiff][" + imageID + "] error fetching ancestry: " + err.Error())
+		genDiffError(imageID, "error fetching ancestry: "+err.Error())
 		return
 	}
 	var ancestry []string
 	if err := json.Unmarshal(anContent, &ancestry); err != nil {
 		// json unmarshal fail, just return
-		logger.Error("[GenDiff][" + imageID + "] error unmarshalling ancestry json: " + err.Error())
+		genDiffError(imageID, "error unmarshalling ancestry json: "+err.Error())
 		return
 	}
 	// get map of file infos
 	infoMap, err := fileInfoMap(s, imageID)
 	if err != nil {
 		// error getting file info, just return
-		logger.Error("[GenDiff][" + imageID + "] error getting files info: " + err.Error())
+		genDiffError(imageID, "error getting files info: "+err.Error())
 		return
 	}
 
@@ -193,7 +233,7 @@ func GenDiff(s storage.Storage, imageID string) {
 		anInfoMap, err := fileInfoMap(s, anID)
 		if err != nil {
 			// error getting file info, just return
-			logger.Error("[GenDiff][" + imageID + "] error getting ancestor " + anID + " files info: " + err.Error())
+			genDiffError(imageID, "error getting ancestor "+anID+" files info: "+err.Error())
 			return
 		}
 		for fname, info := range infoMap {
@@ -202,7 +242,7 @@ func GenDiff(s storage.Storage, imageID string) {
 			// technically isBool should never be false.
 			if !isBool || isDeleted {
 				if !isBool {
-					logger.Error("[GenDiff][" + imageID + "] file info is in a bad format")
+					genDiffError(imageID, "file info is in a bad format")
 				}
 				deleted[fname] = info
 				delete(infoMap, fname)
@@ -216,7 +256,7 @@ func GenDiff(s storage.Storage, imageID string) {
 			isDeleted, isBool = anInfo[1].(bool)
 			if !isBool || isDeleted {
 				if !isBool {
-					logger.Error("[GenDiff][" + imageID + "] file info is in a bad format")
+					genDiffError(imageID, "file info is in a bad format")
 				}
 				// deleted in ancestor, must be created now.
 				created[fname] = info
@@ -239,12 +279,12 @@ func GenDiff(s storage.Storage, imageID string) {
 	}
 	if diffJson, err = json.Marshal(&diff); err != nil {
 		// json marshal fail. just return
-		logger.Error("[GenDiff][" + imageID + "] error marshalling new diff json: " + err.Error())
+		genDiffError(imageID, "error marshalling new diff json: "+err.Error())
 		return
 	}
 	if err := SetImageDiffCache(s, imageID, diffJson); err != nil {
 		// json marshal fail. just return
-		logger.Error("[GenDiff][" + imageID + "] error setting new diff cache: " + err.Error())
+		genDiffError(imageID, "error setting new diff cache: "+err.Error())
 		return
 	}
 }
@@ -0,0 +1,300 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"registry/logger"
+	"registry/storage"
+	"strings"
+	"time"
+)
+
+// the checkpoint is saved after this many keys are copied, so an interrupted run doesn't start over
+const CHECKPOINT_INTERVAL = 100
+
+// What is under these doesn't change once written (except for images still being uploaded, which are copied again
+// on every run), so a key whose size matches the checkpoint needs no copying. Everything else is small and read
+// again to see if it changed.
+var IMMUTABLE_PREFIXES = []string{"images/", "blobs/"}
+
+// not worth copying
+var SKIPPED_PREFIXES = []string{"_status/"}
+
+// A Checkpoint records what was copied and what it looked like, so a migration can be resumed, and run again to copy
+// only what changed since (before switching the registry over to the new storage).
+type Checkpoint struct {
+	From      string               `json:"from"` // storage.Identity of the storages
+	To        string               `json:"to"`
+	UpdatedAt time.Time            `json:"updated_at"`
+	Keys      map[string]CopiedKey `json:"keys"`
+}
+
+type CopiedKey struct {
+	Size       int64  `json:"size"`
+	Sha256     string `json:"sha256"`
+	InProgress bool   `json:"in_progress,omitempty"` // of an image being uploaded, may change before it is done
+}
+
+type Report struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
+	Keys      int       `json:"keys"`
+	Copied    int       `json:"copied"`
+	Unchanged int       `json:"unchanged"`
+	Removed   int       `json:"removed"` // keys copied by an earlier run that are gone from the source
+	// nothing is removed if anything went wrong, since a key that couldn't be listed or read looks gone
+	SkippedRemoval bool     `json:"skipped_removal"`
+	Bytes          int64    `json:"bytes"`
+	Errors         []string `json:"errors"`
+}
+
+func (r *Report) addError(format string, args ...interface{}) {
+	logger.Error("[Migrate] "+format, args...)
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func LoadCheckpoint(filename string) (*Checkpoint, error) {
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &Checkpoint{Keys: map[string]CopiedKey{}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(content, checkpoint); err != nil {
+		return nil, err
+	}
+	if checkpoint.Keys == nil {
+		checkpoint.Keys = map[string]CopiedKey{}
+	}
+	return checkpoint, nil
+}
+
+// written to a temp file and renamed, so a crash leaves the previous checkpoint
+func (c *Checkpoint) Save(filename string) error {
+	c.UpdatedAt = time.Now().UTC()
+	content, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	temp := filename + ".tmp"
+	if err := ioutil.WriteFile(temp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, filename)
+}
+
+type migration struct {
+	from, to       storage.Storage
+	checkpoint     *Checkpoint
+	checkpointFile string
+	report         *Report
+	unsaved        int
+	// whether each image seen was still being uploaded
+	inProgress map[string]bool
+}
+
+// Migrate copies every key in from to to, checking what was written against the size and sha256 of what was read.
+// Keys recorded in the checkpoint (a file, created if it doesn't exist) are only copied again if they changed, and
+// the ones that are gone from from are removed from to, so running it again while the registry keeps serving from
+// from copies what changed in the meantime.
+func Migrate(from, to storage.Storage, checkpointFile string) (*Report, error) {
+	checkpoint, err := LoadCheckpoint(checkpointFile)
+	if err != nil {
+		return nil, err
+	}
+	fromType, toType := storage.Identity(from), storage.Identity(to)
+	if checkpoint.From == "" {
+		checkpoint.From, checkpoint.To = fromType, toType
+	} else if checkpoint.From != fromType || checkpoint.To != toType {
+		return nil, fmt.Errorf("%s is a checkpoint of a migration from %s to %s", checkpointFile, checkpoint.From,
+			checkpoint.To)
+	}
+	m := &migration{
+		from:           from,
+		to:             to,
+		checkpoint:     checkpoint,
+		checkpointFile: checkpointFile,
+		report:         &Report{From: fromType, To: toType, StartedAt: time.Now().UTC(), Errors: []string{}},
+		inProgress:     map[string]bool{},
+	}
+	seen := map[string]bool{}
+	err = storage.Walk(from, "/", func(relpath string) error {
+		if hasPrefix(relpath, SKIPPED_PREFIXES) {
+			return nil
+		}
+		seen[relpath] = true
+		m.report.Keys++
+		return m.migrateKey(relpath)
+	})
+	if err != nil && !storage.IsNotFound(err) {
+		return nil, err
+	} else if err != nil {
+		m.report.addError("error listing: %s", err.Error())
+	}
+	for relpath, _ := range checkpoint.Keys {
+		if seen[relpath] {
+			continue
+		}
+		if len(m.report.Errors) > 0 {
+			m.report.SkippedRemoval = true
+			break
+		}
+		if err := to.Remove(relpath); err != nil && !storage.IsNotFound(err) {
+			m.report.addError("%s: error removing: %s", relpath, err.Error())
+			continue
+		}
+		delete(checkpoint.Keys, relpath)
+		m.report.Removed++
+	}
+	if err := checkpoint.Save(checkpointFile); err != nil {
+		return nil, err
+	}
+	report := m.report
+	report.Duration = time.Since(report.StartedAt).String()
+	logger.Info("[Migrate] %s -> %s; keys=%d; copied=%d (%d bytes); unchanged=%d; removed=%d; errors=%d", fromType,
+		toType, report.Keys, report.Copied, report.Bytes, report.Unchanged, report.Removed, len(report.Errors))
+	return report, nil
+}
+
+func hasPrefix(relpath string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(relpath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// images/{id}/... of an image that is marked as in progress
+func (m *migration) isInProgress(relpath string) bool {
+	parts := strings.Split(relpath, "/")
+	if len(parts) < 3 || parts[0] != "images" {
+		return false
+	}
+	imageID := parts[1]
+	if inProgress, ok := m.inProgress[imageID]; ok {
+		return inProgress
+	}
+	inProgress, _ := m.from.Exists(storage.ImageMarkPath(imageID))
+	m.inProgress[imageID] = inProgress
+	return inProgress
+}
+
+// errors copying a key are reported and the migration goes on. only failing to save the checkpoint stops it.
+func (m *migration) migrateKey(relpath string) error {
+	copied, ok := m.checkpoint.Keys[relpath]
+	if ok && m.unchanged(relpath, copied) {
+		m.report.Unchanged++
+		return nil
+	}
+	inProgress := m.isInProgress(relpath)
+	copied, err := m.copyKey(relpath)
+	if err != nil {
+		m.report.addError("%s: %s", relpath, err.Error())
+		return nil
+	}
+	m.report.Copied++
+	m.report.Bytes += copied.Size
+	copied.InProgress = inProgress
+	m.checkpoint.Keys[relpath] = copied
+	if m.unsaved++; m.unsaved >= CHECKPOINT_INTERVAL {
+		m.unsaved = 0
+		return m.checkpoint.Save(m.checkpointFile)
+	}
+	return nil
+}
+
+func (m *migration) unchanged(relpath string, copied CopiedKey) bool {
+	if copied.InProgress {
+		return false
+	}
+	if hasPrefix(relpath, IMMUTABLE_PREFIXES) {
+		size, err := m.from.Size(relpath)
+		return err == nil && size == copied.Size
+	}
+	reader, err := m.from.GetReader(relpath)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+	current, err := sum(reader)
+	return err == nil && current.Sha256 == copied.Sha256
+}
+
+// copies relpath from m.from to m.to and reads it back to check that it arrived intact. layers are streamed, the
+// rest is written with Put like the registry writes it, so backends store it the same way.
+func (m *migration) copyKey(relpath string) (CopiedKey, error) {
+	reader, err := m.from.GetReader(relpath)
+	if err != nil {
+		return CopiedKey{}, err
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	counter := &countingWriter{}
+	tee := io.TeeReader(reader, io.MultiWriter(hash, counter))
+	if storage.IsLayerPath(relpath) {
+		err = m.to.PutReader(relpath, tee, func(io.ReadSeeker) {})
+	} else {
+		var data []byte
+		if data, err = ioutil.ReadAll(tee); err == nil {
+			err = m.to.Put(relpath, data)
+		}
+	}
+	if err != nil {
+		return CopiedKey{}, err
+	}
+	copied := CopiedKey{Size: counter.n, Sha256: hex.EncodeToString(hash.Sum(nil))}
+	if size, err := m.to.Size(relpath); err != nil {
+		return CopiedKey{}, err
+	} else if size != copied.Size {
+		return CopiedKey{}, fmt.Errorf("size mismatch: read %d bytes, wrote %d", copied.Size, size)
+	}
+	written, err := m.to.GetReader(relpath)
+	if err != nil {
+		return CopiedKey{}, err
+	}
+	defer written.Close()
+	if check, err := sum(written); err != nil {
+		return CopiedKey{}, err
+	} else if check.Sha256 != copied.Sha256 {
+		return CopiedKey{}, errors.New("checksum mismatch: " + copied.Sha256 + " was written as " + check.Sha256)
+	}
+	return copied, nil
+}
+
+func sum(r io.Reader) (CopiedKey, error) {
+	hash := sha256.New()
+	n, err := io.Copy(hash, r)
+	return CopiedKey{Size: n, Sha256: hex.EncodeToString(hash.Sum(nil))}, err
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// the storage.Config in a file, for the command line
+func LoadConfig(filename string) (*storage.Config, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &storage.Config{}
+	if err := json.Unmarshal(content, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
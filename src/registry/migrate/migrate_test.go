@@ -0,0 +1,112 @@
+package migrate
+
+import (
+	"errors"
+	"io"
+	"os"
+	"registry/storage"
+	"testing"
+)
+
+func newStorage(t *testing.T, cfg *storage.Config) storage.Storage {
+	s, err := storage.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	return s
+}
+
+func TestMigrate(t *testing.T) {
+	from := newStorage(t, &storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-migrate-test"}})
+	defer from.RemoveAll("/")
+	to := newStorage(t, &storage.Config{Type: "memory", Memory: &storage.Memory{}})
+	checkpointFile := "/tmp/go-docker-registry-migrate-test.json"
+	os.Remove(checkpointFile)
+	defer os.Remove(checkpointFile)
+
+	from.Put(storage.ImageJsonPath("base"), []byte(`{"id":"base"}`))
+	from.Put(storage.ImageLayerPath("base"), []byte("layer of base"))
+	from.Put(storage.ImageJsonPath("pushing"), []byte(`{"id":"pushing"}`))
+	from.Put(storage.ImageMarkPath("pushing"), []byte("true"))
+	from.Put(storage.RepoTagPath("library", "app", "latest"), []byte("base"))
+	from.Put(storage.RepoTagPath("library", "app", "old"), []byte("base"))
+	from.Put(storage.StatusProbePath("1"), []byte("probe"))
+
+	report, err := Migrate(from, to, checkpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Keys != 6 || report.Copied != 6 || len(report.Errors) != 0 {
+		t.Fatalf("Expected every key but the probe to be copied, got %+v", report)
+	}
+	if content, _ := to.Get(storage.ImageLayerPath("base")); string(content) != "layer of base" {
+		t.Fatalf("The layer should have been copied, got %q", content)
+	}
+	if exists, _ := to.Exists(storage.StatusProbePath("1")); exists {
+		t.Fatal("Status probes should not be copied")
+	}
+
+	// what changes while the registry keeps serving from the old storage
+	from.Put(storage.RepoTagPath("library", "app", "latest"), []byte("next"))
+	from.Remove(storage.RepoTagPath("library", "app", "old"))
+	from.Put(storage.ImageLayerPath("pushing"), []byte("layer of pushing"))
+	from.Remove(storage.ImageMarkPath("pushing"))
+
+	if report, err = Migrate(from, to, checkpointFile); err != nil {
+		t.Fatal(err)
+	}
+	// the tag that changed and the image that was being pushed. its mark and the old tag are removed
+	if report.Copied != 3 || report.Unchanged != 2 || report.Removed != 2 || len(report.Errors) != 0 {
+		t.Fatalf("Expected 3 copied, 2 unchanged and 2 removed, got %+v", report)
+	}
+	if content, _ := to.Get(storage.RepoTagPath("library", "app", "latest")); string(content) != "next" {
+		t.Fatalf("The changed tag should have been copied, got %q", content)
+	}
+	if exists, _ := to.Exists(storage.RepoTagPath("library", "app", "old")); exists {
+		t.Fatal("The removed tag should have been removed")
+	}
+	if exists, _ := to.Exists(storage.ImageMarkPath("pushing")); exists {
+		t.Fatal("The finished upload should not be marked in progress anymore")
+	}
+
+	// a key that can't be read looks just like one that is gone, so nothing is removed while anything fails
+	from.Remove(storage.RepoTagPath("library", "app", "latest"))
+	from.Put(storage.RepoJsonPath("library", "app"), []byte("{}"))
+	unreadable := &unreadableStorage{from, storage.RepoJsonPath("library", "app")}
+	checkpoint, _ := LoadCheckpoint(checkpointFile)
+	checkpoint.From = storage.Identity(unreadable)
+	checkpoint.Save(checkpointFile)
+	if report, err = Migrate(unreadable, to, checkpointFile); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) != 1 || report.Removed != 0 || !report.SkippedRemoval {
+		t.Fatalf("Expected the removal to be skipped, got %+v", report)
+	}
+	if exists, _ := to.Exists(storage.RepoTagPath("library", "app", "latest")); !exists {
+		t.Fatal("Nothing should have been removed")
+	}
+
+	checkpoint.From = storage.Identity(from)
+	checkpoint.Save(checkpointFile)
+	if _, err := Migrate(to, from, checkpointFile); err == nil {
+		t.Fatal("A checkpoint should only be used for the migration it was made for")
+	}
+	other := newStorage(t, &storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-migrate-test-other"}})
+	defer other.RemoveAll("/")
+	if _, err := Migrate(other, to, checkpointFile); err == nil {
+		t.Fatal("A checkpoint should not be used for another storage of the same type")
+	}
+}
+
+type unreadableStorage struct {
+	storage.Storage
+	unreadable string
+}
+
+func (s *unreadableStorage) GetReader(relpath string) (io.ReadCloser, error) {
+	if relpath == s.unreadable {
+		return nil, errors.New("connection reset")
+	}
+	return s.Storage.GetReader(relpath)
+}
@@ -0,0 +1,318 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"registry/layers"
+	"registry/logger"
+	"registry/storage"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DEFAULT_TAG_TTL = 5 * time.Minute
+
+// how many repositories upstream doesn't have are remembered at most
+const MAX_MISSES = 10000
+
+var ErrNotFound = errors.New("Not found upstream")
+var ErrChecksumMismatch = errors.New("Layer doesn't match the upstream checksum")
+
+type Config struct {
+	Upstream string `json:"upstream"` // base url of the registry to mirror, e.g. "https://registry.example.com"
+	TagTTL   string `json:"tag_ttl"`  // how long mirrored tags are served before asking upstream again (default "5m")
+	Username string `json:"username"` // basic auth for the upstream, if it needs it
+	Password string `json:"password"`
+}
+
+// A Mirror fills storage from an upstream registry on demand. Images never change once pushed, so they are fetched
+// once and served locally from then on. Tags are refreshed once they are older than the tag TTL, and repositories
+// upstream doesn't have aren't asked for again until the tag TTL has passed either.
+type Mirror struct {
+	*Config
+	Storage    storage.Storage
+	client     *http.Client
+	tagTTL     time.Duration
+	missesLock sync.Mutex
+	misses     map[string]time.Time // repository -> when upstream didn't have it
+	fetchLock  sync.Mutex
+	fetching   map[string]bool // images whose layer is being stored
+}
+
+func New(cfg *Config, s storage.Storage) *Mirror {
+	tagTTL := DEFAULT_TAG_TTL
+	if cfg.TagTTL != "" {
+		ttl, err := time.ParseDuration(cfg.TagTTL)
+		if err != nil {
+			logger.Error("[Mirror] Invalid tag_ttl %q, using %s: %s", cfg.TagTTL, DEFAULT_TAG_TTL, err.Error())
+		} else {
+			tagTTL = ttl
+		}
+	}
+	return &Mirror{Config: cfg, Storage: s, client: &http.Client{}, tagTTL: tagTTL, misses: map[string]time.Time{},
+		fetching: map[string]bool{}}
+}
+
+// claims the storing of the layer of imageID. false if it is already being stored.
+func (m *Mirror) startFetch(imageID string) bool {
+	m.fetchLock.Lock()
+	defer m.fetchLock.Unlock()
+	if m.fetching[imageID] {
+		return false
+	}
+	m.fetching[imageID] = true
+	return true
+}
+
+func (m *Mirror) finishFetch(imageID string) {
+	m.fetchLock.Lock()
+	defer m.fetchLock.Unlock()
+	delete(m.fetching, imageID)
+}
+
+// whether upstream didn't have the repository less than the tag TTL ago
+func (m *Mirror) missed(repo string) bool {
+	m.missesLock.Lock()
+	defer m.missesLock.Unlock()
+	missedAt, ok := m.misses[repo]
+	if ok && time.Since(missedAt) >= m.tagTTL {
+		delete(m.misses, repo)
+		return false
+	}
+	return ok
+}
+
+func (m *Mirror) miss(repo string) {
+	m.missesLock.Lock()
+	defer m.missesLock.Unlock()
+	if len(m.misses) >= MAX_MISSES {
+		for missed, missedAt := range m.misses {
+			if time.Since(missedAt) >= m.tagTTL {
+				delete(m.misses, missed)
+			}
+		}
+		if len(m.misses) >= MAX_MISSES {
+			// still full, ask upstream every time rather than grow without bound
+			return
+		}
+	}
+	m.misses[repo] = time.Now()
+}
+
+func (m *Mirror) get(relpath string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(m.Upstream, "/")+relpath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if m.Username != "" {
+		req.SetBasicAuth(m.Username, m.Password)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("Upstream returned %s for %s", resp.Status, relpath)
+}
+
+func (m *Mirror) getBytes(relpath string) ([]byte, http.Header, error) {
+	resp, err := m.get(relpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, resp.Header, err
+}
+
+// FetchImageJson fetches the json of imageID from upstream and stores it, along with its checksum if upstream has one
+func (m *Mirror) FetchImageJson(imageID string) ([]byte, error) {
+	logger.Debug("[Mirror] fetching json of %s", imageID)
+	data, header, err := m.getBytes("/v1/images/" + imageID + "/json")
+	if err != nil {
+		return nil, err
+	}
+	if checksum := header.Get("X-Docker-Checksum"); checksum != "" {
+		if err := layers.StoreChecksum(m.Storage, imageID, checksum); err != nil {
+			logger.Error("[Mirror] error storing checksum of %s: %s", imageID, err.Error())
+		}
+	}
+	return data, m.Storage.Put(storage.ImageJsonPath(imageID), data)
+}
+
+func (m *Mirror) FetchImageAncestry(imageID string) ([]byte, error) {
+	logger.Debug("[Mirror] fetching ancestry of %s", imageID)
+	data, _, err := m.getBytes("/v1/images/" + imageID + "/ancestry")
+	if err != nil {
+		return nil, err
+	}
+	return data, m.Storage.Put(storage.ImageAncestryPath(imageID), data)
+}
+
+// keeps the layer going into storage if the client goes away
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *clientWriter) Write(p []byte) (int, error) {
+	if c.err == nil {
+		_, c.err = c.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// FetchImageLayer fetches the layer of imageID from upstream and stores it. Once upstream has answered, start is
+// called with the size of the layer (-1 if unknown) and the layer is copied to the writer it returns while it is
+// being stored. The image is marked as in progress until the layer is stored and matches the checksum upstream gave
+// for the image (if it gave one), so nothing serves half of it or a corrupt one. While the layer is being stored
+// (by this registry or, going by the mark, another one sharing the storage), it is only passed through.
+func (m *Mirror) FetchImageLayer(imageID string, start func(size int64) io.Writer) error {
+	logger.Debug("[Mirror] fetching layer of %s", imageID)
+	jsonContent, err := m.Storage.Get(storage.ImageJsonPath(imageID))
+	if storage.IsNotFound(err) {
+		jsonContent, err = m.FetchImageJson(imageID)
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := m.get("/v1/images/" + imageID + "/layer")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !m.startFetch(imageID) {
+		_, err := io.Copy(start(resp.ContentLength), resp.Body)
+		return err
+	}
+	defer m.finishFetch(imageID)
+	markPath := storage.ImageMarkPath(imageID)
+	mark := []byte(time.Now().UTC().Format(time.RFC3339))
+	if err := m.Storage.PutIfVersion(markPath, mark, ""); storage.IsConflict(err) {
+		_, err := io.Copy(start(resp.ContentLength), resp.Body)
+		return err
+	} else if err != nil {
+		return err
+	}
+	client := &clientWriter{w: start(resp.ContentLength)}
+	// checksum the layer as it is stored, the same way a pushed one is
+	sha256Writer := sha256.New()
+	sha256Writer.Write(jsonContent)
+	tarInfo := layers.NewTarInfo()
+	tarReader, tarWriter := io.Pipe()
+	loaded := make(chan bool)
+	go func() {
+		tarInfo.LoadReader(tarReader)
+		io.Copy(ioutil.Discard, tarReader)
+		close(loaded)
+	}()
+	layerPath := storage.ImageLayerPath(imageID)
+	body := io.TeeReader(resp.Body, io.MultiWriter(sha256Writer, tarWriter, client))
+	err = m.Storage.PutReader(layerPath, body, func(io.ReadSeeker) {})
+	tarWriter.CloseWithError(err)
+	<-loaded
+	if err == nil {
+		if err = m.checkLayer(imageID, jsonContent, "sha256:"+hex.EncodeToString(sha256Writer.Sum(nil)), tarInfo); err != nil {
+			m.Storage.Remove(layerPath)
+		}
+	}
+	if err != nil {
+		// unless someone else has taken over the upload since
+		if content, _ := m.Storage.Get(markPath); string(content) == string(mark) {
+			m.Storage.Remove(markPath)
+		}
+		return err
+	}
+	return layers.ClearMark(m.Storage, imageID)
+}
+
+// checks a stored layer against the checksum upstream gave with the json of the image
+func (m *Mirror) checkLayer(imageID string, jsonContent []byte, sha256Sum string, tarInfo *layers.TarInfo) error {
+	checksum, err := m.Storage.Get(storage.ImageChecksumPath(imageID))
+	if storage.IsNotFound(err) {
+		// nothing to check it against
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if string(checksum) == sha256Sum || (tarInfo.Error == nil && string(checksum) == tarInfo.TarSum.Compute(jsonContent)) {
+		return nil
+	}
+	logger.Debug("[Mirror][%s] wrong checksum: %s is neither %s nor the tarsum", imageID, checksum, sha256Sum)
+	return ErrChecksumMismatch
+}
+
+// RefreshRepoTags replaces the repository's tags with the ones upstream has, unless they were fetched less than the
+// tag TTL ago.
+func (m *Mirror) RefreshRepoTags(namespace, repo string) error {
+	mirroredPath := storage.RepoMirroredPath(namespace, repo)
+	if content, err := m.Storage.Get(mirroredPath); err == nil {
+		if fetched, err := time.Parse(time.RFC3339, string(content)); err == nil && time.Since(fetched) < m.tagTTL {
+			return nil
+		}
+	}
+	if m.missed(namespace + "/" + repo) {
+		return ErrNotFound
+	}
+	logger.Debug("[Mirror] fetching tags of %s/%s", namespace, repo)
+	data, _, err := m.getBytes("/v1/repositories/" + namespace + "/" + repo + "/tags")
+	if err == ErrNotFound {
+		m.miss(namespace + "/" + repo)
+		return err
+	} else if err != nil {
+		return err
+	}
+	var tags map[string]string
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return err
+	}
+	current, err := layers.ListTags(m.Storage, namespace, repo)
+	if err != nil {
+		current = map[string]string{}
+	}
+	for tag, imageID := range tags {
+		if current[tag] == imageID {
+			continue
+		}
+		if err := layers.AddTaggedImage(m.Storage, namespace, repo, imageID); err != nil {
+			return err
+		}
+		err := storage.Update(m.Storage, storage.RepoTagPath(namespace, repo, tag), func(content []byte) ([]byte, error) {
+			if string(content) == imageID {
+				return nil, nil
+			}
+			return []byte(imageID), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for tag, imageID := range current {
+		if _, ok := tags[tag]; ok {
+			continue
+		}
+		// gone upstream, unless it was written meanwhile
+		tagPath := storage.RepoTagPath(namespace, repo, tag)
+		if content, err := m.Storage.Get(tagPath); err != nil || string(content) != imageID {
+			continue
+		}
+		if err := m.Storage.Remove(tagPath); err != nil && !storage.IsNotFound(err) {
+			return err
+		}
+	}
+	return m.Storage.Put(mirroredPath, []byte(time.Now().UTC().Format(time.RFC3339)))
+}
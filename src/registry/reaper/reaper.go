@@ -0,0 +1,245 @@
+package reaper
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"registry/layers"
+	"registry/logger"
+	"registry/storage"
+	"sort"
+	"time"
+)
+
+// A push that dies between putting an image's json and its checksum leaves the image marked as in progress
+// forever, and pulls of it (and everything built on it) fail with "Image is being uploaded". The reaper removes
+// images whose upload started more than MaxAge ago, or moves them under storage.QuarantineDir to be looked at. It
+// also removes resumable upload sessions (uploads/) that stopped receiving chunks more than MaxAge ago.
+
+const DEFAULT_MAX_AGE = 24 * time.Hour
+
+type Config struct {
+	Interval   string `json:"interval"`   // how often to look for abandoned uploads (e.g. "1h"). empty disables it.
+	MaxAge     string `json:"max_age"`    // how long an upload may take before it is abandoned (default "24h")
+	Quarantine bool   `json:"quarantine"` // move abandoned images to quarantine/ instead of removing them
+}
+
+func (c *Config) ParseMaxAge() (time.Duration, error) {
+	if c.MaxAge == "" {
+		return DEFAULT_MAX_AGE, nil
+	}
+	return time.ParseDuration(c.MaxAge)
+}
+
+type Upload struct {
+	ImageID   string     `json:"image_id"`
+	StartedAt *time.Time `json:"started_at"` // nil for marks from older versions, until the reaper has seen them
+	Age       string     `json:"age,omitempty"`
+}
+
+type Report struct {
+	Quarantine bool      `json:"quarantine"`
+	StartedAt  time.Time `json:"started_at"`
+	Duration   string    `json:"duration"`
+	InProgress int       `json:"in_progress"`
+	Reaped     []string  `json:"reaped"`
+	Sessions   []string  `json:"sessions"` // upload sessions (uploads/{uuid}) removed
+	Errors     []string  `json:"errors"`
+}
+
+func (r *Report) addError(format string, args ...interface{}) {
+	logger.Error("[Reaper] "+format, args...)
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// ids of the images that are marked as in progress
+func MarkedImages(s storage.Storage) ([]string, error) {
+	imagePaths, err := s.List("images")
+	if storage.IsNotFound(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, imagePath := range imagePaths {
+		imageID := path.Base(imagePath)
+		if exists, _ := s.Exists(storage.ImageMarkPath(imageID)); exists {
+			ids = append(ids, imageID)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// List returns the uploads in progress, oldest first (those without a start time last)
+func List(s storage.Storage) ([]Upload, error) {
+	ids, err := MarkedImages(s)
+	if err != nil {
+		return nil, err
+	}
+	uploads := []Upload{}
+	for _, imageID := range ids {
+		markedAt, ok, err := layers.MarkedAt(s, imageID)
+		if storage.IsNotFound(err) || storage.IsConflict(err) {
+			// finished or finishing meanwhile
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		upload := Upload{ImageID: imageID}
+		if ok {
+			upload.StartedAt = &markedAt
+			upload.Age = time.Since(markedAt).String()
+		}
+		uploads = append(uploads, upload)
+	}
+	sort.Stable(byStart(uploads))
+	return uploads, nil
+}
+
+type byStart []Upload
+
+func (u byStart) Len() int      { return len(u) }
+func (u byStart) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u byStart) Less(i, j int) bool {
+	return u[i].StartedAt != nil && (u[j].StartedAt == nil || u[i].StartedAt.Before(*u[j].StartedAt))
+}
+
+// Abort removes the image being uploaded, or moves it to quarantine. Images that aren't marked as in progress
+// are complete and can't be aborted.
+func Abort(s storage.Storage, imageID string, quarantine bool) error {
+	return abort(s, imageID, quarantine, 0)
+}
+
+// aborts the upload unless its mark says it started (or made progress) less than maxAge ago. The mark is claimed
+// before anything is removed, so an upload that completes or makes progress meanwhile fails this with a conflict
+// instead of being removed from under its client.
+func abort(s storage.Storage, imageID string, quarantine bool, maxAge time.Duration) error {
+	markedAt, ok, version, err := layers.GetMark(s, imageID)
+	if err != nil {
+		return err
+	}
+	if ok && time.Since(markedAt) < maxAge {
+		return &storage.Error{Kind: storage.ErrConflict, Path: storage.ImageMarkPath(imageID)}
+	}
+	if err := layers.AbortMark(s, imageID, version); err != nil {
+		return err
+	}
+	if quarantine {
+		if err := moveToQuarantine(s, imageID); err != nil {
+			return err
+		}
+	}
+	return s.RemoveAll(storage.ImageDir(imageID))
+}
+
+// copies everything in the image's directory (which has no subdirectories) under storage.QuarantineDir. the
+// image is removed by the caller.
+func moveToQuarantine(s storage.Storage, imageID string) error {
+	files, err := s.List(storage.ImageDir(imageID))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := path.Base(file)
+		if err := copyFile(s, path.Join(storage.ImageDir(imageID), name),
+			path.Join(storage.QuarantineDir(imageID), name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(s storage.Storage, from, to string) error {
+	reader, err := s.GetReader(from)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return s.PutReader(to, reader, func(io.ReadSeeker) {})
+}
+
+// Reap aborts the uploads that started more than maxAge ago. Marks without a start time are given the current
+// time, so they are reaped maxAge after the first run that sees them.
+func Reap(s storage.Storage, maxAge time.Duration, quarantine bool) (*Report, error) {
+	report := &Report{Quarantine: quarantine, StartedAt: time.Now().UTC(), Reaped: []string{}, Sessions: []string{},
+		Errors: []string{}}
+	ids, err := MarkedImages(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, imageID := range ids {
+		markedAt, err := layers.StampMark(s, imageID)
+		if storage.IsNotFound(err) {
+			continue
+		} else if storage.IsConflict(err) {
+			// being completed
+			report.InProgress++
+			continue
+		} else if err != nil {
+			report.addError("%s: error reading mark: %s", imageID, err.Error())
+			continue
+		}
+		if time.Since(markedAt) < maxAge {
+			report.InProgress++
+			continue
+		}
+		if err := abort(s, imageID, quarantine, maxAge); storage.IsNotFound(err) {
+			continue
+		} else if storage.IsConflict(err) {
+			// finished or made progress since it was looked at
+			report.InProgress++
+			continue
+		} else if err != nil {
+			report.addError("%s: error aborting upload: %s", imageID, err.Error())
+			continue
+		}
+		logger.Info("[Reaper] %s: upload started at %s was abandoned", imageID, markedAt.Format(time.RFC3339))
+		report.Reaped = append(report.Reaped, imageID)
+	}
+	if err := reapSessions(s, maxAge, report); err != nil {
+		return nil, err
+	}
+	report.Duration = time.Since(report.StartedAt).String()
+	logger.Info("[Reaper] quarantine=%t; in_progress=%d; reaped=%d; sessions=%d; errors=%d", quarantine,
+		report.InProgress, len(report.Reaped), len(report.Sessions), len(report.Errors))
+	return report, nil
+}
+
+// removes the resumable upload sessions that haven't received a chunk for more than maxAge, and those without a state
+// (which can't be resumed)
+func reapSessions(s storage.Storage, maxAge time.Duration, report *Report) error {
+	sessions, err := s.List("uploads")
+	if storage.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		uuid := path.Base(session)
+		upload, err := layers.GetUpload(s, uuid)
+		if err == nil && time.Since(upload.LastActive()) < maxAge {
+			continue
+		} else if err != nil && !storage.IsNotFound(err) {
+			report.addError("%s: error reading upload state: %s", session, err.Error())
+			continue
+		}
+		if err := s.RemoveAll(storage.UploadPath(uuid)); err != nil && !storage.IsNotFound(err) {
+			report.addError("%s: error removing upload session: %s", session, err.Error())
+			continue
+		}
+		logger.Info("[Reaper] %s: upload session was abandoned", session)
+		report.Sessions = append(report.Sessions, uuid)
+	}
+	return nil
+}
+
+// Run Reap every interval, forever. Meant to be started in its own goroutine.
+func Schedule(s storage.Storage, interval, maxAge time.Duration, quarantine bool) {
+	for {
+		time.Sleep(interval)
+		if _, err := Reap(s, maxAge, quarantine); err != nil {
+			logger.Error("[Reaper] error reaping: %s", err.Error())
+		}
+	}
+}
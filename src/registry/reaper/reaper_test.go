@@ -0,0 +1,162 @@
+package reaper
+
+import (
+	"registry/layers"
+	"registry/storage"
+	"testing"
+	"time"
+)
+
+func TestReap(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-reaper-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	for _, id := range []string{"complete", "abandoned", "legacy", "uploading"} {
+		s.Put(storage.ImageJsonPath(id), []byte(`{"id":"`+id+`"}`))
+	}
+	s.Put(storage.ImageLayerPath("abandoned"), []byte("half a layer"))
+	s.Put(storage.ImageMarkPath("abandoned"), []byte(time.Now().Add(-48*time.Hour).UTC().Format(time.RFC3339)))
+	s.Put(storage.ImageMarkPath("legacy"), []byte("true"))
+	if err := layers.MarkInProgress(s, "uploading"); err != nil {
+		t.Fatal(err)
+	}
+
+	uploads, err := List(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 3 || uploads[0].ImageID != "abandoned" || uploads[1].ImageID != "uploading" ||
+		uploads[2].ImageID != "legacy" || uploads[2].StartedAt != nil {
+		t.Fatalf("Expected abandoned, uploading and legacy (without a start), got %+v", uploads)
+	}
+
+	report, err := Reap(s, DEFAULT_MAX_AGE, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Reaped) != 1 || report.Reaped[0] != "abandoned" || report.InProgress != 2 {
+		t.Fatalf("Only abandoned should be reaped, got %+v", report)
+	}
+	if exists, _ := s.Exists(storage.ImageDir("abandoned")); exists {
+		t.Fatal("abandoned should have been removed")
+	}
+	if content, err := s.Get(storage.QuarantineDir("abandoned") + "/layer"); err != nil || string(content) != "half a layer" {
+		t.Fatalf("abandoned should have been quarantined, got %q, %v", content, err)
+	}
+	if _, ok, _ := layers.MarkedAt(s, "legacy"); !ok {
+		t.Fatal("The legacy mark should have been given a start time")
+	}
+
+	// the legacy mark is reaped max age after it was first seen
+	time.Sleep(10 * time.Millisecond)
+	if report, err = Reap(s, 5*time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Reaped) != 2 {
+		t.Fatalf("legacy and uploading should be reaped, got %+v", report)
+	}
+	if exists, _ := s.Exists(storage.ImageDir("legacy")); exists {
+		t.Fatal("legacy should have been removed")
+	}
+	if exists, _ := s.Exists(storage.QuarantineDir("legacy")); exists {
+		t.Fatal("legacy should not have been quarantined")
+	}
+	if exists, _ := s.Exists(storage.ImageJsonPath("complete")); !exists {
+		t.Fatal("complete images should never be reaped")
+	}
+	if err := Abort(s, "complete", false); !storage.IsNotFound(err) {
+		t.Fatalf("Aborting a complete image should fail with not found, got %v", err)
+	}
+}
+
+func TestAbortClaimsTheMark(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-reaper-abort-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	s.Put(storage.ImageJsonPath("slow"), []byte(`{"id":"slow"}`))
+	s.Put(storage.ImageMarkPath("slow"), []byte(time.Now().Add(-48*time.Hour).UTC().Format(time.RFC3339)))
+	// a chunk arriving after the mark was read
+	_, _, version, err := layers.GetMark(s, "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := layers.RefreshMark(s, "slow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := layers.AbortMark(s, "slow", version); !storage.IsConflict(err) {
+		t.Fatalf("Aborting with a stale mark should conflict, got %v", err)
+	}
+	report, err := Reap(s, DEFAULT_MAX_AGE, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Reaped) != 0 || report.InProgress != 1 {
+		t.Fatalf("An upload that made progress should not be reaped, got %+v", report)
+	}
+
+	// an upload being completed can't be aborted
+	s.Put(storage.ImageMarkPath("slow"), []byte(layers.MARK_COMPLETING))
+	if err := Abort(s, "slow", false); !storage.IsConflict(err) {
+		t.Fatalf("Aborting an upload being completed should conflict, got %v", err)
+	}
+	s.Put(storage.ImageMarkPath("slow"), []byte(time.Now().Add(-48*time.Hour).UTC().Format(time.RFC3339)))
+	if err := Abort(s, "slow", true); err != nil {
+		t.Fatal(err)
+	}
+	// what a client completing the upload meanwhile runs into
+	s.Put(storage.ImageMarkPath("late"), []byte(layers.MARK_ABORTED))
+	if err := layers.ClearMark(s, "late"); err != layers.ErrUploadAborted {
+		t.Fatalf("Completing an aborted upload should fail, got %v", err)
+	}
+	if err := layers.RefreshMark(s, "late"); err != layers.ErrUploadAborted {
+		t.Fatalf("Continuing an aborted upload should fail, got %v", err)
+	}
+	// an abort that died halfway is finished by the next run
+	if report, err = Reap(s, DEFAULT_MAX_AGE, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Reaped) != 1 || report.Reaped[0] != "late" {
+		t.Fatalf("The aborted upload should be reaped, got %+v", report)
+	}
+}
+
+func TestReapSessions(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "local", Local: &storage.Local{Root: "/tmp/go-docker-registry-reaper-sessions-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemoveAll("/")
+	defer s.RemoveAll("/")
+
+	active, err := layers.NewUpload(s, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(storage.UploadChunkPath("stateless", 0, "chunk"), []byte("chunk"))
+	report, err := Reap(s, DEFAULT_MAX_AGE, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Sessions) != 1 || report.Sessions[0] != "stateless" {
+		t.Fatalf("Only the session without a state should be removed, got %+v", report)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if report, err = Reap(s, 5*time.Millisecond, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Sessions) != 1 || report.Sessions[0] != active.UUID {
+		t.Fatalf("The idle session should be removed, got %+v", report)
+	}
+	if exists, _ := s.Exists(storage.UploadPath(active.UUID)); exists {
+		t.Fatal("The idle session should be gone")
+	}
+}
@@ -0,0 +1,291 @@
+package scrub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"registry/layers"
+	"registry/logger"
+	"registry/storage"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A layer's checksum is only checked when it is pushed. The scrubber reads every layer back now and then and checks
+// it against its _checksum again, to find layers that rotted or were truncated in storage since. Layers found
+// corrupt are kept in storage.ScrubResultsPath until they check out again (or are removed), and can be refused to
+// pullers.
+
+type Config struct {
+	Interval  string `json:"interval"`   // time between passes over every layer (e.g. "24h"). empty disables it.
+	RateLimit int64  `json:"rate_limit"` // bytes per second read from storage. 0 for no limit
+	Block     bool   `json:"block"`      // refuse to serve layers found corrupt
+}
+
+type Result struct {
+	ImageID   string    `json:"image_id"`
+	CheckedAt time.Time `json:"checked_at"`
+	Problem   string    `json:"problem"`
+}
+
+type Status struct {
+	Running        bool      `json:"running"`
+	LastStartedAt  time.Time `json:"last_started_at"`
+	LastFinishedAt time.Time `json:"last_finished_at"`
+	Checked        int       `json:"checked"` // layers checked by the last (or current) pass
+	Skipped        int       `json:"skipped"` // being uploaded, without a checksum, or not readable right now
+	Bytes          int64     `json:"bytes"`
+	Corrupt        []Result  `json:"corrupt"`
+}
+
+type Scrubber struct {
+	*Config
+	Storage storage.Storage
+	lock    sync.Mutex
+	status  Status
+	corrupt map[string]Result
+}
+
+func New(cfg *Config, s storage.Storage) *Scrubber {
+	// through the cache it would check the cached copies (and fill the cache with every layer)
+	if cache, ok := s.(*storage.Cache); ok {
+		s = cache.Backend()
+	}
+	sc := &Scrubber{Config: cfg, Storage: s, corrupt: map[string]Result{}}
+	if content, err := s.Get(storage.ScrubResultsPath()); err == nil {
+		results := []Result{}
+		if err := json.Unmarshal(content, &results); err != nil {
+			logger.Error("[Scrub] error reading results: %s", err.Error())
+		}
+		for _, result := range results {
+			sc.corrupt[result.ImageID] = result
+		}
+	}
+	return sc
+}
+
+// Blocked is true if the layer of imageID was found corrupt and corrupt layers aren't served
+func (sc *Scrubber) Blocked(imageID string) bool {
+	if !sc.Block {
+		return false
+	}
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	_, corrupt := sc.corrupt[imageID]
+	return corrupt
+}
+
+func (sc *Scrubber) Status() Status {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	status := sc.status
+	status.Corrupt = sc.results()
+	return status
+}
+
+// must hold the lock
+func (sc *Scrubber) results() []Result {
+	results := make([]Result, 0, len(sc.corrupt))
+	for _, result := range sc.corrupt {
+		results = append(results, result)
+	}
+	sort.Sort(byImageID(results))
+	return results
+}
+
+type byImageID []Result
+
+func (r byImageID) Len() int           { return len(r) }
+func (r byImageID) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byImageID) Less(i, j int) bool { return r[i].ImageID < r[j].ImageID }
+
+// Pass checks the layer of every image once
+func (sc *Scrubber) Pass() error {
+	sc.lock.Lock()
+	sc.status = Status{Running: true, LastStartedAt: time.Now().UTC(), LastFinishedAt: sc.status.LastFinishedAt}
+	sc.lock.Unlock()
+	defer func() {
+		sc.lock.Lock()
+		sc.status.Running = false
+		sc.status.LastFinishedAt = time.Now().UTC()
+		sc.lock.Unlock()
+	}()
+	imagePaths, err := sc.Storage.List("images")
+	if storage.IsNotFound(err) {
+		imagePaths = []string{}
+	} else if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for _, imagePath := range imagePaths {
+		imageID := path.Base(imagePath)
+		exists[imageID] = true
+		problem, size, err := Verify(sc.Storage, imageID, sc.RateLimit)
+		sc.lock.Lock()
+		sc.status.Bytes += size
+		if err != nil {
+			if err != errSkipped {
+				logger.Error("[Scrub][%s] error checking layer: %s", imageID, err.Error())
+			}
+			sc.status.Skipped++
+			sc.lock.Unlock()
+			continue
+		}
+		sc.status.Checked++
+		_, wasCorrupt := sc.corrupt[imageID]
+		if problem != "" {
+			logger.Error("[Scrub][%s] layer is corrupt: %s", imageID, problem)
+			sc.corrupt[imageID] = Result{ImageID: imageID, CheckedAt: time.Now().UTC(), Problem: problem}
+		} else {
+			delete(sc.corrupt, imageID)
+		}
+		sc.lock.Unlock()
+		if problem != "" || wasCorrupt {
+			sc.save()
+		}
+	}
+	sc.lock.Lock()
+	for imageID, _ := range sc.corrupt {
+		if !exists[imageID] {
+			// removed since
+			delete(sc.corrupt, imageID)
+		}
+	}
+	status := sc.status
+	status.Corrupt = sc.results()
+	sc.lock.Unlock()
+	logger.Info("[Scrub] checked=%d; skipped=%d; bytes=%d; corrupt=%d", status.Checked, status.Skipped, status.Bytes,
+		len(status.Corrupt))
+	return sc.save()
+}
+
+func (sc *Scrubber) save() error {
+	sc.lock.Lock()
+	content, err := json.Marshal(sc.results())
+	sc.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := sc.Storage.Put(storage.ScrubResultsPath(), content); err != nil {
+		logger.Error("[Scrub] error saving results: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// Run a Pass, then wait interval before the next one, forever. Meant to be started in its own goroutine.
+func (sc *Scrubber) Run(interval time.Duration) {
+	for {
+		if err := sc.Pass(); err != nil {
+			logger.Error("[Scrub] error scrubbing: %s", err.Error())
+		}
+		time.Sleep(interval)
+	}
+}
+
+type skippedError string
+
+func (e skippedError) Error() string {
+	return string(e)
+}
+
+// images that can't be checked: being uploaded, or pushed without a checksum
+const errSkipped = skippedError("not checkable")
+
+// Verify reads the layer of imageID back (at no more than rateLimit bytes per second if it isn't 0) and checks its
+// sha256 and TarSum against the stored checksum. problem says what is wrong with the layer if anything. err is set
+// if it couldn't be checked, in which case nothing is known about it.
+func Verify(s storage.Storage, imageID string, rateLimit int64) (problem string, size int64, err error) {
+	if marked, _ := s.Exists(storage.ImageMarkPath(imageID)); marked {
+		return "", 0, errSkipped
+	}
+	return VerifyLayer(s, imageID, rateLimit)
+}
+
+// Like Verify, but checks images that are still marked as in progress too
+func VerifyLayer(s storage.Storage, imageID string, rateLimit int64) (problem string, size int64, err error) {
+	checksum, err := s.Get(storage.ImageChecksumPath(imageID))
+	if storage.IsNotFound(err) {
+		return "", 0, errSkipped
+	} else if err != nil {
+		return "", 0, err
+	}
+	jsonContent, err := s.Get(storage.ImageJsonPath(imageID))
+	if err != nil {
+		return "", 0, err
+	}
+	reader, err := s.GetReader(storage.ImageLayerPath(imageID))
+	if storage.IsNotFound(err) {
+		return "layer is missing", 0, nil
+	} else if err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+	// the sha256 is of the json followed by the layer, the TarSum is seeded with the json (see PutImageLayerHandler)
+	sha256Writer := sha256.New()
+	sha256Writer.Write(jsonContent)
+	counter := &countingReader{r: newRateLimitedReader(reader, rateLimit)}
+	tee := io.TeeReader(counter, sha256Writer)
+	tarInfo := layers.NewTarInfo()
+	tarInfo.LoadReader(tee)
+	// the end of the tar may not be the end of the layer
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return "", counter.n, err
+	}
+	checksums := map[string]bool{"sha256:" + hex.EncodeToString(sha256Writer.Sum(nil)): true}
+	if tarInfo.Error == nil {
+		checksums[tarInfo.TarSum.Compute(jsonContent)] = true
+	}
+	if checksums[string(checksum)] {
+		return "", counter.n, nil
+	}
+	if strings.HasPrefix(string(checksum), "tarsum") && tarInfo.Error != nil {
+		return "layer is not a readable tar: " + tarInfo.Error.Error(), counter.n, nil
+	}
+	return "checksum mismatch: expected " + string(checksum), counter.n, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sleeps as needed to keep reads under bytesPerSecond on average
+type rateLimitedReader struct {
+	r              io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	n              int64
+}
+
+func newRateLimitedReader(r io.Reader, bytesPerSecond int64) io.Reader {
+	if bytesPerSecond <= 0 {
+		return r
+	}
+	return &rateLimitedReader{r: r, bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.bytesPerSecond {
+		// so no single read is much over the limit
+		p = p[:r.bytesPerSecond]
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	due := time.Duration(float64(r.n) / float64(r.bytesPerSecond) * float64(time.Second))
+	if wait := due - time.Since(r.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
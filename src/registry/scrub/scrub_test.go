@@ -0,0 +1,134 @@
+package scrub
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"registry/layers"
+	"registry/storage"
+	"testing"
+	"time"
+)
+
+func makeLayer(t *testing.T, content string) []byte {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	if err := writer.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte(content))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// pushes an image with the sha256 checksum, or the TarSum if tarsum is set
+func putImage(t *testing.T, s storage.Storage, id string, layer []byte, tarsum bool) {
+	jsonContent := []byte(`{"id":"` + id + `"}`)
+	s.Put(storage.ImageJsonPath(id), jsonContent)
+	s.Put(storage.ImageLayerPath(id), layer)
+	sum := sha256.Sum256(append(jsonContent, layer...))
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+	if tarsum {
+		tarInfo := layers.NewTarInfo()
+		tarInfo.Load(bytes.NewReader(layer))
+		checksum = tarInfo.TarSum.Compute(jsonContent)
+	}
+	s.Put(storage.ImageChecksumPath(id), []byte(checksum))
+}
+
+func TestScrub(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "memory", Memory: &storage.Memory{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := makeLayer(t, "hello")
+	putImage(t, s, "good", layer, false)
+	putImage(t, s, "tarsum", layer, true)
+	putImage(t, s, "rotted", layer, false)
+	putImage(t, s, "truncated", layer, true)
+	s.Put(storage.ImageJsonPath("pushing"), []byte(`{"id":"pushing"}`))
+	layers.MarkInProgress(s, "pushing")
+
+	rotted := append([]byte{}, layer...)
+	rotted[len(rotted)/2] ^= 1
+	s.Put(storage.ImageLayerPath("rotted"), rotted)
+	// cut off in the middle of the file. the TarSum doesn't cover the padding after it
+	s.Put(storage.ImageLayerPath("truncated"), layer[:514])
+
+	scrubber := New(&Config{Block: true}, s)
+	if err := scrubber.Pass(); err != nil {
+		t.Fatal(err)
+	}
+	status := scrubber.Status()
+	if status.Checked != 4 || status.Skipped != 1 {
+		t.Fatalf("Expected 4 layers checked and the upload skipped, got %+v", status)
+	}
+	if len(status.Corrupt) != 2 || status.Corrupt[0].ImageID != "rotted" || status.Corrupt[1].ImageID != "truncated" {
+		t.Fatalf("Expected rotted and truncated to be corrupt, got %+v", status.Corrupt)
+	}
+	if !scrubber.Blocked("rotted") || scrubber.Blocked("good") {
+		t.Fatal("Only corrupt layers should be blocked")
+	}
+	// results survive a restart
+	if !New(&Config{Block: true}, s).Blocked("truncated") {
+		t.Fatal("The results should have been saved")
+	}
+	if New(&Config{}, s).Blocked("truncated") {
+		t.Fatal("Nothing should be blocked unless block is set")
+	}
+
+	// repaired and removed layers are cleared on the next pass
+	s.Put(storage.ImageLayerPath("rotted"), layer)
+	s.RemoveAll(storage.ImageDir("truncated"))
+	if err := scrubber.Pass(); err != nil {
+		t.Fatal(err)
+	}
+	if status := scrubber.Status(); len(status.Corrupt) != 0 || scrubber.Blocked("rotted") {
+		t.Fatalf("Nothing should be corrupt anymore, got %+v", status.Corrupt)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "memory", Memory: &storage.Memory{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := makeLayer(t, "hello")
+	putImage(t, s, "image", layer, false)
+	start := time.Now()
+	problem, size, err := Verify(s, "image", int64(len(layer))*10)
+	if err != nil || problem != "" || size != int64(len(layer)) {
+		t.Fatalf("Expected a good layer of %d bytes, got %q, %d, %v", len(layer), problem, size, err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("Reading at 10 layers per second should take 100ms, took %s", elapsed)
+	}
+}
+
+func TestScrubChecksTheBackend(t *testing.T) {
+	backend := &storage.Memory{}
+	s, err := storage.New(&storage.Config{Type: "memory", Memory: backend, Cache: &storage.Cache{
+		Root: "/tmp/go-docker-registry-scrub-cache-test",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("/tmp/go-docker-registry-scrub-cache-test")
+	layer := makeLayer(t, "hello")
+	putImage(t, s, "cached", layer, false)
+	s.Get(storage.ImageLayerPath("cached"))
+	// rots in the backend, behind the cache's back
+	backend.Put(storage.ImageLayerPath("cached"), layer[:len(layer)/2])
+
+	scrubber := New(&Config{}, s)
+	if err := scrubber.Pass(); err != nil {
+		t.Fatal(err)
+	}
+	if status := scrubber.Status(); len(status.Corrupt) != 1 {
+		t.Fatalf("Expected the layer rotted in the backend to be found, got %+v", status)
+	}
+}
@@ -0,0 +1,386 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"registry/logger"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// only these files of an image are cached (and the data of blobs). they don't change once pushed, so a copy can't
+// go stale behind the cache's back even when other registries write to the same backend. the rest of an image
+// (_inprogress, _checksum, ...) does change.
+var CACHE_IMAGE_FILES = []string{"layer", "json", "ancestry"}
+
+var errIncompleteRead = errors.New("read did not reach the end")
+
+// Cache wraps another storage (set with Cache in Config) and keeps copies of what is read from it on local disk,
+// evicting the least recently used once it holds more than MaxSize bytes. Writes and removes through the cache
+// go to the backend and drop the cached copy.
+type Cache struct {
+	Root    string `json:"root"`
+	MaxSize int64  `json:"max_size"` // in bytes. 0 for no limit
+
+	backend Storage
+	disk    *Local
+	lock    sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	filling map[string]*cacheFill
+	stats   CacheStats
+}
+
+type CacheStats struct {
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRate   float64 `json:"hit_rate"`
+	Evictions int64   `json:"evictions"`
+	Files     int     `json:"files"`
+	Size      int64   `json:"size"`
+	MaxSize   int64   `json:"max_size"`
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// a copy being made. if the key is written or removed meanwhile the copy may be of the old content, so it is
+// thrown away.
+type cacheFill struct {
+	stale bool
+}
+
+func (c *Cache) Init() error {
+	if c.backend == nil {
+		return errors.New("Cache has no storage to wrap")
+	}
+	if c.Root == "" {
+		return errors.New("Cache Root must be set")
+	}
+	if c.MaxSize < 0 {
+		return errors.New("Cache Max Size can't be negative")
+	}
+	c.disk = &Local{Root: c.Root}
+	if err := c.disk.Init(); err != nil {
+		return err
+	}
+	c.lru = list.New()
+	c.entries = map[string]*list.Element{}
+	c.filling = map[string]*cacheFill{}
+	return c.load()
+}
+
+// picks up what an earlier run left in the cache, most recently used (touched) first
+func (c *Cache) load() error {
+	files := cachedFiles{}
+	err := filepath.Walk(c.Root, func(abspath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), LOCAL_TEMP_PREFIX) {
+			return nil
+		}
+		rel, err := filepath.Rel(c.Root, abspath)
+		if err != nil {
+			return err
+		}
+		files = append(files, cachedFile{key: filepath.ToSlash(rel), info: info})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Sort(files)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, file := range files {
+		c.entries[file.key] = c.lru.PushBack(&cacheEntry{key: file.key, size: file.info.Size()})
+		c.stats.Size += file.info.Size()
+	}
+	c.evict()
+	if len(files) > 0 {
+		logger.Info("[Cache] loaded %d files (%d bytes) from %s", c.lru.Len(), c.stats.Size, c.Root)
+	}
+	return nil
+}
+
+type cachedFile struct {
+	key  string
+	info os.FileInfo
+}
+
+// newest first
+type cachedFiles []cachedFile
+
+func (f cachedFiles) Len() int           { return len(f) }
+func (f cachedFiles) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f cachedFiles) Less(i, j int) bool { return f[i].info.ModTime().After(f[j].info.ModTime()) }
+
+// Backend returns the storage being cached
+func (c *Cache) Backend() Storage {
+	return c.backend
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := c.stats
+	stats.Files = c.lru.Len()
+	stats.MaxSize = c.MaxSize
+	if reads := stats.Hits + stats.Misses; reads > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(reads)
+	}
+	return stats
+}
+
+func cacheKey(relpath string) (string, bool) {
+	key := strings.TrimPrefix(path.Clean("/"+relpath), "/")
+	parts := strings.Split(key, "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "images":
+		for _, name := range CACHE_IMAGE_FILES {
+			if parts[2] == name {
+				return key, true
+			}
+		}
+	case len(parts) == 4 && parts[0] == "blobs" && parts[3] == "data":
+		return key, true
+	}
+	return key, false
+}
+
+// must hold the lock. drops least recently used entries until the cache fits.
+func (c *Cache) evict() {
+	for c.MaxSize > 0 && c.stats.Size > c.MaxSize && c.lru.Len() > 0 {
+		c.drop(c.lru.Back().Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// must hold the lock
+func (c *Cache) drop(key string) {
+	element, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(element)
+	delete(c.entries, key)
+	c.stats.Size -= element.Value.(*cacheEntry).size
+	if err := c.disk.Remove(key); err != nil {
+		logger.Error("[Cache] error removing %s: %s", key, err.Error())
+	}
+}
+
+// returns the key if it is cached, marking it used
+func (c *Cache) lookup(relpath string) (string, bool) {
+	key, cacheable := cacheKey(relpath)
+	if !cacheable {
+		return key, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return key, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(element)
+	// so the order survives a restart
+	now := time.Now()
+	os.Chtimes(path.Join(c.Root, key), now, now)
+	return key, true
+}
+
+// starts a copy of key unless one is already being made
+func (c *Cache) startFill(key string) *cacheFill {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.filling[key]; ok {
+		return nil
+	}
+	fill := &cacheFill{}
+	c.filling[key] = fill
+	return fill
+}
+
+// called once the copy of key is on disk (written is false if it failed). indexes it unless it went stale.
+func (c *Cache) finishFill(key string, fill *cacheFill, size int64, written bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.filling, key)
+	if !written {
+		return
+	}
+	if fill.stale || (c.MaxSize > 0 && size > c.MaxSize) {
+		c.disk.Remove(key)
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		// cached by a read that missed just before this one, and the file was replaced. don't remove it.
+		c.lru.Remove(element)
+		c.stats.Size -= element.Value.(*cacheEntry).size
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: size})
+	c.stats.Size += size
+	c.evict()
+}
+
+// drops the cached copies of relpath (and everything under it if all is set), and any copies being made of them
+func (c *Cache) invalidate(relpath string, all bool) {
+	key, _ := cacheKey(relpath)
+	matches := func(other string) bool {
+		return other == key || (all && (key == "" || strings.HasPrefix(other, key+"/")))
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for other, fill := range c.filling {
+		if matches(other) {
+			fill.stale = true
+		}
+	}
+	for other, _ := range c.entries {
+		if matches(other) {
+			c.drop(other)
+		}
+	}
+}
+
+func (c *Cache) Get(relpath string) ([]byte, error) {
+	key, hit := c.lookup(relpath)
+	if hit {
+		if data, err := c.disk.Get(key); err == nil {
+			return data, nil
+		}
+		// gone from disk somehow
+		c.invalidate(relpath, false)
+	}
+	fill := (*cacheFill)(nil)
+	if _, cacheable := cacheKey(relpath); cacheable {
+		fill = c.startFill(key)
+	}
+	data, err := c.backend.Get(relpath)
+	if fill != nil {
+		written := err == nil && c.disk.Put(key, data) == nil
+		c.finishFill(key, fill, int64(len(data)), written)
+	}
+	return data, err
+}
+
+func (c *Cache) Put(relpath string, data []byte) error {
+	defer c.invalidate(relpath, false)
+	return c.backend.Put(relpath, data)
+}
+
+func (c *Cache) GetVersion(relpath string) ([]byte, string, error) {
+	return c.backend.GetVersion(relpath)
+}
+
+func (c *Cache) PutIfVersion(relpath string, data []byte, version string) error {
+	defer c.invalidate(relpath, false)
+	return c.backend.PutIfVersion(relpath, data, version)
+}
+
+// copies what is read from the backend to the cache. the copy is kept if the reader is read to the end.
+type cacheFillReader struct {
+	io.ReadCloser
+	cache    *Cache
+	key      string
+	fill     *cacheFill
+	pipe     *io.PipeWriter
+	size     int64
+	complete bool
+	done     chan error
+}
+
+func (r *cacheFillReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.size += int64(n)
+		r.pipe.Write(p[:n])
+	}
+	if err == io.EOF {
+		r.complete = true
+	}
+	return n, err
+}
+
+func (r *cacheFillReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.complete {
+		r.pipe.Close()
+	} else {
+		r.pipe.CloseWithError(errIncompleteRead)
+	}
+	written := <-r.done == nil
+	r.cache.finishFill(r.key, r.fill, r.size, written)
+	return err
+}
+
+func (c *Cache) GetReader(relpath string) (io.ReadCloser, error) {
+	key, hit := c.lookup(relpath)
+	if hit {
+		if reader, err := c.disk.GetReader(key); err == nil {
+			return reader, nil
+		}
+		c.invalidate(relpath, false)
+	}
+	fill := (*cacheFill)(nil)
+	if _, cacheable := cacheKey(relpath); cacheable {
+		fill = c.startFill(key)
+	}
+	reader, err := c.backend.GetReader(relpath)
+	if fill == nil {
+		return reader, err
+	}
+	if err != nil {
+		c.finishFill(key, fill, 0, false)
+		return nil, err
+	}
+	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := c.disk.PutReader(key, pipeReader, func(io.ReadSeeker) {})
+		// stop the pipe blocking the client if the disk write failed
+		pipeReader.CloseWithError(err)
+		done <- err
+	}()
+	return &cacheFillReader{ReadCloser: reader, cache: c, key: key, fill: fill, pipe: pipeWriter, done: done}, nil
+}
+
+func (c *Cache) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) error {
+	defer c.invalidate(relpath, false)
+	return c.backend.PutReader(relpath, r, afterWrite)
+}
+
+func (c *Cache) List(relpath string) ([]string, error) {
+	return c.backend.List(relpath)
+}
+
+// always asks the backend: a copy in the cache doesn't mean another registry hasn't removed the original
+func (c *Cache) Exists(relpath string) (bool, error) {
+	return c.backend.Exists(relpath)
+}
+
+// always asks the backend, for the same reason as Exists
+func (c *Cache) Size(relpath string) (int64, error) {
+	return c.backend.Size(relpath)
+}
+
+func (c *Cache) Remove(relpath string) error {
+	defer c.invalidate(relpath, false)
+	return c.backend.Remove(relpath)
+}
+
+func (c *Cache) RemoveAll(relpath string) error {
+	defer c.invalidate(relpath, true)
+	return c.backend.RemoveAll(relpath)
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestCache(t *testing.T, backend Storage, maxSize int64) *Cache {
+	s, err := New(&Config{Type: "memory", Memory: backend.(*Memory), Cache: &Cache{
+		Root:    "/tmp/go-docker-registry-cache-test",
+		MaxSize: maxSize,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*Cache)
+}
+
+func TestCacheHitsAndInvalidation(t *testing.T) {
+	os.RemoveAll("/tmp/go-docker-registry-cache-test")
+	defer os.RemoveAll("/tmp/go-docker-registry-cache-test")
+	backend := &Memory{}
+	s := newTestCache(t, backend, 10)
+	readLayer := func(id string) string {
+		reader, err := s.GetReader(ImageLayerPath(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	s.Put(ImageLayerPath("1"), []byte("aaaa"))
+	s.Put(ImageLayerPath("2"), []byte("bbbb"))
+	readLayer("1")
+	readLayer("1")
+	if stats := s.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Files != 1 || stats.HitRate != 0.5 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	// served from the cache even if the backend lost it
+	backend.Put(ImageLayerPath("1"), []byte("lost data"))
+	if content := readLayer("1"); content != "aaaa" {
+		t.Fatalf("Expected cached content, got %q", content)
+	}
+	if size, err := s.Size(ImageLayerPath("1")); err != nil || size != 9 {
+		t.Fatalf("Expected the size in the backend, got %d, %v", size, err)
+	}
+	// but not once it is written through the cache
+	s.Put(ImageLayerPath("1"), []byte("cccc"))
+	if content := readLayer("1"); content != "cccc" {
+		t.Fatalf("Expected new content, got %q", content)
+	}
+
+	// 1 was used more recently than 2, so 2 goes first
+	readLayer("2")
+	readLayer("1")
+	s.Put(ImageJsonPath("3"), []byte("{}"))
+	s.Get(ImageJsonPath("3"))
+	s.Put(ImageAncestryPath("3"), []byte("[]"))
+	s.Get(ImageAncestryPath("3"))
+	if stats := s.Stats(); stats.Evictions != 1 || stats.Size != 8 {
+		t.Fatalf("Unexpected stats after eviction %+v", stats)
+	}
+	if _, err := os.Stat("/tmp/go-docker-registry-cache-test/images/2/layer"); !os.IsNotExist(err) {
+		t.Fatal("Least recently used layer should have been evicted")
+	}
+
+	// tags and the marks of images can change behind the cache's back, so they are never cached
+	s.Put(RepoTagPath("foo", "bar", "latest"), []byte("1"))
+	s.Get(RepoTagPath("foo", "bar", "latest"))
+	s.Put(ImageMarkPath("3"), []byte("true"))
+	s.Get(ImageMarkPath("3"))
+	if stats := s.Stats(); stats.Files != 3 {
+		t.Fatalf("Only image files should be cached, got %+v", stats)
+	}
+	backend.Remove(ImageMarkPath("3"))
+	if exists, _ := s.Exists(ImageMarkPath("3")); exists {
+		t.Fatal("A mark removed from the backend should not exist")
+	}
+
+	if err := s.RemoveAll("/images/3"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := s.Exists(ImageJsonPath("3")); exists {
+		t.Fatal("Removed image should not be served from the cache")
+	}
+
+	// what is cached survives a restart
+	if stats := newTestCache(t, backend, 10).Stats(); stats.Files != 1 || stats.Size != 4 {
+		t.Fatalf("Expected the cached layer to be loaded, got %+v", stats)
+	}
+}
@@ -0,0 +1,123 @@
+package storage_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"registry/storage"
+	"registry/storage/storagetest"
+	"sync"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	storagetest.TestStorage(t, &storage.Local{
+		Root: "/tmp/go-docker-registry-test",
+	})
+}
+
+func TestMemory(t *testing.T) {
+	s, err := storage.New(&storage.Config{Type: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagetest.TestStorage(t, s)
+}
+
+func TestCache(t *testing.T) {
+	os.RemoveAll("/tmp/go-docker-registry-cache-test")
+	defer os.RemoveAll("/tmp/go-docker-registry-cache-test")
+	s, err := storage.New(&storage.Config{Type: "memory", Cache: &storage.Cache{Root: "/tmp/go-docker-registry-cache-test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagetest.TestStorage(t, s)
+}
+
+func TestS3(t *testing.T) {
+	if os.Getenv("TEST_S3_ENDPOINT") != "" {
+		testS3Endpoint(t)
+		return
+	}
+	// read test config. has sensitive data so pass filename in as env variable
+	content, err := ioutil.ReadFile(os.Getenv("TEST_S3_CONFIG"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s3 storage.S3
+	if err := json.Unmarshal(content, &s3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3.Init(); err != nil {
+		t.Fatal(err)
+	}
+	storagetest.TestStorage(t, &s3)
+}
+
+// runs against a local S3 stand-in (e.g. minio) at TEST_S3_ENDPOINT, creating the bucket if it needs to
+func testS3Endpoint(t *testing.T) {
+	s := &storage.S3{
+		Endpoint:  os.Getenv("TEST_S3_ENDPOINT"),
+		PathStyle: true,
+		AllowHTTP: true,
+		Bucket:    os.Getenv("TEST_S3_BUCKET"),
+		Root:      "/go-docker-registry-test",
+		AccessKey: os.Getenv("TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("TEST_S3_SECRET_KEY"),
+	}
+	if s.Bucket == "" {
+		s.Bucket = "go-docker-registry-test"
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.CreateS3Bucket(s); err != nil {
+		t.Fatal(err)
+	}
+	storagetest.TestStorage(t, s)
+}
+
+// a driver from outside the package
+type prefixed struct {
+	storage.Storage
+	Prefix string `json:"prefix"`
+}
+
+func (p *prefixed) Init() error {
+	p.Storage = &storage.Memory{}
+	return p.Storage.(*storage.Memory).Init()
+}
+
+// drivers can't be registered twice, and the test may run more than once (go test -count)
+var registerPrefixed sync.Once
+var prefixedConfig *json.RawMessage
+
+func TestRegister(t *testing.T) {
+	registerPrefixed.Do(func() {
+		storage.Register("prefixed", func(raw json.RawMessage) (storage.Driver, error) {
+			prefixedConfig = &raw
+			p := &prefixed{}
+			return p, json.Unmarshal(raw, p)
+		})
+	})
+	var cfg storage.Config
+	if err := json.Unmarshal([]byte(`{"type": "prefixed", "prefixed": {"prefix": "x"}}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	s, err := storage.New(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := s.(*prefixed); !ok || p.Prefix != "x" || string(*prefixedConfig) != `{"prefix": "x"}` {
+		t.Fatalf("Driver not made from its config block: %#v", s)
+	}
+	if name := storage.TypeName(s); name != "prefixed" {
+		t.Fatalf("Expected type name prefixed, got %s", name)
+	}
+	storagetest.TestStorage(t, s)
+
+	cfg.Type = "nope"
+	if _, err := storage.New(&cfg); err == nil {
+		t.Fatal("Expected an error for an unregistered type")
+	}
+}
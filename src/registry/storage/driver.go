@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Driver is what a storage backend implements. New calls Init once, before anything else is called.
+type Driver interface {
+	Storage
+	Init() error
+}
+
+// A Factory makes a driver from the block of the config named after its type, which is nil if there is none. It
+// shouldn't call Init.
+type Factory func(config json.RawMessage) (Driver, error)
+
+var drivers = struct {
+	sync.RWMutex
+	factories map[string]Factory
+	names     map[string]string // "%T" of the drivers made -> their type
+}{factories: map[string]Factory{}, names: map[string]string{}}
+
+// Register makes a driver available as storage type name. It panics if name is already taken, so call it from the
+// init function of the package implementing the driver.
+func Register(name string, factory Factory) {
+	drivers.Lock()
+	defer drivers.Unlock()
+	if _, ok := drivers.factories[name]; ok {
+		panic("storage: driver registered twice: " + name)
+	}
+	drivers.factories[name] = factory
+}
+
+// decodes config into driver, if there is a config
+func decodeConfig(config json.RawMessage, driver Driver) (Driver, error) {
+	if config == nil {
+		return driver, nil
+	}
+	return driver, json.Unmarshal(config, driver)
+}
+
+func init() {
+	Register("local", func(config json.RawMessage) (Driver, error) {
+		if config == nil {
+			return nil, errors.New("No config for storage type 'local' found")
+		}
+		return decodeConfig(config, &Local{})
+	})
+	Register("s3", func(config json.RawMessage) (Driver, error) {
+		if config == nil {
+			return nil, errors.New("No config for storage type 's3' found")
+		}
+		return decodeConfig(config, &S3{})
+	})
+	Register("memory", func(config json.RawMessage) (Driver, error) {
+		// nothing has to be configured
+		return decodeConfig(config, &Memory{})
+	})
+}
+
+func newDriver(cfg *Config) (Driver, error) {
+	var driver Driver
+	if builtin := cfg.builtin(); builtin != nil {
+		driver = builtin
+	} else {
+		drivers.RLock()
+		factory, ok := drivers.factories[cfg.Type]
+		drivers.RUnlock()
+		if !ok {
+			return nil, errors.New("Invalid storage type: " + cfg.Type)
+		}
+		var err error
+		if driver, err = factory(cfg.blocks[cfg.Type]); err != nil {
+			return nil, err
+		}
+	}
+	drivers.Lock()
+	drivers.names[fmt.Sprintf("%T", driver)] = cfg.Type
+	drivers.Unlock()
+	return driver, driver.Init()
+}
+
+// The configured name of a storage backend (as used in Config.Type)
+func TypeName(s Storage) string {
+	if cache, ok := s.(*Cache); ok {
+		s = cache.Backend()
+	}
+	typeName := fmt.Sprintf("%T", s)
+	drivers.RLock()
+	defer drivers.RUnlock()
+	if name, ok := drivers.names[typeName]; ok {
+		return name
+	}
+	return typeName
+}
+
+// Storages that can say where they keep their data implement Identifier, so two storages of the same type can be
+// told apart
+type Identifier interface {
+	Identity() string
+}
+
+// Identity names s by its type and, if it is an Identifier, where it keeps its data (e.g. "s3:us-east-1/bucket/root")
+func Identity(s Storage) string {
+	if cache, ok := s.(*Cache); ok {
+		s = cache.Backend()
+	}
+	if identifier, ok := s.(Identifier); ok {
+		return TypeName(s) + ":" + identifier.Identity()
+	}
+	return TypeName(s)
+}
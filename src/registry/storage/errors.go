@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+)
+
+// The kinds of failure callers need to tell apart, e.g. to answer 404 rather than 503. Backends return them wrapped
+// in an *Error; use IsNotFound and friends to check for them.
+var (
+	ErrNotFound         = errors.New("no such file or directory")
+	ErrAlreadyExists    = errors.New("file already exists")
+	ErrUploadInProgress = errors.New("upload already in progress")
+	ErrTransient        = errors.New("storage temporarily unavailable")
+	ErrConflict         = errors.New("written concurrently")
+	ErrFull             = errors.New("storage full")
+)
+
+// Error is a failure of one of the kinds above on Path. Err is what the backend said about it, if anything, and is
+// used as the message.
+type Error struct {
+	Kind error
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return e.Kind.Error() + ": " + e.Path
+}
+
+func newError(kind error, relpath string, err error) error {
+	return &Error{Kind: kind, Path: relpath, Err: err}
+}
+
+func isKind(err error, kind error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.Kind == kind
+	}
+	return err == kind
+}
+
+func IsNotFound(err error) bool {
+	return isKind(err, ErrNotFound)
+}
+
+func IsAlreadyExists(err error) bool {
+	return isKind(err, ErrAlreadyExists)
+}
+
+func IsUploadInProgress(err error) bool {
+	return isKind(err, ErrUploadInProgress)
+}
+
+// a PutIfVersion that lost to another write
+func IsConflict(err error) bool {
+	return isKind(err, ErrConflict)
+}
+
+// a write that doesn't fit, like one going over the MaxSize of Memory
+func IsFull(err error) bool {
+	return isKind(err, ErrFull)
+}
+
+// a backend failure that may go away if retried, like S3 being unreachable or answering 5xx
+func IsTransient(err error) bool {
+	if errs, ok := err.(Errors); ok {
+		for _, err := range errs {
+			if IsTransient(err) {
+				return true
+			}
+		}
+		return false
+	}
+	return isKind(err, ErrTransient)
+}
+
+// Errors collects the errors of an operation that carries on past failures
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
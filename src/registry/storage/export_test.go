@@ -0,0 +1,15 @@
+package storage
+
+import (
+	"github.com/crowdmob/goamz/s3"
+)
+
+// for the tests in storage_test, which can't get at the bucket
+func CreateS3Bucket(s *S3) error {
+	if err := s.bucket.PutBucket(s3.Private); err != nil {
+		if s3Err, ok := err.(*s3.Error); !ok || s3Err.Code != "BucketAlreadyOwnedByYou" {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,73 +6,243 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"registry/logger"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// Writes go to a temp file (named LOCAL_TEMP_PREFIX + ...) in the destination directory, which is fsynced and then
+// renamed into place, so a crash never leaves a half written file behind under the real name. Temp files that
+// haven't been touched in LOCAL_TEMP_MAX_AGE are abandoned and swept up on startup.
+const LOCAL_TEMP_PREFIX = ".tmp_"
+const LOCAL_TEMP_MAX_AGE = 10 * time.Minute
+
+// PutIfVersion holds an flock on this file (in Root) while it checks the version and writes, so it also works
+// between registries sharing Root
+const LOCAL_LOCK_FILE = ".lock"
+
 type Local struct {
-	Root string `json:"root"`
+	Root  string `json:"root"`
+	Dedup bool   `json:"dedup"` // store layers with the same content once. see LOCAL_POOL_DIR
 }
 
-func (s *Local) init() error {
-	return os.MkdirAll(s.Root, 0755)
+func (s *Local) Identity() string {
+	if root, err := filepath.Abs(s.Root); err == nil {
+		return root
+	}
+	return s.Root
 }
 
-func (s *Local) createFile(relpath string) (*os.File, error) {
+func (s *Local) Init() error {
+	if err := os.MkdirAll(s.Root, 0755); err != nil {
+		return err
+	}
+	return s.sweepTempFiles()
+}
+
+// removes abandoned temp files. ones still being written to (by another registry sharing the root) are left alone.
+func (s *Local) sweepTempFiles() error {
+	// another registry sharing the root may be sweeping at the same time, so whatever disappears is skipped
+	abandoned := []string{}
+	err := filepath.Walk(s.Root, func(abspath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasPrefix(info.Name(), LOCAL_TEMP_PREFIX) &&
+			time.Since(info.ModTime()) > LOCAL_TEMP_MAX_AGE {
+			abandoned = append(abandoned, abspath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	root := path.Clean(s.Root)
+	for _, abspath := range abandoned {
+		if err := os.Remove(abspath); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for absdir := path.Dir(abspath); absdir != root && s.removeIfEmpty(absdir); absdir = path.Dir(absdir) {
+			// the temp file may have been the first thing written to its directory
+		}
+	}
+	if len(abandoned) > 0 {
+		logger.Info("Removed %d abandoned temp files from %s", len(abandoned), s.Root)
+	}
+	return nil
+}
+
+func (s *Local) createTempFile(relpath string) (*os.File, error) {
 	abspath := path.Join(s.Root, relpath)
 	if err := os.MkdirAll(path.Dir(abspath), 0755); err != nil {
 		return nil, err
 	}
-	return os.OpenFile(abspath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	return ioutil.TempFile(path.Dir(abspath), LOCAL_TEMP_PREFIX+path.Base(abspath)+"_")
+}
+
+// fsyncs the temp file and renames it to relpath. the file is left open.
+func (s *Local) commitTempFile(file *os.File, relpath string) error {
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	abspath := path.Join(s.Root, relpath)
+	if err := os.Rename(file.Name(), abspath); err != nil {
+		return err
+	}
+	// make the rename itself durable
+	dir, err := os.Open(path.Dir(abspath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// types the errors of os calls on relpath
+func localError(relpath string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return newError(ErrNotFound, relpath, err)
+	case os.IsExist(err):
+		return newError(ErrAlreadyExists, relpath, err)
+	}
+	return err
 }
 
 func (s *Local) Get(relpath string) ([]byte, error) {
-	return ioutil.ReadFile(path.Join(s.Root, relpath))
+	data, err := ioutil.ReadFile(path.Join(s.Root, relpath))
+	return data, localError(relpath, err)
 }
 
 func (s *Local) Put(relpath string, data []byte) (err error) {
 	var file *os.File
-	if file, err = s.createFile(relpath); err != nil {
-		return err
+	if file, err = s.createTempFile(relpath); err != nil {
+		return localError(relpath, err)
 	}
 	defer file.Close()
-	_, err = file.Write(data)
-	return err
+	if _, err = file.Write(data); err == nil {
+		err = s.commitTempFile(file, relpath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return localError(relpath, err)
 }
 
-func (s *Local) GetReader(relpath string) (io.ReadCloser, error) {
-	return os.Open(path.Join(s.Root, relpath))
+func (s *Local) GetVersion(relpath string) ([]byte, string, error) {
+	data, err := s.Get(relpath)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, ContentVersion(data), nil
 }
 
-func (s *Local) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) error {
-	file, err := s.createFile(relpath)
+func (s *Local) PutIfVersion(relpath string, data []byte, version string) error {
+	unlock, err := s.lock()
 	if err != nil {
 		return err
 	}
+	defer unlock()
+	current, err := ioutil.ReadFile(path.Join(s.Root, relpath))
+	if err != nil && !os.IsNotExist(err) {
+		return localError(relpath, err)
+	}
+	if err := checkVersion(relpath, current, err == nil, version); err != nil {
+		return err
+	}
+	return s.Put(relpath, data)
+}
+
+// takes the lock on LOCAL_LOCK_FILE, returning the function that releases it
+func (s *Local) lock() (func(), error) {
+	if err := os.MkdirAll(s.Root, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path.Join(s.Root, LOCAL_LOCK_FILE), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+func (s *Local) GetReader(relpath string) (io.ReadCloser, error) {
+	file, err := os.Open(path.Join(s.Root, relpath))
+	if err != nil {
+		return nil, localError(relpath, err)
+	}
+	return file, nil
+}
+
+func (s *Local) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) (err error) {
+	if s.Dedup && isPoolableLayerPath(relpath) {
+		return localError(relpath, s.putDedup(relpath, r, afterWrite))
+	}
+	file, err := s.createTempFile(relpath)
+	if err != nil {
+		return localError(relpath, err)
+	}
 	defer func() {
+		if err != nil {
+			os.Remove(file.Name())
+		}
+		err = localError(relpath, err)
 		file.Seek(0, 0)
 		afterWrite(file)
 		file.Close()
 	}()
-	_, err = io.Copy(file, r)
-	return err
+	if _, err = io.Copy(file, r); err != nil {
+		return err
+	}
+	return s.commitTempFile(file, relpath)
 }
 
 func (s *Local) List(relpath string) ([]string, error) {
 	abspath := path.Join(s.Root, relpath)
 	infos, err := ioutil.ReadDir(abspath)
 	if err != nil {
-		return nil, err
+		return nil, localError(relpath, err)
 	}
 	if len(infos) == 0 {
 		// to be consistent with S3, return no such file or directory here. from docker-registry 0.6.5
-		return nil, errors.New("open " + abspath + ": no such file or directory")
+		return nil, newError(ErrNotFound, relpath, errors.New("open "+abspath+": no such file or directory"))
 	}
-	list := make([]string, len(infos))
-	for i, info := range infos {
-		list[i] = path.Join(relpath, info.Name())
-		if !strings.HasPrefix(list[i], "/") {
-			list[i] = "/" + list[i]
+	list := make([]string, 0, len(infos))
+	isRoot := path.Clean(abspath) == path.Clean(s.Root)
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), LOCAL_TEMP_PREFIX) {
+			// a write in progress
+			continue
 		}
+		if isRoot && (info.Name() == LOCAL_POOL_DIR || info.Name() == LOCAL_LOCK_FILE) {
+			// not part of the key space
+			continue
+		}
+		name := path.Join(relpath, info.Name())
+		if !strings.HasPrefix(name, "/") {
+			name = "/" + name
+		}
+		list = append(list, name)
+	}
+	if len(list) == 0 {
+		return nil, newError(ErrNotFound, relpath, errors.New("open "+abspath+": no such file or directory"))
 	}
 	return list, nil
 }
@@ -89,43 +259,55 @@ func (s *Local) Size(relpath string) (int64, error) {
 	info, err := os.Stat(path.Join(s.Root, relpath))
 	if info == nil || err != nil {
 		// dunno size
-		return -1, err
+		return -1, localError(relpath, err)
 	}
 	return info.Size(), nil
 }
 
 func (s *Local) Remove(relpath string) error {
 	// this is not abspath because Exists uses relpath
-	if ok, err := s.Exists(relpath); !ok || err != nil {
-		return errors.New("no such file or directory: " + relpath)
+	if ok, err := s.Exists(relpath); err != nil {
+		return err
+	} else if !ok {
+		return newError(ErrNotFound, relpath, nil)
 	}
 	abspath := path.Join(s.Root, relpath)
+	info, _ := os.Stat(abspath)
 	err := os.Remove(abspath)
 	if err != nil {
-		return err
+		return localError(relpath, err)
 	}
 	for absdir := path.Dir(abspath); s.removeIfEmpty(absdir); absdir = path.Dir(absdir) {
 		// loop over parent directories and remove them if empty
 		// we do this because that is how s3 looks since it is purely a key-value store
 	}
+	if info != nil {
+		// may have been the last reference to a pooled layer
+		return s.release([]pooledLink{{relpath: relpath, info: info}})
+	}
 	return nil
 }
 
 func (s *Local) RemoveAll(relpath string) error {
 	// this is not abspath because Exists uses relpath
-	if ok, err := s.Exists(relpath); !ok || err != nil {
-		return errors.New("no such file or directory: " + relpath)
+	if ok, err := s.Exists(relpath); err != nil {
+		return err
+	} else if !ok {
+		return newError(ErrNotFound, relpath, nil)
 	}
 	abspath := path.Join(s.Root, relpath)
-	err := os.RemoveAll(abspath)
+	pooled, err := s.pooledFiles(abspath)
 	if err != nil {
 		return err
 	}
+	if err := os.RemoveAll(abspath); err != nil {
+		return err
+	}
 	for absdir := path.Dir(abspath); s.removeIfEmpty(absdir); absdir = path.Dir(absdir) {
 		// loop over parent directires and remove them if empty
 		// we do this because that is how s3 looks since it is purely a key-value store
 	}
-	return nil
+	return s.release(pooled)
 }
 
 func (s *Local) removeIfEmpty(dir string) bool {
@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"registry/logger"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// With Dedup on, layers are stored once in a pool under LOCAL_POOL_DIR named by the sha256 of their content, and
+// images/{id}/layer is a hardlink to the pool file. The link count of a pool file is its reference count (the pool
+// entry itself plus one per layer), so when the last layer pointing at it is removed the pool file is removed too.
+// The pool is not part of the key space: List never returns it.
+//
+// Next to the pool files, .pool/refs/{key} holds the sha256 of the pool file a key is linked to, so removing the
+// key can tell which pool file may have lost its last reference without looking through the whole pool.
+const LOCAL_POOL_DIR = ".pool"
+
+type DedupReport struct {
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
+	Layers    int       `json:"layers"`
+	Converted int       `json:"converted"`
+	Blobs     int       `json:"blobs"`
+	Saved     int64     `json:"saved"` // bytes
+	Freed     int       `json:"freed"` // unreferenced pool files removed
+	Errors    []string  `json:"errors"`
+}
+
+func (r *DedupReport) addError(format string, args ...interface{}) {
+	logger.Error("[Dedup] "+format, args...)
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// images/{id}/layer, the only layer content that goes into the pool (see IsLayerPath for all of it)
+func isPoolableLayerPath(relpath string) bool {
+	parts := strings.Split(strings.TrimPrefix(path.Clean("/"+relpath), "/"), "/")
+	return len(parts) == 3 && parts[0] == "images" && parts[2] == "layer"
+}
+
+func linkCount(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
+
+func (s *Local) poolRoot() string {
+	return path.Join(s.Root, LOCAL_POOL_DIR)
+}
+
+// where the pool files are, as opposed to the refs
+func (s *Local) poolFilesRoot() string {
+	return path.Join(s.poolRoot(), "sha256")
+}
+
+// .pool/sha256/ab/abcdef...
+func (s *Local) poolPath(sum string) string {
+	return path.Join(s.poolFilesRoot(), sum[:2], sum)
+}
+
+func (s *Local) refsRoot() string {
+	return path.Join(s.poolRoot(), "refs")
+}
+
+// .pool/refs/{relpath}
+func (s *Local) refPath(relpath string) string {
+	return path.Join(s.refsRoot(), path.Clean("/"+relpath))
+}
+
+// the sum of the pool file relpath is linked to, or "" if that isn't recorded (linked by an older version)
+func (s *Local) readRef(relpath string) string {
+	content, err := ioutil.ReadFile(s.refPath(relpath))
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
+
+func (s *Local) writeRef(relpath, sum string) error {
+	refPath := s.refPath(relpath)
+	if err := os.MkdirAll(path.Dir(refPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(refPath, []byte(sum), 0644)
+}
+
+// a key that was linked to a pool file, as it was before it was removed
+type pooledLink struct {
+	relpath string
+	info    os.FileInfo
+}
+
+// moves the fsynced temp file into the pool unless the pool already has the same content, in which case the temp
+// file is removed. returns the pool path.
+func (s *Local) addToPool(file *os.File, sum string) (string, bool, error) {
+	poolPath := s.poolPath(sum)
+	if _, err := os.Stat(poolPath); err == nil {
+		return poolPath, false, os.Remove(file.Name())
+	}
+	if err := os.MkdirAll(path.Dir(poolPath), 0755); err != nil {
+		return "", false, err
+	}
+	if err := file.Chmod(0644); err != nil {
+		return "", false, err
+	}
+	if err := file.Sync(); err != nil {
+		return "", false, err
+	}
+	return poolPath, true, os.Rename(file.Name(), poolPath)
+}
+
+// atomically replaces relpath with a hardlink to poolPath, freeing whatever relpath pointed to before if it was the
+// last reference to it
+func (s *Local) linkFromPool(poolPath, relpath string) error {
+	abspath := path.Join(s.Root, relpath)
+	if err := os.MkdirAll(path.Dir(abspath), 0755); err != nil {
+		return err
+	}
+	pooled, err := os.Stat(poolPath)
+	if err != nil {
+		return err
+	}
+	old, _ := os.Stat(abspath)
+	if old != nil && os.SameFile(old, pooled) {
+		return nil
+	}
+	oldSum := s.readRef(relpath)
+	// recorded before linking, so a link never exists without its ref. a ref left behind by a crash before the link
+	// names a pool file relpath isn't linked to, which freePoolFile checks for.
+	if err := s.writeRef(relpath, path.Base(poolPath)); err != nil {
+		return err
+	}
+	link := path.Join(path.Dir(abspath), fmt.Sprintf("%s%s_%d", LOCAL_TEMP_PREFIX, path.Base(abspath),
+		time.Now().UnixNano()))
+	if err := os.Link(poolPath, link); err != nil {
+		return err
+	}
+	if err := os.Rename(link, abspath); err != nil {
+		os.Remove(link)
+		return err
+	}
+	dir, err := os.Open(path.Dir(abspath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return err
+	}
+	if old != nil && linkCount(old) == 2 {
+		// the ref of the old content was just overwritten, so it is freed here rather than by release
+		return s.freePoolFile(oldSum, old)
+	}
+	return nil
+}
+
+// writes r to the pool and links relpath to it
+func (s *Local) putDedup(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) (err error) {
+	if err := os.MkdirAll(s.poolRoot(), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(s.poolRoot(), LOCAL_TEMP_PREFIX)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(file.Name())
+		}
+		// still readable if it was removed because the pool had it already
+		file.Seek(0, 0)
+		afterWrite(file)
+		file.Close()
+	}()
+	hash := sha256.New()
+	if _, err = io.Copy(file, io.TeeReader(r, hash)); err != nil {
+		return err
+	}
+	_, err = s.pool(file, hex.EncodeToString(hash.Sum(nil)), relpath)
+	return err
+}
+
+// adds the temp file to the pool and links relpath to it. returns whether a new pool file was created.
+func (s *Local) pool(file *os.File, sum, relpath string) (bool, error) {
+	poolPath, created, err := s.addToPool(file, sum)
+	if err != nil {
+		return false, err
+	}
+	if err := s.linkFromPool(poolPath, relpath); err != nil {
+		if info, _ := os.Stat(poolPath); created && info != nil && linkCount(info) == 1 {
+			// nothing else linked to it in the meantime
+			os.Remove(poolPath)
+		}
+		return false, err
+	}
+	return created, nil
+}
+
+// release is called with keys that have just been removed. any pool file among them that no longer has other
+// references is removed, and so are their refs.
+func (s *Local) release(removed []pooledLink) error {
+	for _, link := range removed {
+		sum := s.readRef(link.relpath)
+		s.removeRef(link.relpath)
+		// the removed link was counted in info, so 2 means only the pool entry is left
+		if link.info.IsDir() || linkCount(link.info) != 2 {
+			continue
+		}
+		if err := s.freePoolFile(sum, link.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removes the pool file named sum if it is what removed was linked to and nothing else references it anymore
+func (s *Local) freePoolFile(sum string, removed os.FileInfo) error {
+	if sum == "" {
+		return s.releaseLegacy(removed)
+	}
+	poolPath := s.poolPath(sum)
+	info, err := os.Stat(poolPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !os.SameFile(info, removed) || linkCount(info) != 1 {
+		return nil
+	}
+	if err := os.Remove(poolPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.removeIfEmpty(path.Dir(poolPath))
+	return nil
+}
+
+func (s *Local) removeRef(relpath string) {
+	refPath := s.refPath(relpath)
+	if err := os.Remove(refPath); err != nil {
+		return
+	}
+	for absdir := path.Dir(refPath); absdir != s.refsRoot() && s.removeIfEmpty(absdir); absdir = path.Dir(absdir) {
+		// same as the key space
+	}
+}
+
+// links made before refs were recorded have to have their pool file looked for in the whole pool. Deduplicate
+// records the refs of such links, after which this isn't needed anymore.
+func (s *Local) releaseLegacy(removed os.FileInfo) error {
+	unreferenced := ""
+	err := filepath.Walk(s.poolFilesRoot(), func(abspath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() && linkCount(info) == 1 && os.SameFile(info, removed) {
+			unreferenced = abspath
+		}
+		return nil
+	})
+	if err != nil || unreferenced == "" {
+		return err
+	}
+	if err := os.Remove(unreferenced); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.removeIfEmpty(path.Dir(unreferenced))
+	return nil
+}
+
+// keys under abspath that are linked to a pool file
+func (s *Local) pooledFiles(abspath string) ([]pooledLink, error) {
+	pooled := []pooledLink{}
+	err := filepath.Walk(abspath, func(abspath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && linkCount(info) >= 2 {
+			relpath, err := filepath.Rel(s.Root, abspath)
+			if err != nil {
+				return err
+			}
+			pooled = append(pooled, pooledLink{relpath: relpath, info: info})
+		}
+		return nil
+	})
+	return pooled, err
+}
+
+// Deduplicate moves every layer that isn't in the pool yet into it, linking layers with identical content to the
+// same pool file, and removes pool files nothing references anymore. It is meant to be run offline (with dedup
+// turned on in the config afterwards): a layer written while it runs may be missed, or have its pool file removed.
+func (s *Local) Deduplicate() (*DedupReport, error) {
+	report := &DedupReport{StartedAt: time.Now().UTC()}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt).String()
+	}()
+	images, err := ioutil.ReadDir(path.Join(s.Root, "images"))
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		relpath := ImageLayerPath(image.Name())
+		info, err := os.Stat(path.Join(s.Root, relpath))
+		if err != nil {
+			// no layer yet
+			continue
+		}
+		report.Layers++
+		if linkCount(info) > 1 {
+			// already pooled, maybe by a version that didn't record refs
+			if s.readRef(relpath) == "" {
+				if err := s.recordRef(relpath); err != nil {
+					report.addError("%s: %s", relpath, err.Error())
+				}
+			}
+			continue
+		}
+		created, err := s.dedupLayer(relpath)
+		if err != nil {
+			report.addError("%s: %s", relpath, err.Error())
+			continue
+		}
+		report.Converted++
+		if created {
+			report.Blobs++
+		} else {
+			report.Saved += info.Size()
+		}
+	}
+	if err := s.freeUnreferenced(report); err != nil {
+		return nil, err
+	}
+	logger.Info("[Dedup] converted %d of %d layers into %d new blobs, saving %d bytes", report.Converted,
+		report.Layers, report.Blobs, report.Saved)
+	return report, nil
+}
+
+// copies the layer into the pool (rather than linking it in place so an interrupted run changes nothing) and links
+// it back. returns whether a new pool file was created.
+func (s *Local) dedupLayer(relpath string) (created bool, err error) {
+	in, err := os.Open(path.Join(s.Root, relpath))
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(s.poolRoot(), 0755); err != nil {
+		return false, err
+	}
+	file, err := ioutil.TempFile(s.poolRoot(), LOCAL_TEMP_PREFIX)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}()
+	hash := sha256.New()
+	if _, err = io.Copy(file, io.TeeReader(in, hash)); err != nil {
+		return false, err
+	}
+	return s.pool(file, hex.EncodeToString(hash.Sum(nil)), relpath)
+}
+
+// records the ref of a layer that is already linked to a pool file
+func (s *Local) recordRef(relpath string) error {
+	file, err := os.Open(path.Join(s.Root, relpath))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	return s.writeRef(relpath, hex.EncodeToString(hash.Sum(nil)))
+}
+
+// removes pool files that only the pool refers to, which a crash between adding to the pool and linking (or racing
+// removes of the last two references) can leave behind
+func (s *Local) freeUnreferenced(report *DedupReport) error {
+	return filepath.Walk(s.poolFilesRoot(), func(abspath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), LOCAL_TEMP_PREFIX) || linkCount(info) != 1 {
+			return nil
+		}
+		if err := os.Remove(abspath); err != nil {
+			report.addError("%s: %s", abspath, err.Error())
+			return nil
+		}
+		report.Freed++
+		return nil
+	})
+}
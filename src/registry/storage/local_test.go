@@ -1,11 +1,158 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestLocal(t *testing.T) {
-	testStorage(t, &Local{
-		Root: "/tmp/go-docker-registry-test",
-	})
+func TestLocalTempFiles(t *testing.T) {
+	s := &Local{Root: "/tmp/go-docker-registry-temp-test"}
+	os.RemoveAll(s.Root)
+	defer os.RemoveAll(s.Root)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("/dir/1", []byte("lolwtf")); err != nil {
+		t.Fatal(err)
+	}
+	// a crashed write and one still in progress
+	abandoned := path.Join(s.Root, "dir", LOCAL_TEMP_PREFIX+"2_crashed")
+	inProgress := path.Join(s.Root, "dir", LOCAL_TEMP_PREFIX+"3_writing")
+	for _, abspath := range []string{abandoned, inProgress} {
+		if err := ioutil.WriteFile(abspath, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * LOCAL_TEMP_MAX_AGE)
+	os.Chtimes(abandoned, old, old)
+
+	if names, err := s.List("/dir"); err != nil {
+		t.Fatal(err)
+	} else {
+		checkSlices(t, names, []string{"/dir/1"})
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(abandoned); !os.IsNotExist(err) {
+		t.Fatal("Abandoned temp file should have been swept up")
+	}
+	if _, err := os.Stat(inProgress); err != nil {
+		t.Fatal("Temp file still being written should have been left alone")
+	}
+	if content, err := s.Get("/dir/1"); err != nil || string(content) != "lolwtf" {
+		t.Fatalf("Content should be unaffected, got %q, %v", content, err)
+	}
+
+	// registries sharing the root sweep up the same files at the same time
+	for i := 0; i < 100; i++ {
+		abspath := path.Join(s.Root, fmt.Sprintf("sweep%d", i%10), fmt.Sprintf("%s%d_crashed", LOCAL_TEMP_PREFIX, i))
+		os.MkdirAll(path.Dir(abspath), 0755)
+		if err := ioutil.WriteFile(abspath, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(abspath, old, old)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := (&Local{Root: s.Root}).Init(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLocalDedup(t *testing.T) {
+	s := &Local{Root: "/tmp/go-docker-registry-dedup-test"}
+	os.RemoveAll(s.Root)
+	defer os.RemoveAll(s.Root)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// written before dedup was turned on
+	s.Put(ImageLayerPath("1"), []byte("same"))
+	s.Put(ImageLayerPath("2"), []byte("same"))
+	s.Put(ImageLayerPath("3"), []byte("different"))
+	report, err := s.Deduplicate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Layers != 3 || report.Converted != 3 || report.Blobs != 2 || report.Saved != 4 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	s.Dedup = true
+	if err := s.PutReader(ImageLayerPath("4"), strings.NewReader("same"), func(io.ReadSeeker) {}); err != nil {
+		t.Fatal(err)
+	}
+	pooled := s.poolPath(fmt.Sprintf("%x", sha256.Sum256([]byte("same"))))
+	links := func() uint64 {
+		info, err := os.Stat(pooled)
+		if err != nil {
+			return 0
+		}
+		return linkCount(info)
+	}
+	if links() != 4 {
+		t.Fatalf("Expected the pool file and 3 layers to share content, got %d links", links())
+	}
+	if names, err := s.List("/"); err != nil {
+		t.Fatal(err)
+	} else {
+		checkSlices(t, names, []string{"/images"})
+	}
+	if content, err := s.Get(ImageLayerPath("4")); err != nil || string(content) != "same" {
+		t.Fatalf("Expected pooled layer content, got %q, %v", content, err)
+	}
+
+	if s.readRef(ImageLayerPath("4")) != path.Base(pooled) {
+		t.Fatal("The pool file of a layer should be recorded in its ref")
+	}
+
+	if err := s.Remove(ImageLayerPath("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveAll("/images/2"); err != nil {
+		t.Fatal(err)
+	}
+	if links() != 2 {
+		t.Fatalf("Pool file should still be referenced by the last layer, got %d links", links())
+	}
+	if _, err := os.Stat(s.refPath(ImageLayerPath("2"))); !os.IsNotExist(err) {
+		t.Fatal("The ref of a removed layer should be removed")
+	}
+	if err := s.Remove(ImageLayerPath("4")); err != nil {
+		t.Fatal(err)
+	}
+	if links() != 0 {
+		t.Fatal("Pool file should have been freed with its last reference")
+	}
+
+	// linked by a version that didn't record refs
+	os.Remove(s.refPath(ImageLayerPath("3")))
+	if _, err := s.Deduplicate(); err != nil {
+		t.Fatal(err)
+	}
+	if s.readRef(ImageLayerPath("3")) == "" {
+		t.Fatal("Deduplicate should record the refs of pooled layers")
+	}
+	os.Remove(s.refPath(ImageLayerPath("3")))
+	if err := s.Remove(ImageLayerPath("3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.poolPath(fmt.Sprintf("%x", sha256.Sum256([]byte("different"))))); !os.IsNotExist(err) {
+		t.Fatal("Pool file of a layer without a ref should still be freed")
+	}
 }
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Memory keeps everything in a map of path -> content. Directories only exist as the parents of files, so they
+// disappear with their last file like they do on S3 (and on Local, which cleans up empty parents).
+type Memory struct {
+	files map[string][]byte
+	dirs  map[string]int // directory -> how many files are under it
+	size  int64
+	lock  sync.RWMutex
+
+	MaxSize int64 `json:"max_size"` // in bytes. 0 for no limit
+}
+
+func (s *Memory) Init() error {
+	if s.MaxSize < 0 {
+		return errors.New("Memory Max Size can't be negative")
+	}
+	s.files = map[string][]byte{}
+	s.dirs = map[string]int{}
+	return nil
+}
+
+// "/a/b/" -> "a/b", "/" -> ""
+func memoryKey(relpath string) string {
+	return strings.TrimPrefix(path.Clean("/"+relpath), "/")
+}
+
+func notFound(relpath string) error {
+	return newError(ErrNotFound, relpath, nil)
+}
+
+// must hold the lock
+func (s *Memory) isDir(key string) bool {
+	return key == "" || s.dirs[key] > 0
+}
+
+// must hold the write lock. counts the file at key in (by how many) or out of (by -1) its parent directories.
+func (s *Memory) countInDirs(key string, by int) {
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		if s.dirs[dir] += by; s.dirs[dir] == 0 {
+			delete(s.dirs, dir)
+		}
+	}
+}
+
+// must hold the write lock
+func (s *Memory) delete(key string) {
+	s.size -= int64(len(s.files[key]))
+	delete(s.files, key)
+	s.countInDirs(key, -1)
+}
+
+// must hold the write lock. checks that key can be written and that data fits.
+func (s *Memory) store(relpath, key string, data []byte) error {
+	if key == "" || s.isDir(key) {
+		return newError(ErrAlreadyExists, relpath, errors.New("is a directory: "+relpath))
+	}
+	for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+		if _, ok := s.files[dir]; ok {
+			return errors.New("not a directory: " + dir)
+		}
+	}
+	size := s.size - int64(len(s.files[key])) + int64(len(data))
+	if s.MaxSize > 0 && size > s.MaxSize {
+		return newError(ErrFull, relpath, fmt.Errorf("Memory storage full: writing %d bytes to %s would use %d of %d "+
+			"bytes", len(data), relpath, size, s.MaxSize))
+	}
+	if _, ok := s.files[key]; !ok {
+		s.countInDirs(key, 1)
+	}
+	s.files[key] = data
+	s.size = size
+	return nil
+}
+
+func (s *Memory) Get(relpath string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	data, ok := s.files[memoryKey(relpath)]
+	if !ok {
+		return nil, notFound(relpath)
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (s *Memory) Put(relpath string, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.store(relpath, memoryKey(relpath), append([]byte{}, data...))
+}
+
+func (s *Memory) GetVersion(relpath string) ([]byte, string, error) {
+	data, err := s.Get(relpath)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, ContentVersion(data), nil
+}
+
+func (s *Memory) PutIfVersion(relpath string, data []byte, version string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := memoryKey(relpath)
+	current, exists := s.files[key]
+	if err := checkVersion(relpath, current, exists, version); err != nil {
+		return err
+	}
+	return s.store(relpath, key, append([]byte{}, data...))
+}
+
+func (s *Memory) GetReader(relpath string) (io.ReadCloser, error) {
+	data, err := s.Get(relpath)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// The content is only stored once all of r has been read, so a failed write leaves nothing behind. afterWrite gets
+// whatever was read either way.
+func (s *Memory) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) error {
+	var buffer bytes.Buffer
+	defer func() {
+		afterWrite(bytes.NewReader(buffer.Bytes()))
+	}()
+	if s.MaxSize > 0 {
+		// don't read more than could possibly fit
+		s.lock.RLock()
+		r = io.LimitReader(r, s.MaxSize-s.size+int64(len(s.files[memoryKey(relpath)]))+1)
+		s.lock.RUnlock()
+	}
+	if _, err := buffer.ReadFrom(r); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.store(relpath, memoryKey(relpath), buffer.Bytes())
+}
+
+func (s *Memory) List(relpath string) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	key := memoryKey(relpath)
+	prefix := key + "/"
+	if key == "" {
+		prefix = ""
+	}
+	children := map[string]bool{}
+	for name, _ := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			children[strings.SplitN(strings.TrimPrefix(name, prefix), "/", 2)[0]] = true
+		}
+	}
+	if len(children) == 0 {
+		// to be consistent with S3, return no such file or directory here. from docker-registry 0.6.5
+		return nil, notFound(relpath)
+	}
+	list := make([]string, 0, len(children))
+	for child, _ := range children {
+		list = append(list, path.Join("/", key, child))
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+func (s *Memory) Exists(relpath string) (bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	key := memoryKey(relpath)
+	if _, ok := s.files[key]; ok {
+		return true, nil
+	}
+	return s.isDir(key), nil
+}
+
+func (s *Memory) Size(relpath string) (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	data, ok := s.files[memoryKey(relpath)]
+	if !ok {
+		return -1, notFound(relpath)
+	}
+	return int64(len(data)), nil
+}
+
+func (s *Memory) Remove(relpath string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := memoryKey(relpath)
+	if _, ok := s.files[key]; !ok {
+		if s.isDir(key) {
+			return errors.New("directory not empty: " + relpath)
+		}
+		return notFound(relpath)
+	}
+	s.delete(key)
+	return nil
+}
+
+func (s *Memory) RemoveAll(relpath string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := memoryKey(relpath)
+	if _, ok := s.files[key]; !ok && !s.isDir(key) {
+		return notFound(relpath)
+	}
+	for name := range s.files {
+		if key == "" || name == key || strings.HasPrefix(name, key+"/") {
+			s.delete(name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestMemoryMaxSize(t *testing.T) {
+	s := &Memory{MaxSize: 10}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("/a", []byte("12345")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("/b", []byte("123456")); !IsFull(err) {
+		t.Fatal("Writing past the max size should fail")
+	}
+	if err := s.PutReader("/b", bytes.NewBufferString("123456"), func(io.ReadSeeker) {}); !IsFull(err) {
+		t.Fatal("Writing past the max size with PutReader should fail")
+	}
+	if exists, _ := s.Exists("/b"); exists {
+		t.Fatal("A failed write should not leave anything behind")
+	}
+	// replacing a file only counts the difference
+	if err := s.Put("/a", []byte("1234567890")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutReader("/b", bytes.NewBufferString("1234567890"), func(io.ReadSeeker) {}); err != nil {
+		t.Fatal("Removing should free up space: " + err.Error())
+	}
+}
+
+func TestMemoryDirs(t *testing.T) {
+	s := &Memory{}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	s.Put("/a/b/c", []byte("1"))
+	s.Put("/a/b/d", []byte("2"))
+	s.Put("/a/b/d", []byte("3"))
+	if err := s.Put("/a/b", []byte("x")); !IsAlreadyExists(err) {
+		t.Fatalf("Expected /a/b to be a directory, got %v", err)
+	}
+	s.Remove("/a/b/c")
+	if exists, _ := s.Exists("/a/b"); !exists {
+		t.Fatal("/a/b still has a file")
+	}
+	s.Remove("/a/b/d")
+	if exists, _ := s.Exists("/a"); exists {
+		t.Fatal("Directories should go with their last file")
+	}
+	if err := s.Put("/a/b", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,39 +1,130 @@
 package storage
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/crowdmob/goamz/aws"
 	"github.com/crowdmob/goamz/s3"
 	"io"
-	"os"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"path"
+	"registry/logger"
 	"strings"
 	"sync"
 	"time"
 )
 
 const S3_CONTENT_TYPE = "application/binary"
+const S3_MIN_PART_SIZE = 5 // MB
+const S3_LIST_MAX = 1000   // the most keys S3 returns per list request
+const S3_DELETE_MAX = 1000 // the most keys S3 deletes per multi-object delete
 
-var S3_OPTIONS = s3.Options{}
+var S3_ACLS = map[string]s3.ACL{
+	"private":                   s3.Private,
+	"public-read":               s3.PublicRead,
+	"public-read-write":         s3.PublicReadWrite,
+	"authenticated-read":        s3.AuthenticatedRead,
+	"bucket-owner-read":         s3.BucketOwnerRead,
+	"bucket-owner-full-control": s3.BucketOwnerFull,
+}
 var EMPTY_HEADERS = map[string][]string{}
 
 type S3 struct {
-	auth      aws.Auth
-	authLock  sync.RWMutex // lock for the auth so we can update it when we need to
-	region    aws.Region
-	s3        *s3.S3
-	bucket    *s3.Bucket
-	bufferDir *BufferDir // used to buffer content if length is unknown
-	root      string     // sanitized root (no leading slash)
+	auth        aws.Auth
+	authLock    sync.RWMutex // lock for the auth so we can update it when we need to
+	region      aws.Region
+	s3          *s3.S3
+	bucket      *s3.Bucket
+	root        string          // sanitized root (no leading slash)
+	partSize    int             // size of the parts of multipart uploads
+	uploads     map[string]bool // keys with an upload in progress
+	uploadsLock sync.Mutex
+	layers      *s3WriteOptions
+	transient   *s3WriteOptions // layers with the default storage class, for layer content that doesn't stay long
+	metadata    *s3WriteOptions
 
 	Region    string `json:"region"`
 	Bucket    string `json:"bucket"`
 	Root      string `json:"root"`
-	BufferDir string `json:"buffer_dir"`
 	AccessKey string `json:"access_key"`
 	SecretKey string `json:"secret_key"`
+	PartSize  int    `json:"part_size"`  // in MB, 5 (the S3 minimum) by default
+	Endpoint  string `json:"endpoint"`   // url of an S3 compatible store to use instead of an aws region
+	PathStyle bool   `json:"path_style"` // address buckets as endpoint/bucket rather than bucket.endpoint
+	AllowHTTP bool   `json:"allow_http"` // allow a plain http endpoint
+	Insecure  bool   `json:"insecure"`   // don't verify the TLS certificate of an https endpoint. needs path_style.
+	// how objects are written. Layers applies to layer content (layers, blobs, upload chunks, see IsLayerPath),
+	// Metadata to everything else (json, tags, ancestry, checksums, ...), however it is written. Upload chunks and
+	// quarantined layers don't stay long, so they are written in the default storage class: the colder ones bill a
+	// minimum duration and object size.
+	Layers   *S3WriteConfig `json:"layers"`
+	Metadata *S3WriteConfig `json:"metadata"`
+	// no longer used, content is streamed to S3 without being buffered on disk. still accepted so existing configs
+	// keep working, with a warning.
+	BufferDir string `json:"buffer_dir"`
+}
+
+type S3WriteConfig struct {
+	Encryption   string `json:"encryption"`    // server side encryption: "AES256" or "aws:kms". none by default
+	KMSKeyID     string `json:"kms_key_id"`    // with "aws:kms", the key to use instead of the account's default
+	StorageClass string `json:"storage_class"` // e.g. "STANDARD_IA" or "REDUCED_REDUNDANCY". "STANDARD" by default
+	ACL          string `json:"acl"`           // canned acl, "private" by default
+}
+
+type s3WriteOptions struct {
+	acl     s3.ACL
+	options s3.Options
+}
+
+func newS3WriteOptions(cfg *S3WriteConfig) (*s3WriteOptions, error) {
+	o := &s3WriteOptions{acl: s3.Private}
+	if cfg == nil {
+		return o, nil
+	}
+	switch cfg.Encryption {
+	case "":
+	case "AES256":
+		o.options.SSE = true
+	case "aws:kms":
+		o.options.SSEKMS = true
+		o.options.SSEKMSKeyId = cfg.KMSKeyID
+	default:
+		return nil, errors.New("Invalid S3 Encryption (must be AES256 or aws:kms): " + cfg.Encryption)
+	}
+	if cfg.KMSKeyID != "" && cfg.Encryption != "aws:kms" {
+		return nil, errors.New("S3 KMS Key ID given without aws:kms Encryption")
+	}
+	o.options.StorageClass = s3.StorageClass(cfg.StorageClass)
+	if cfg.ACL != "" {
+		var ok bool
+		if o.acl, ok = S3_ACLS[cfg.ACL]; !ok {
+			return nil, errors.New("Invalid S3 ACL: " + cfg.ACL)
+		}
+	}
+	return o, nil
+}
+
+// the headers goamz sets from options, for the calls that take headers instead
+func (o *s3WriteOptions) headers() map[string][]string {
+	headers := map[string][]string{"Content-Type": []string{S3_CONTENT_TYPE}}
+	if o.options.SSE {
+		headers["x-amz-server-side-encryption"] = []string{"AES256"}
+	} else if o.options.SSEKMS {
+		headers["x-amz-server-side-encryption"] = []string{"aws:kms"}
+		if o.options.SSEKMSKeyId != "" {
+			headers["x-amz-server-side-encryption-aws-kms-key-id"] = []string{o.options.SSEKMSKeyId}
+		}
+	}
+	if o.options.StorageClass != "" {
+		headers["x-amz-storage-class"] = []string{string(o.options.StorageClass)}
+	}
+	return headers
 }
 
 func (s *S3) getAuth() (err error) {
@@ -71,95 +162,353 @@ func (s *S3) updateAuthLoop() {
 	}
 }
 
-func (s *S3) init() error {
+func (s *S3) Init() error {
 	if s.Bucket == "" {
 		return errors.New("Please Specify an S3 Bucket")
 	}
-	if s.Region == "" {
-		return errors.New("Please Specify an S3 Region")
+	if s.Region == "" && s.Endpoint == "" {
+		return errors.New("Please Specify an S3 Region or Endpoint")
 	}
 	if s.Root == "" {
 		return errors.New("Please Specify an S3 Root Path")
 	}
-	if s.BufferDir == "" {
-		return errors.New("Please Specify a Buffer Directory to use for Uploads")
+	if s.BufferDir != "" {
+		logger.Info("[S3] buffer_dir is no longer used and can be removed from the config")
+	}
+	if s.PartSize == 0 {
+		s.PartSize = S3_MIN_PART_SIZE
+	} else if s.PartSize < S3_MIN_PART_SIZE {
+		return fmt.Errorf("S3 Part Size must be at least %d MB", S3_MIN_PART_SIZE)
 	}
 
-	var ok bool
-	if s.region, ok = aws.Regions[s.Region]; !ok {
-		return errors.New("Invalid Region: " + s.Region)
+	if s.Endpoint != "" {
+		region, err := s.endpointRegion()
+		if err != nil {
+			return err
+		}
+		s.region = region
+	} else {
+		var ok bool
+		if s.region, ok = aws.Regions[s.Region]; !ok {
+			return errors.New("Invalid Region: " + s.Region)
+		}
 	}
-	err := s.getAuth()
-	if err != nil {
+	var err error
+	if s.layers, err = newS3WriteOptions(s.Layers); err != nil {
 		return err
 	}
-	s.s3 = s3.New(s.auth, s.region)
-	s.bucket = s.s3.Bucket(s.Bucket)
-	if err := os.MkdirAll(s.BufferDir, 0755); err != nil && !os.IsExist(err) {
-		// there was an error and it wasn't that the directory already exists
+	transient := *s.layers
+	transient.options.StorageClass = ""
+	s.transient = &transient
+	if s.metadata, err = newS3WriteOptions(s.Metadata); err != nil {
 		return err
 	}
-	s.bufferDir = &BufferDir{Mutex: sync.Mutex{}, root: s.BufferDir}
+	if err = s.getAuth(); err != nil {
+		return err
+	}
+	s.s3 = s3.New(s.auth, s.region)
+	s.bucket = s.s3.Bucket(s.Bucket)
+	s.partSize = s.PartSize * 1024 * 1024
+	s.uploads = map[string]bool{}
 	s.root = strings.TrimPrefix(s.Root, "/")
 	go s.updateAuthLoop()
 	return nil
 }
 
+// a region for an S3 compatible store (minio, ceph rgw, ...) at s.Endpoint
+func (s *S3) endpointRegion() (aws.Region, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return aws.Region{}, err
+	}
+	if endpoint.Scheme != "https" && !(endpoint.Scheme == "http" && s.AllowHTTP) {
+		return aws.Region{}, errors.New("Invalid S3 Endpoint (must be https, or http with allow_http set): " + s.Endpoint)
+	}
+	if s.Insecure {
+		if endpoint.Scheme != "https" || !s.PathStyle {
+			return aws.Region{}, errors.New("S3 insecure needs an https Endpoint and path_style: " + s.Endpoint)
+		}
+		if endpoint, err = insecureForwarder(endpoint); err != nil {
+			return aws.Region{}, err
+		}
+	}
+	name := s.Region
+	if name == "" {
+		name = "us-east-1"
+	}
+	region := aws.Region{Name: name, S3Endpoint: endpoint.String()}
+	if !s.PathStyle {
+		// goamz fills in ${bucket}
+		region.S3BucketEndpoint = endpoint.Scheme + "://${bucket}." + endpoint.Host
+	}
+	return region, nil
+}
+
+// goamz has no way of changing how it connects, so to not verify the TLS certificate of endpoint, requests go through
+// a forwarder on the loopback interface that doesn't. returns the url of the forwarder, to use instead of endpoint.
+func insecureForwarder(endpoint *url.URL) (*url.URL, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(endpoint)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		// as if the request had been sent to the endpoint
+		r.Host = endpoint.Host
+	}
+	proxy.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	go http.Serve(listener, proxy)
+	logger.Info("[S3] not verifying the TLS certificate of %s, forwarding from %s", endpoint.Host, listener.Addr())
+	return &url.URL{Scheme: "http", Host: listener.Addr().String()}, nil
+}
+
+// where the objects are: the endpoint (or region), bucket and root
+func (s *S3) Identity() string {
+	where := s.Region
+	if s.Endpoint != "" {
+		where = s.Endpoint
+	}
+	return where + "/" + s.Bucket + "/" + strings.Trim(s.Root, "/")
+}
+
+// layer content and metadata may be stored differently, whichever way they are written
+func (s *S3) writeOptions(relpath string) *s3WriteOptions {
+	if !IsLayerPath(relpath) {
+		return s.metadata
+	}
+	switch strings.SplitN(strings.TrimPrefix(path.Clean("/"+relpath), "/"), "/", 2)[0] {
+	case "uploads", "quarantine":
+		return s.transient
+	}
+	return s.layers
+}
+
 func (s *S3) key(relpath string) string {
 	return path.Join(s.root, relpath) // s3 expects no leading slash in some operations
 }
 
+// types the errors S3 (or getting to it) gives for operations on relpath
+func s3Error(relpath string, err error) error {
+	switch typedErr := err.(type) {
+	case nil:
+		return nil
+	case *s3.Error:
+		switch {
+		case typedErr.StatusCode == 404 || typedErr.Code == "NoSuchKey":
+			return newError(ErrNotFound, relpath, err)
+		case typedErr.StatusCode >= 500 || typedErr.Code == "SlowDown" || typedErr.Code == "RequestTimeout":
+			return newError(ErrTransient, relpath, err)
+		}
+	case net.Error:
+		return newError(ErrTransient, relpath, err)
+	}
+	if err == io.ErrUnexpectedEOF {
+		// the connection dropped mid response
+		return newError(ErrTransient, relpath, err)
+	}
+	return err
+}
+
 func (s *S3) Get(relpath string) ([]byte, error) {
 	s.authLock.RLock()
 	defer s.authLock.RUnlock()
-	return s.bucket.Get(s.key(relpath))
+	data, err := s.bucket.Get(s.key(relpath))
+	return data, s3Error(relpath, err)
 }
 
 func (s *S3) Put(relpath string, data []byte) error {
 	s.authLock.RLock()
 	defer s.authLock.RUnlock()
-	return s.bucket.Put(s.key(relpath), data, S3_CONTENT_TYPE, s3.Private, S3_OPTIONS)
+	o := s.writeOptions(relpath)
+	return s3Error(relpath, s.bucket.Put(s.key(relpath), data, S3_CONTENT_TYPE, o.acl, o.options))
+}
+
+func (s *S3) GetVersion(relpath string) ([]byte, string, error) {
+	data, _, err := s.getWithETag(relpath)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, ContentVersion(data), nil
+}
+
+func (s *S3) getWithETag(relpath string) ([]byte, string, error) {
+	s.authLock.RLock()
+	resp, err := s.bucket.GetResponse(s.key(relpath))
+	s.authLock.RUnlock()
+	if err != nil {
+		return nil, "", s3Error(relpath, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", s3Error(relpath, err)
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// a conditional put (If-Match, or If-None-Match for content that must not exist yet). S3 answers 412 if the
+// condition doesn't hold and 409 if another conditional put of the key is in flight. The ETag isn't the version, as
+// it can't be known from the content (it isn't the MD5 with KMS encryption), so the current content is checked
+// against version first and the put made conditional on its ETag.
+func (s *S3) PutIfVersion(relpath string, data []byte, version string) error {
+	o := s.writeOptions(relpath)
+	headers := o.headers()
+	if version == "" {
+		headers["If-None-Match"] = []string{"*"}
+	} else {
+		current, etag, err := s.getWithETag(relpath)
+		if IsNotFound(err) || (err == nil && ContentVersion(current) != version) {
+			return newError(ErrConflict, relpath, err)
+		} else if err != nil {
+			return err
+		}
+		headers["If-Match"] = []string{etag}
+	}
+	s.authLock.RLock()
+	err := s.bucket.PutHeader(s.key(relpath), data, headers, o.acl)
+	s.authLock.RUnlock()
+	if s3Err, ok := err.(*s3.Error); ok && (s3Err.StatusCode == 412 || s3Err.StatusCode == 409) {
+		return newError(ErrConflict, relpath, err)
+	}
+	return s3Error(relpath, err)
 }
 
 func (s *S3) GetReader(relpath string) (io.ReadCloser, error) {
 	s.authLock.RLock()
 	defer s.authLock.RUnlock()
-	return s.bucket.GetReader(s.key(relpath))
+	reader, err := s.bucket.GetReader(s.key(relpath))
+	if err != nil {
+		return nil, s3Error(relpath, err)
+	}
+	return reader, nil
 }
 
-func (s *S3) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) error {
+// PutReader streams r into S3. Content that fits in one part is uploaded with a single put, anything bigger goes
+// through a multipart upload, so at most one part is ever held in memory. afterWrite is given a reader over the stored
+// object, which fetches it back from S3 as it is read: callers that need to look at the content should tee r instead.
+func (s *S3) PutReader(relpath string, r io.Reader, afterWrite func(io.ReadSeeker)) (err error) {
 	key := s.key(relpath)
-	buffer, err := s.bufferDir.reserve(key)
-	if err != nil {
+	if err := s.reserve(key); err != nil {
+		return newError(ErrUploadInProgress, relpath, err)
+	}
+	defer s.release(key)
+	defer func() {
+		err = s3Error(relpath, err)
+	}()
+	o := s.writeOptions(relpath)
+	// grown as it is read, so small objects don't cost a whole part
+	first := &bytes.Buffer{}
+	n, err := io.CopyN(first, r, int64(s.partSize))
+	if err == io.EOF {
+		// fits in a single part
+		s.authLock.RLock()
+		err = s.bucket.PutReader(key, bytes.NewReader(first.Bytes()), n, S3_CONTENT_TYPE, o.acl, o.options)
+		s.authLock.RUnlock()
+		if err != nil {
+			return err
+		}
+		afterWrite(&s3ReadSeeker{s: s, key: key, size: n})
+		return nil
+	} else if err != nil {
 		return err
 	}
-	defer buffer.release(afterWrite)
-	// don't know the length, buffer to file first
-	length, err := io.Copy(buffer, r)
+	size, err := s.putMulti(key, o, first.Bytes(), r)
 	if err != nil {
 		return err
 	}
-	buffer.Seek(0, 0) // seek to the beginning of the file
-	// we know the length, write to s3 from file now
-	return s.bucket.PutReader(s.key(relpath), buffer, length, S3_CONTENT_TYPE, s3.Private, S3_OPTIONS)
+	afterWrite(&s3ReadSeeker{s: s, key: key, size: size})
+	return nil
+}
+
+// uploads first (a full part) and the rest of r as a multipart upload, which is aborted if anything goes wrong
+func (s *S3) putMulti(key string, o *s3WriteOptions, first []byte, r io.Reader) (size int64, err error) {
+	s.authLock.RLock()
+	multi, err := s.bucket.InitMulti(key, S3_CONTENT_TYPE, o.acl, o.options)
+	s.authLock.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			s.authLock.RLock()
+			defer s.authLock.RUnlock()
+			if abortErr := multi.Abort(); abortErr != nil {
+				err = fmt.Errorf("%s (and aborting the upload failed: %s)", err.Error(), abortErr.Error())
+			}
+		}
+	}()
+	parts := []s3.Part{}
+	buffer := first
+	n := len(first)
+	for n > 0 {
+		s.authLock.RLock()
+		part, err := multi.PutPart(len(parts)+1, bytes.NewReader(buffer[:n]))
+		s.authLock.RUnlock()
+		if err != nil {
+			return size, err
+		}
+		parts = append(parts, part)
+		size += int64(n)
+		n, err = io.ReadFull(r, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return size, err
+		}
+	}
+	s.authLock.RLock()
+	defer s.authLock.RUnlock()
+	return size, multi.Complete(parts)
+}
+
+// lists every key and common prefix under prefix, following the markers until the listing isn't truncated
+func (s *S3) listAll(prefix, delim string) ([]s3.Key, []string, error) {
+	keys := []s3.Key{}
+	prefixes := []string{}
+	marker := ""
+	for {
+		result, err := s.bucket.List(prefix, delim, marker, S3_LIST_MAX)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, result.Contents...)
+		prefixes = append(prefixes, result.CommonPrefixes...)
+		if !result.IsTruncated {
+			return keys, prefixes, nil
+		}
+		// NextMarker is only returned when there is a delimiter, otherwise carry on from the last key
+		marker = result.NextMarker
+		if marker == "" && len(result.Contents) > 0 {
+			marker = result.Contents[len(result.Contents)-1].Key
+		}
+		if n := len(result.CommonPrefixes); n > 0 && result.CommonPrefixes[n-1] > marker {
+			marker = result.CommonPrefixes[n-1]
+		}
+		if marker == "" {
+			return nil, nil, errors.New("Truncated listing of " + prefix + " without a marker to continue from")
+		}
+	}
 }
 
 func (s *S3) List(relpath string) ([]string, error) {
 	s.authLock.RLock()
 	defer s.authLock.RUnlock()
-	result, err := s.bucket.List(s.key(relpath)+"/", "/", "", 0)
+	keys, prefixes, err := s.listAll(s.key(relpath)+"/", "/")
 	if err != nil {
-		return nil, err
+		return nil, s3Error(relpath, err)
 	}
-	names := make([]string, len(result.Contents)+len(result.CommonPrefixes))
-	for i, key := range result.Contents {
+	names := make([]string, len(keys)+len(prefixes))
+	for i, key := range keys {
 		names[i] = strings.TrimPrefix(key.Key, s.root)
 		if !strings.HasPrefix(names[i], "/") {
 			names[i] = "/" + names[i]
 		}
 	}
-	for i, prefix := range result.CommonPrefixes {
-		prefixIdx := i+len(result.Contents)
+	for i, prefix := range prefixes {
+		prefixIdx := i + len(keys)
 		// trim trailing "/" and preceeding s.root
 		names[prefixIdx] = strings.TrimPrefix(strings.TrimSuffix(prefix, "/"), s.root)
 		// if there is no preceeding / then add it
@@ -169,7 +518,7 @@ func (s *S3) List(relpath string) ([]string, error) {
 	}
 	if len(names) == 0 {
 		// nothing there. return an error.
-		return nil, errors.New("No keys exist in " + s.key(relpath))
+		return nil, newError(ErrNotFound, relpath, errors.New("No keys exist in "+s.key(relpath)))
 	}
 	return names, nil
 }
@@ -177,7 +526,8 @@ func (s *S3) List(relpath string) ([]string, error) {
 func (s *S3) Exists(relpath string) (bool, error) {
 	s.authLock.RLock()
 	defer s.authLock.RUnlock()
-	return s.bucket.Exists(s.key(relpath))
+	exists, err := s.bucket.Exists(s.key(relpath))
+	return exists, s3Error(relpath, err)
 }
 
 func (s *S3) Size(relpath string) (int64, error) {
@@ -185,7 +535,7 @@ func (s *S3) Size(relpath string) (int64, error) {
 	defer s.authLock.RUnlock()
 	resp, err := s.bucket.Head(s.key(relpath), EMPTY_HEADERS)
 	if err != nil {
-		return -1, err
+		return -1, s3Error(relpath, err)
 	}
 	return resp.ContentLength, nil
 }
@@ -193,64 +543,141 @@ func (s *S3) Size(relpath string) (int64, error) {
 func (s *S3) Remove(relpath string) error {
 	s.authLock.RLock()
 	defer s.authLock.RUnlock()
-	if exists, err := s.bucket.Exists(s.key(relpath)); !exists || err != nil {
-		return errors.New("no such file or directory: " + relpath)
+	if exists, err := s.bucket.Exists(s.key(relpath)); err != nil {
+		return s3Error(relpath, err)
+	} else if !exists {
+		return newError(ErrNotFound, relpath, nil)
 	}
-	return s.bucket.Del(s.key(relpath))
+	return s3Error(relpath, s.bucket.Del(s.key(relpath)))
 }
 
 func (s *S3) RemoveAll(relpath string) error {
 	// find and remove everything "under" it
 	s.authLock.RLock()
 	defer s.authLock.RUnlock()
-	result, err := s.bucket.List(s.key(relpath)+"/", "", "", 0)
+	keys, _, err := s.listAll(s.key(relpath)+"/", "")
 	if err != nil {
-		return err
+		return s3Error(relpath, err)
 	}
-	if len(result.Contents) == 0 {
+	if len(keys) == 0 {
 		// nothing under it, return error
-		return errors.New("no such file or directory " + relpath)
+		return newError(ErrNotFound, relpath, nil)
+	}
+	// delete in batches as big as S3 allows. A batch delete doesn't say which keys it failed to delete, so
+	// whatever is still there afterwards is deleted one key at a time to find out which ones fail and why.
+	tried := map[string]bool{}
+	for start := 0; start < len(keys); start += S3_DELETE_MAX {
+		end := start + S3_DELETE_MAX
+		if end > len(keys) {
+			end = len(keys)
+		}
+		objects := make([]s3.Object, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, s3.Object{Key: key.Key})
+			tried[key.Key] = true
+		}
+		if err := s.bucket.DelMulti(s3.Delete{Quiet: true, Objects: objects}); err != nil {
+			logger.Debug("[S3] deleting %s to %s failed, deleting them one by one: %s", objects[0].Key, objects[len(objects)-1].Key, err.Error())
+		}
 	}
-	for _, key := range result.Contents {
-		s.bucket.Del(key.Key)
+	var errs Errors
+	left, _, err := s.listAll(s.key(relpath)+"/", "")
+	if err != nil {
+		return s3Error(relpath, err)
+	}
+	for _, key := range left {
+		if !tried[key.Key] {
+			// written after it was listed, not ours to remove
+			continue
+		}
+		if err := s.bucket.Del(key.Key); err != nil {
+			keyErr := fmt.Errorf("deleting %s: %s", key.Key, err.Error())
+			if typedErr, ok := s3Error(relpath, err).(*Error); ok {
+				// keep the kind of failure, with the key in the message
+				typedErr.Err = keyErr
+				keyErr = typedErr
+			}
+			errs = append(errs, keyErr)
+		}
 	}
 	// finally, remove it if needed
-	return s.bucket.Del(s.key(relpath))
+	if err := s.bucket.Del(s.key(relpath)); err != nil {
+		errs = append(errs, s3Error(relpath, err))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 // This will ensure that we don't try to upload the same thing from two different requests at the same time
-type BufferDir struct {
-	sync.Mutex
-	root string
-}
-
-func (b *BufferDir) reserve(key string) (*Buffer, error) {
-	b.Lock()
-	defer b.Unlock()
-	// sha key path and create temporary file
-	filepath := path.Join(b.root, fmt.Sprintf("%x", sha256.Sum256([]byte(key))))
-	if _, err := os.Stat(filepath); !os.IsNotExist(err) {
-		// buffer file already exists
-		return nil, errors.New("Upload already in progress for key " + key)
-	}
-	// if not exist, create buffer file
-	file, err := os.Create(filepath)
-	if err != nil {
-		return nil, err
+func (s *S3) reserve(key string) error {
+	s.uploadsLock.Lock()
+	defer s.uploadsLock.Unlock()
+	if s.uploads[key] {
+		return errors.New("Upload already in progress for key " + key)
+	}
+	s.uploads[key] = true
+	return nil
+}
+
+func (s *S3) release(key string) {
+	s.uploadsLock.Lock()
+	defer s.uploadsLock.Unlock()
+	delete(s.uploads, key)
+}
+
+// Reads an object back from S3, starting a new ranged get whenever it is seeked
+type s3ReadSeeker struct {
+	s      *S3
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3ReadSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		headers := map[string][]string{"Range": []string{fmt.Sprintf("bytes=%d-", r.offset)}}
+		r.s.authLock.RLock()
+		resp, err := r.s.bucket.GetResponseWithHeaders(r.key, headers)
+		r.s.authLock.RUnlock()
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF {
+		r.close()
 	}
-	return &Buffer{File: *file, dir: b}, nil
+	return n, err
 }
 
-type Buffer struct {
-	os.File
-	dir *BufferDir
+func (r *s3ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 1:
+		offset += r.offset
+	case 2:
+		offset += r.size
+	}
+	if offset < 0 {
+		return r.offset, errors.New("Seek to negative offset")
+	}
+	if offset != r.offset {
+		r.close()
+		r.offset = offset
+	}
+	return r.offset, nil
 }
 
-func (b *Buffer) release(beforeRelease func(io.ReadSeeker)) {
-	b.dir.Lock()
-	defer b.dir.Unlock()
-	b.Seek(0, 0)
-	beforeRelease(&b.File)
-	b.Close()
-	os.Remove(b.Name())
+func (r *s3ReadSeeker) close() {
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
 }
@@ -1,16 +1,120 @@
 package storage
 
 import (
-	"os"
+	"errors"
+	"github.com/crowdmob/goamz/s3"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 )
 
-func TestS3(t *testing.T) {
-	// read test config. has sensitive data so pass filename in as env variable
-	var s3 S3
-	err := storageFromFile(os.Getenv("TEST_S3_CONFIG"), &s3)
+func TestNewS3WriteOptions(t *testing.T) {
+	o, err := newS3WriteOptions(nil)
+	if err != nil || o.acl != s3.Private || o.options.SSE || o.options.SSEKMS {
+		t.Fatalf("Defaults should be private and unencrypted, got %+v, %v", o, err)
+	}
+	o, err = newS3WriteOptions(&S3WriteConfig{Encryption: "aws:kms", KMSKeyID: "key", StorageClass: "STANDARD_IA",
+		ACL: "bucket-owner-full-control"})
 	if err != nil {
 		t.Fatal(err)
 	}
-	testStorage(t, &s3)
+	if !o.options.SSEKMS || o.options.SSEKMSKeyId != "key" || o.options.StorageClass != "STANDARD_IA" ||
+		o.acl != s3.BucketOwnerFull {
+		t.Fatalf("Options not applied: %+v", o)
+	}
+	for _, cfg := range []*S3WriteConfig{{Encryption: "rot13"}, {Encryption: "AES256", KMSKeyID: "key"}, {ACL: "secret"}} {
+		if _, err := newS3WriteOptions(cfg); err == nil {
+			t.Fatalf("Expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestS3Error(t *testing.T) {
+	notFound := s3Error("a", &s3.Error{StatusCode: 404, Code: "NoSuchKey"})
+	if !IsNotFound(notFound) {
+		t.Fatalf("Expected a not found error, got %#v", notFound)
+	}
+	for _, err := range []error{&s3.Error{StatusCode: 503, Code: "SlowDown"}, &s3.Error{StatusCode: 500},
+		&net.OpError{Op: "dial", Err: errors.New("connection refused")}, io.ErrUnexpectedEOF} {
+		if !IsTransient(s3Error("a", err)) {
+			t.Fatalf("Expected %#v to be transient", err)
+		}
+	}
+	if err := s3Error("a", &s3.Error{StatusCode: 403, Code: "AccessDenied"}); IsNotFound(err) || IsTransient(err) {
+		t.Fatalf("Access denied should be left untyped, got %#v", err)
+	}
+}
+
+func TestS3WriteHeaders(t *testing.T) {
+	o, err := newS3WriteOptions(&S3WriteConfig{Encryption: "aws:kms", KMSKeyID: "key", StorageClass: "STANDARD_IA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := o.headers()
+	for name, value := range map[string]string{
+		"Content-Type":                                S3_CONTENT_TYPE,
+		"x-amz-server-side-encryption":                "aws:kms",
+		"x-amz-server-side-encryption-aws-kms-key-id": "key",
+		"x-amz-storage-class":                         "STANDARD_IA",
+	} {
+		if len(headers[name]) != 1 || headers[name][0] != value {
+			t.Errorf("Expected %s: %s, got %v", name, value, headers[name])
+		}
+	}
+}
+
+func TestS3WriteOptionsByKey(t *testing.T) {
+	s := &S3{layers: &s3WriteOptions{acl: s3.PublicRead}, transient: &s3WriteOptions{acl: s3.PublicRead},
+		metadata: &s3WriteOptions{acl: s3.Private}}
+	for relpath, layer := range map[string]bool{
+		ImageLayerPath("abc"):                  true,
+		BlobPath("sha256:00"):                  true,
+		ImageJsonPath("abc"):                   false,
+		ImageChecksumPath("abc"):               false,
+		UploadStatePath("uuid"):                false,
+		RepoTagPath("library", "app", "layer"): false,
+		"/images/abc/layer/../json":            false,
+	} {
+		if o := s.writeOptions(relpath); (o == s.layers) != layer {
+			t.Errorf("%s: expected layer options %t", relpath, layer)
+		}
+	}
+	// short-lived layer content
+	for _, relpath := range []string{UploadChunkPath("uuid", 0, "id"), "/quarantine/images/abc/layer"} {
+		if o := s.writeOptions(relpath); o != s.transient {
+			t.Errorf("%s: expected transient layer options", relpath)
+		}
+	}
+}
+
+func TestS3InsecureForwarder(t *testing.T) {
+	// httptest's certificate isn't trusted
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.Path))
+	}))
+	defer server.Close()
+	endpoint, _ := url.Parse(server.URL + "/root")
+	if _, err := http.Get(endpoint.String()); err == nil {
+		t.Fatal("Expected the endpoint's certificate not to verify")
+	}
+	forwarder, err := insecureForwarder(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(forwarder.String() + "/bucket/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != endpoint.Host+"/root/bucket/key" {
+		t.Fatalf("Expected the request to reach the endpoint as sent to it, got %q", body)
+	}
+	s := &S3{Endpoint: server.URL, Insecure: true}
+	if _, err := s.endpointRegion(); err == nil {
+		t.Fatal("insecure should need path_style")
+	}
 }
@@ -1,17 +1,17 @@
 package storage
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"io"
 	"path"
+	"strings"
 )
 
 const TAG_PREFIX = "tag_"
 
+// Storage is what the rest of the registry uses. see Driver for implementing a backend.
 type Storage interface {
-	init() error
-
 	Get(string) ([]byte, error)
 	Put(string, []byte) error
 	GetReader(string) (io.ReadCloser, error)
@@ -21,29 +21,61 @@ type Storage interface {
 	Size(string) (int64, error)
 	Remove(string) error
 	RemoveAll(string) error
+
+	// GetVersion is Get, plus the version of the content (see ContentVersion) to pass to PutIfVersion
+	GetVersion(string) ([]byte, string, error)
+	// PutIfVersion is Put if the content is still at version ("" for not existing yet). Otherwise it fails with an
+	// error IsConflict is true for. see Update
+	PutIfVersion(string, []byte, string) error
 }
 
+// Type picks the driver (see Register), which is configured by the block named after it, e.g. "local" for
+// {"type": "local", "local": {"root": "/var/lib/registry"}}. The built in drivers can also be configured in code
+// with the fields below, which take precedence.
 type Config struct {
 	Type  string `json:"type"`
-	Local *Local `json:"local"`
-	S3    *S3    `json:"s3"`
+	Cache *Cache `json:"cache"` // optional, caches reads from the storage above on local disk
+
+	Local  *Local  `json:"-"`
+	S3     *S3     `json:"-"`
+	Memory *Memory `json:"-"`
+
+	blocks map[string]json.RawMessage
+}
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &c.blocks); err != nil {
+		return err
+	}
+	// everything but the blocks
+	type plain Config
+	return json.Unmarshal(data, (*plain)(c))
+}
+
+// the built in driver configured in code for Type, if there is one
+func (c *Config) builtin() Driver {
+	switch {
+	case c.Type == "local" && c.Local != nil:
+		return c.Local
+	case c.Type == "s3" && c.S3 != nil:
+		return c.S3
+	case c.Type == "memory" && c.Memory != nil:
+		return c.Memory
+	}
+	return nil
 }
 
 func New(cfg *Config) (Storage, error) {
-	switch cfg.Type {
-	case "local":
-		if cfg.Local != nil {
-			return cfg.Local, cfg.Local.init()
-		}
-		return nil, errors.New("No config for storage type 'local' found")
-	case "s3":
-		if cfg.S3 != nil {
-			return cfg.S3, cfg.S3.init()
-		}
-		return nil, errors.New("No config for storage type 's3' found")
-	default:
-		return nil, errors.New("Invalid storage type: " + cfg.Type)
+	driver, err := newDriver(cfg)
+	if err != nil || cfg.Cache == nil {
+		return driver, err
 	}
+	cfg.Cache.backend = driver
+	return cfg.Cache, cfg.Cache.Init()
+}
+
+func ImageDir(id string) string {
+	return fmt.Sprintf("images/%s", id)
 }
 
 func ImageJsonPath(id string) string {
@@ -54,6 +86,11 @@ func ImageMarkPath(id string) string {
 	return fmt.Sprintf("images/%s/_inprogress", id)
 }
 
+// where the reaper moves abandoned uploads to if told to keep them
+func QuarantineDir(id string) string {
+	return fmt.Sprintf("quarantine/images/%s", id)
+}
+
 func ImageChecksumPath(id string) string {
 	return fmt.Sprintf("images/%s/_checksum", id)
 }
@@ -96,3 +133,112 @@ func RepoIndexImagesPath(namespace, repo string) string {
 func RepoPrivatePath(namespace, repo string) string {
 	return fmt.Sprintf("repositories/%s/_private", path.Join(namespace, repo))
 }
+
+// when the repository's tags were last fetched from the upstream registry in mirror mode
+func RepoMirroredPath(namespace, repo string) string {
+	return fmt.Sprintf("repositories/%s/_mirrored", path.Join(namespace, repo))
+}
+
+// digestPath turns "sha256:abc..." into "sha256/abc..." so digests map onto a directory per algorithm
+func digestPath(digest string) string {
+	return strings.Replace(digest, ":", "/", 1)
+}
+
+func BlobDir(digest string) string {
+	return fmt.Sprintf("blobs/%s", digestPath(digest))
+}
+
+func BlobPath(digest string) string {
+	return fmt.Sprintf("blobs/%s/data", digestPath(digest))
+}
+
+// the repositories linking a blob. kept apart from the blob, which never changes once written.
+func BlobRepositoriesPath(digest string) string {
+	return fmt.Sprintf("blob_repositories/%s", digestPath(digest))
+}
+
+// a blob pushed to or mounted into a repository, which is what lets the repository serve it
+func RepoBlobLinkPath(namespace, repo, digest string) string {
+	return fmt.Sprintf("repositories/%s/_layers/%s", path.Join(namespace, repo), digestPath(digest))
+}
+
+func ManifestRevisionPath(namespace, repo, digest string) string {
+	if digest == "" {
+		return fmt.Sprintf("repositories/%s/_manifests/revisions", path.Join(namespace, repo))
+	}
+	return fmt.Sprintf("repositories/%s/_manifests/revisions/%s", path.Join(namespace, repo), digestPath(digest))
+}
+
+func ManifestTagPath(namespace, repo, tag string) string {
+	if tag == "" {
+		return fmt.Sprintf("repositories/%s/_manifests/tags", path.Join(namespace, repo))
+	}
+	return fmt.Sprintf("repositories/%s/_manifests/tags/%s", path.Join(namespace, repo), tag)
+}
+
+func UserPath(username string) string {
+	return fmt.Sprintf("users/%s/json", username)
+}
+
+func SearchIndexPath() string {
+	return "_search/index"
+}
+
+// the images gc found unreachable and when it first did
+func GCCandidatesPath() string {
+	return "_gc/candidates"
+}
+
+func PrivateIndexPath() string {
+	return "_private/index"
+}
+
+// the repositories that may reference an image, see layers.CanReadImage
+func ImageRepositoriesPath(imageID string) string {
+	return fmt.Sprintf("_private/images/%s", imageID)
+}
+
+// written once the image repositories have been built from every repository
+func ImageRepositoriesBuiltPath() string {
+	return "_private/images_built"
+}
+
+// the layers the scrubber found corrupt
+func ScrubResultsPath() string {
+	return "_scrub/corrupt"
+}
+
+func StatusProbePath(id string) string {
+	return fmt.Sprintf("_status/probe_%s", id)
+}
+
+// IsLayerPath says whether relpath holds layer content (the layers of images, blobs and the chunks of uploads)
+// rather than metadata, which backends may store differently
+func IsLayerPath(relpath string) bool {
+	parts := strings.Split(strings.TrimPrefix(path.Clean("/"+relpath), "/"), "/")
+	if len(parts) == 4 && parts[0] == "quarantine" {
+		parts = parts[1:]
+	}
+	switch {
+	case len(parts) == 3 && parts[0] == "images":
+		return parts[2] == "layer"
+	case len(parts) == 4 && parts[0] == "blobs":
+		return parts[3] == "data"
+	case len(parts) == 4 && parts[0] == "uploads":
+		return parts[2] == "chunks"
+	}
+	return false
+}
+
+func UploadPath(uuid string) string {
+	return fmt.Sprintf("uploads/%s", uuid)
+}
+
+func UploadStatePath(uuid string) string {
+	return fmt.Sprintf("uploads/%s/state", uuid)
+}
+
+// chunks are zero padded by offset so they list in order. id keeps chunks sent concurrently for the same offset apart.
+func UploadChunkPath(uuid string, offset int64, id string) string {
+	return fmt.Sprintf("uploads/%s/chunks/%020d_%s", uuid, offset, id)
+}
@@ -0,0 +1,245 @@
+// Package storagetest has the conformance tests storage drivers are expected to pass
+package storagetest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"registry/storage"
+	"testing"
+)
+
+// CheckSlices fails t unless got and expected have the same elements, in any order
+func CheckSlices(t *testing.T, got, expected []string) {
+	diffMap := map[string]int{}
+	for _, val := range got {
+		diffMap[val]++
+	}
+	for _, val := range expected {
+		diffMap[val]--
+		if diffMap[val] == 0 {
+			delete(diffMap, val)
+		}
+	}
+	if len(diffMap) == 0 {
+		return
+	}
+	t.Fatalf("Slices not equal. got %+v, expected %+v", got, expected)
+}
+
+// TestStorage checks that s behaves like the built in storages do: listing an empty directory is an error, removing
+// the last file in a directory removes the directory, and so on. Everything in s is removed.
+func TestStorage(t *testing.T, s storage.Storage) {
+	// remove all to initialize
+	s.RemoveAll("/")
+	if _, err := s.List("/"); err == nil {
+		t.Fatal("According to docker 0.6.5, listing an empty directory should return an error")
+	}
+
+	testGetPutExistsSizeRemove(t, s)
+	testGetPutReaders(t, s)
+	testListRemoveAll(t, s)
+	testPutIfVersion(t, s)
+
+	// cleanup
+	s.RemoveAll("/")
+	if _, err := s.List("/"); err == nil {
+		t.Fatal("According to docker 0.6.5, listing an empty directory should return an error")
+	}
+}
+
+func testGetPutExistsSizeRemove(t *testing.T, s storage.Storage) {
+	if exists, _ := s.Exists("/1"); exists == true {
+		t.Fatal("Key should not exist yet")
+	}
+	if _, err := s.Get("/1"); !storage.IsNotFound(err) {
+		t.Fatalf("Getting something that doesn't exist should cause a not found error, got %v", err)
+	}
+	if err := s.Remove("/1"); !storage.IsNotFound(err) {
+		t.Fatalf("Removing something that doesn't exist should cause a not found error, got %v", err)
+	}
+	if err := s.Put("/1", []byte("lolwtf")); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := s.Exists("/1"); exists == false {
+		t.Fatal("Key should exist now")
+	}
+	if size, err := s.Size("/1"); err != nil {
+		t.Fatal("Size should not result in an error")
+	} else if size != int64(len("lolwtf")) {
+		t.Fatalf("Size should be %d", len("lolwtf"))
+	}
+	if content, err := s.Get("/1"); err != nil {
+		t.Fatal(err)
+	} else if string(content) != "lolwtf" {
+		t.Log("the content should be 'lolwtf' was '" + string(content) + "'")
+		t.FailNow()
+	}
+	if err := s.Remove("/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.List("/"); err == nil {
+		t.Fatal("According to docker 0.6.5, listing an empty directory should return an error")
+	}
+}
+
+func testGetPutReaders(t *testing.T, s storage.Storage) {
+	if exists, _ := s.Exists("/dir/1"); exists == true {
+		t.Fatal("Key should not exist yet")
+	}
+	if _, err := s.GetReader("/dir/1"); !storage.IsNotFound(err) {
+		t.Fatalf("Getting something that doesn't exist should cause a not found error, got %v", err)
+	}
+	if err := s.Remove("/dir/1"); err == nil {
+		t.Fatal("Removing something that doesn't exist should cause an error")
+	}
+	fileSize := int64(-1)
+	afterWrite := func(file io.ReadSeeker) {
+		size, err := file.Seek(0, 2)
+		if err != nil {
+			fileSize = -2
+			return
+		}
+		fileSize = size
+	}
+	if err := s.PutReader("/dir/1", bytes.NewBufferString("lolwtfdir"), afterWrite); err != nil {
+		t.Fatal(err)
+	}
+	if fileSize == -1 {
+		t.Fatal("afterWrite should have been called!")
+	} else if fileSize == -2 {
+		t.Fatal("afterWrite should have a proper handle on a file!")
+	} else if fileSize != int64(len("lolwtfdir")) {
+		t.Fatal("afterWrite should have the correct file size!")
+	}
+	if size, err := s.Size("/dir/1"); err != nil {
+		t.Fatal("Size should not result in an error")
+	} else if size != int64(len("lolwtfdir")) {
+		t.Fatalf("Size should be %d", len("lolwtfdir"))
+	}
+	if exists, _ := s.Exists("/dir/1"); exists == false {
+		t.Fatal("Key should exist now")
+	}
+	if reader, err := s.GetReader("/dir/1"); err != nil {
+		t.Fatal(err)
+	} else {
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "lolwtfdir" {
+			t.Log("the content should be 'lolwtfdir' was '" + string(content) + "'")
+			t.FailNow()
+		}
+	}
+	if err := s.Remove("/dir/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.List("/dir"); err == nil {
+		t.Fatal("According to docker 0.6.5, listing an empty directory should return an error")
+	}
+	if names, err := s.List("/"); err == nil {
+		// this tests to make sure empty directories are removed (s3 behavior exists on all storages)
+		t.Fatalf("According to docker 0.6.5, listing an empty directory should return an error, got %+v", names)
+	}
+}
+
+func testListRemoveAll(t *testing.T, s storage.Storage) {
+	if err := s.Put("/dir/1", []byte("lolwtfdir1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("/dir/2", []byte("lolwtfdir2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("/dir/3", []byte("lolwtfdir3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("/anotherdir/1", []byte("lolwtfanotherdir1")); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := s.List("/"); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 2 {
+		t.Fatal("There should be two names in the directory list")
+	} else {
+		CheckSlices(t, names, []string{"/dir", "/anotherdir"})
+	}
+	if names, err := s.List("/dir"); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 3 {
+		t.Fatal("There should be three names in the directory list")
+	} else {
+		CheckSlices(t, names, []string{"/dir/1", "/dir/2", "/dir/3"})
+	}
+	if names, err := s.List("/anotherdir/"); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 1 {
+		t.Fatal("There should be one name in the directory list")
+	} else {
+		CheckSlices(t, names, []string{"/anotherdir/1"})
+	}
+	if err := s.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := s.List("/"); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 1 {
+		t.Fatal("There should be one name in the directory list")
+	} else {
+		CheckSlices(t, names, []string{"/anotherdir"})
+	}
+	if _, err := s.List("/dir"); err == nil {
+		t.Fatal("According to docker 0.6.5, listing an empty directory should return an error")
+	}
+	if names, err := s.List("/anotherdir"); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 1 {
+		t.Fatal("There should be one name in the directory list")
+	} else {
+		CheckSlices(t, names, []string{"/anotherdir/1"})
+	}
+	if err := s.RemoveAll("/anotherdir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.List("/"); err == nil {
+		t.Fatal("According to docker 0.6.5, listing an empty directory should return an error")
+	}
+	if _, err := s.List("/dir"); err == nil {
+		t.Fatal("According to docker 0.6.5, listing an empty directory should return an error")
+	}
+	if _, err := s.List("/anotherdir"); err == nil {
+		t.Fatal("According to docker 0.6.5, listing an empty directory should return an error")
+	}
+}
+
+func testPutIfVersion(t *testing.T, s storage.Storage) {
+	if _, _, err := s.GetVersion("/versioned"); !storage.IsNotFound(err) {
+		t.Fatalf("Getting the version of something that doesn't exist should cause a not found error, got %v", err)
+	}
+	if err := s.PutIfVersion("/versioned", []byte("1"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutIfVersion("/versioned", []byte("2"), ""); !storage.IsConflict(err) {
+		t.Fatalf("Creating something that exists should cause a conflict, got %v", err)
+	}
+	content, version, err := s.GetVersion("/versioned")
+	if err != nil {
+		t.Fatal(err)
+	} else if string(content) != "1" {
+		t.Fatalf("the content should be '1' was '%s'", content)
+	}
+	if err := s.PutIfVersion("/versioned", []byte("2"), version); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutIfVersion("/versioned", []byte("3"), version); !storage.IsConflict(err) {
+		t.Fatalf("Writing over a version that was replaced should cause a conflict, got %v", err)
+	}
+	if content, err := s.Get("/versioned"); err != nil {
+		t.Fatal(err)
+	} else if string(content) != "2" {
+		t.Fatalf("the content should be '2' was '%s'", content)
+	}
+	if err := s.Remove("/versioned"); err != nil {
+		t.Fatal(err)
+	}
+}
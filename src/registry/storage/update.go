@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"registry/logger"
+	"time"
+)
+
+// how many times Update starts over when relpath is written under it
+const UPDATE_RETRIES = 10
+
+// Update reads relpath and writes what change makes of its content (nil if it doesn't exist yet), unless relpath
+// was written in the meantime, in which case it starts over. This is how to change shared content (indexes and
+// such) without losing concurrent changes. change returning nil content means nothing needs to be written.
+func Update(s Storage, relpath string, change func([]byte) ([]byte, error)) error {
+	for attempt := 0; ; attempt++ {
+		content, version, err := s.GetVersion(relpath)
+		if IsNotFound(err) {
+			content, version = nil, ""
+		} else if err != nil {
+			return err
+		}
+		updated, err := change(content)
+		if err != nil || updated == nil {
+			return err
+		}
+		err = s.PutIfVersion(relpath, updated, version)
+		if !IsConflict(err) || attempt == UPDATE_RETRIES {
+			return err
+		}
+		logger.Debug("[Update] %s was written concurrently, retrying", relpath)
+		// so the writers that collided don't keep colliding
+		time.Sleep(time.Duration(rand.Intn(10*(attempt+1))) * time.Millisecond)
+	}
+}
+
+// ContentVersion is the version of data: GetVersion returns it and PutIfVersion checks against it, so whoever wrote
+// data knows its version without reading it back
+func ContentVersion(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// checks that the version of current (nil if it doesn't exist) is version
+func checkVersion(relpath string, current []byte, exists bool, version string) error {
+	if (!exists && version == "") || (exists && version != "" && ContentVersion(current) == version) {
+		return nil
+	}
+	return newError(ErrConflict, relpath, nil)
+}
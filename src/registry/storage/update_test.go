@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpdateConcurrently(t *testing.T) {
+	local := &Local{Root: "/tmp/go-docker-registry-update-test"}
+	os.RemoveAll(local.Root)
+	defer os.RemoveAll(local.Root)
+	for _, s := range []Storage{local, &Memory{}} {
+		if err := s.(Driver).Init(); err != nil {
+			t.Fatal(err)
+		}
+		// every writer appends its letter, none may be lost
+		letters := "abcdefgh"
+		wg := sync.WaitGroup{}
+		for _, letter := range letters {
+			wg.Add(1)
+			go func(letter rune) {
+				defer wg.Done()
+				err := Update(s, "/index", func(content []byte) ([]byte, error) {
+					return append(content, byte(letter)), nil
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}(letter)
+		}
+		wg.Wait()
+		content, err := s.Get("/index")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) != len(letters) {
+			t.Fatalf("%T: expected %d updates, got '%s'", s, len(letters), content)
+		}
+		for _, letter := range letters {
+			if !strings.ContainsRune(string(content), letter) {
+				t.Fatalf("%T: update %c was lost, got '%s'", s, letter, content)
+			}
+		}
+		// nothing to write
+		if err := Update(s, "/index", func([]byte) ([]byte, error) { return nil, nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+)
+
+// Walk calls fn with the path of every file under relpath (without the leading /), in order. What can be listed is
+// a directory and anything else is taken for a file, which is the only way to tell them apart on every backend.
+func Walk(s Storage, relpath string, fn func(relpath string) error) error {
+	entries, err := s.List(relpath)
+	if err != nil {
+		return err
+	}
+	sort.Strings(entries)
+	for _, entry := range entries {
+		entry = strings.TrimPrefix(entry, "/")
+		if _, err := s.List(entry); err == nil {
+			if err := Walk(s, entry, fn); err != nil {
+				return err
+			}
+		} else if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}